@@ -12,6 +12,7 @@ import (
 	"runtime"
 	"strings"
 	"syscall"
+	"time"
 
 	pb "github.com/t7a/pitbase/db"
 
@@ -64,32 +65,69 @@ func getGID() uint64 {
 */
 
 type Opts struct {
-	Init       bool
-	Putblock   bool
-	Getblock   bool
-	Puttree    bool
-	Gettree    bool
-	Linkstream bool
-	Getstream  bool
-	Lsstream   bool
-	Cattree    bool
-	Catstream  bool
-	Putstream  bool
-	Canon2abs  bool
-	Abs2canon  bool
-	Exec       bool
-	Run        bool
-	Algo       string
-	Canpath    string
-	Canpaths   []string
-	Name       string
-	All        bool `docopt:"-a"`
-	Out        bool `docopt:"-o"`
-	Filename   string
-	Image      string
-	Arg        []string
-	Cmd        []string
-	Quiet      bool `docopt:"-q"`
+	Init         bool
+	Putblock     bool
+	Getblock     bool
+	Puttree      bool
+	Gettree      bool
+	Linkstream   bool
+	Getstream    bool
+	Lsstream     bool
+	Cattree      bool
+	Catstream    bool
+	Putstream    bool
+	Canon2abs    bool
+	Abs2canon    bool
+	Exec         bool
+	Run          bool
+	Gc           bool
+	Fsck         bool
+	Log          bool
+	Reset        bool
+	Lsstreams    bool
+	Mvstream     bool
+	Rmstream     bool
+	Repack       bool
+	Genkey       bool
+	Rotatekey    bool
+	Migrate      bool
+	Newdir       string
+	Relayout     bool
+	Depth        int
+	Export       bool
+	Import       bool
+	Push         bool
+	Pull         bool
+	Algo         string
+	Canpath      string
+	Canpaths     []string
+	Name         string
+	All          bool   `docopt:"-a"`
+	Out          string `docopt:"-o"`
+	Filename     string
+	Image        string
+	Arg          []string
+	Cmd          []string
+	Quiet        bool `docopt:"-q"`
+	DryRun       bool `docopt:"-n"`
+	Grace        string
+	Pin          []string
+	Quarantine   bool
+	Retention    string
+	Target       string
+	Pattern      string
+	Newname      string
+	Max          int64
+	Compress     string
+	Key          string
+	Keyfile      string
+	Keyed        bool
+	TreeVersion  int
+	Chunker      string
+	Roots        []string
+	Force        bool
+	Otherdbdir   string
+	SkipDangling bool
 }
 
 func main() {
@@ -111,7 +149,15 @@ func _run() (rc int, msg string) {
 	usage := `pitbase
 
 Usage:
-  pb init 
+  pb init [--compress=<method>] [--key=<keyfile>] [--keyed] [--tree-version=<n>] [--chunker=<name>]
+  pb genkey <keyfile>
+  pb rotatekey <keyfile>
+  pb migrate [--tree-version=<n>] [--compress=<method>] [<newdir>]
+  pb relayout --depth=<n>
+  pb export <roots>... [-o <file>]
+  pb import <filename>
+  pb push [--force] <otherdbdir> <name>
+  pb pull [--force] <otherdbdir> <name>
   pb putblock <algo>
   pb getblock <canpath>
   pb puttree <algo> <canpaths>... 
@@ -119,17 +165,39 @@ Usage:
   pb linkstream <canpath> <name>
   pb getstream <name>
   pb lsstream [-a] <name>
-  pb catstream <name> [-o <filename>] 
+  pb lsstreams [<pattern>]
+  pb mvstream <name> <newname>
+  pb rmstream <name>
+  pb catstream <name> [-o <file>]
   pb cattree <canpath>
   pb putstream [-q] <algo> <name>
   pb canon2abs <filename>
   pb abs2canon <filename>
   pb exec <filename> [<arg>...]
   pb run <image> [<cmd>...]
+  pb gc [-n] [--grace=<duration>] [--retention=<duration>] [--skip-dangling] [<pin>...]
+  pb fsck [--quarantine]
+  pb log <name>
+  pb reset <name> <target>
+  pb repack [--max=<bytes>]
 
 Options:
-  -h --help     Show this screen.
-  --version     Show version.
+  -h --help               Show this screen.
+  --version               Show version.
+  -n                      Dry run; report but don't delete.
+  -o <file>               Write output to file instead of stdout.
+  --grace=<duration>      Keep objects modified within duration [default: 1h].
+  --retention=<duration>  Keep trees from label history within duration [default: 720h].
+  --skip-dangling         Collect garbage even if some labels' trees are missing.
+  --quarantine            Move bad objects to the quarantine dir.
+  --max=<bytes>           Leave objects larger than bytes loose [default: 65536].
+  --compress=<method>     Compress new blocks with method (flate).
+  --key=<keyfile>         Encrypt objects with the key in keyfile.
+  --keyed                 Address objects by keyed hash (hmac-<algo>).
+  --tree-version=<n>      Write trees in format n (1 or 2).
+  --force                 Sync between dbs with different chunking or algos.
+  --depth=<n>             Nest objects n subdirs deep.
+  --chunker=<name>        Split streams into blocks with name (rabin, fastcdc, or fixed).
 `
 	parser := &docopt.Parser{OptionsFirst: false}
 	o, _ := parser.ParseArgs(usage, os.Args[1:], "0.0")
@@ -144,7 +212,14 @@ Options:
 
 	switch true {
 	case opts.Init:
-		msg, err := create()
+		msg, err := create(pb.Db{
+			Compress:    opts.Compress,
+			KeyFile:     opts.Key,
+			Keyed:       opts.Keyed,
+			TreeVersion: opts.TreeVersion,
+			Chunker:     opts.Chunker,
+		})
+		ExitIf(err, syscall.EINVAL)
 		Ck(err)
 		fmt.Println(msg)
 	case opts.Putblock:
@@ -163,12 +238,15 @@ Options:
 		fmt.Println(tree.Path.Canon)
 	case opts.Gettree:
 		tree, err := getTree(opts.Canpath)
+		ExitIf(err, syscall.EINVAL)
+		ExitIf(err, syscall.ENOENT)
 		Ck(err)
 		txt, err := tree.Txt()
 		Ck(err)
 		fmt.Println(txt)
 	case opts.Linkstream:
 		stream, err := linkStream(opts.Canpath, opts.Name)
+		ExitIf(err, syscall.EINVAL)
 		Ck(err)
 		gotstream, err := getStream(stream.Label)
 		Ck(err)
@@ -179,15 +257,31 @@ Options:
 		Ck(err)
 		fmt.Println(stream.RootNode.Path.Canon)
 	case opts.Lsstream:
-		canpaths, err := lsStream(opts.Name, opts.All)
+		err := lsStream(opts.Name, opts.All, os.Stdout)
 		ExitIf(err, syscall.ENOENT)
 		Ck(err)
-		fmt.Println(strings.Join(canpaths, "\n"))
+	case opts.Lsstreams:
+		err := lsStreams(opts.Pattern, os.Stdout)
+		ExitIf(err, syscall.EINVAL)
+		Ck(err)
+	case opts.Mvstream:
+		err := mvStream(opts.Name, opts.Newname)
+		ExitIf(err, syscall.ENOENT)
+		ExitIf(err, syscall.EEXIST)
+		ExitIf(err, syscall.EINVAL)
+		Ck(err)
+	case opts.Rmstream:
+		err := rmStream(opts.Name)
+		ExitIf(err, syscall.ENOENT)
+		ExitIf(err, syscall.EINVAL)
+		Ck(err)
 	case opts.Catstream:
 		stream, err := catStream(opts.Name)
 		Ck(err)
-		if opts.Out {
-			fh, err := os.OpenFile(opts.Filename, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644) // XXX perms
+		if opts.Out != "" {
+			fh, err := os.OpenFile(opts.Out, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644) // XXX perms
+			Ck(err)
+			defer fh.Close()
 			_, err = io.Copy(fh, stream)
 			Ck(err)
 		} else {
@@ -196,6 +290,8 @@ Options:
 		}
 	case opts.Cattree:
 		tree, err := catTree(opts.Canpath)
+		ExitIf(err, syscall.EINVAL)
+		ExitIf(err, syscall.ENOENT)
 		Ck(err)
 		_, err = io.Copy(os.Stdout, tree)
 		Ck(err)
@@ -241,6 +337,68 @@ Options:
 		*/
 		_ = stdout
 		_ = stderr
+	case opts.Gc:
+		grace, err := time.ParseDuration(opts.Grace)
+		Ck(err)
+		retention, err := time.ParseDuration(opts.Retention)
+		Ck(err)
+		gcopts := pb.GCOpts{DryRun: opts.DryRun, Grace: grace, Retention: retention, SkipDangling: opts.SkipDangling}
+		err = gc(gcopts, opts.Pin, os.Stdout)
+		Ck(err)
+	case opts.Fsck:
+		ok, err := fsck(opts.Quarantine, os.Stdout)
+		Ck(err)
+		if !ok {
+			return 1, ""
+		}
+	case opts.Repack:
+		err := repack(opts.Max, os.Stdout)
+		Ck(err)
+	case opts.Export:
+		wr := os.Stdout
+		if opts.Out != "" {
+			fh, err := os.OpenFile(opts.Out, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+			Ck(err)
+			defer fh.Close()
+			wr = fh
+		}
+		err := export(opts.Roots, wr)
+		ExitIf(err, syscall.ENOENT)
+		Ck(err)
+	case opts.Import:
+		err := importBundle(opts.Filename, os.Stdout)
+		ExitIf(err, syscall.EINVAL)
+		Ck(err)
+	case opts.Push, opts.Pull:
+		err := syncStream(opts.Push, opts.Otherdbdir, opts.Name, opts.Force, os.Stdout)
+		ExitIf(err, syscall.EINVAL)
+		ExitIf(err, syscall.ENOENT)
+		Ck(err)
+	case opts.Genkey:
+		err := pb.GenKey(opts.Keyfile)
+		Ck(err)
+	case opts.Rotatekey:
+		err := rotateKey(opts.Keyfile, os.Stdout)
+		ExitIf(err, syscall.EINVAL)
+		Ck(err)
+	case opts.Migrate:
+		err := migrate(opts.Newdir, opts.TreeVersion, opts.Compress, os.Stdout)
+		ExitIf(err, syscall.EINVAL)
+		Ck(err)
+	case opts.Relayout:
+		err := relayout(opts.Depth, os.Stdout)
+		ExitIf(err, syscall.EINVAL)
+		ExitIf(err, syscall.EBUSY)
+		Ck(err)
+	case opts.Log:
+		err := logStream(opts.Name, os.Stdout)
+		ExitIf(err, syscall.ENOENT)
+		Ck(err)
+	case opts.Reset:
+		path, err := resetStream(opts.Name, opts.Target)
+		ExitIf(err, syscall.ENOENT)
+		Ck(err)
+		fmt.Printf("stream/%s -> %s\n", opts.Name, path.Canon)
 	}
 	return 0, ""
 }
@@ -259,9 +417,10 @@ func dbdir() (dir string) {
 	return
 }
 
-func create() (msg string, err error) {
-	dir := dbdir()
-	db, err := pb.Db{Dir: dir}.Create()
+// create makes a new db in the db dir, with the settings in tmpl.
+func create(tmpl pb.Db) (msg string, err error) {
+	tmpl.Dir = dbdir()
+	db, err := tmpl.Create()
 	if err != nil {
 		return
 	}
@@ -283,6 +442,7 @@ func putBlock(algo string, rd io.Reader) (block *pb.Block, err error) {
 	Ck(err)
 	file, err := pb.CreateWorm(db, "block", algo)
 	ExitIf(err, syscall.ENOSYS)
+	ExitIf(err, syscall.EINVAL)
 	Ck(err)
 	block = pb.Block{}.New(db, file)
 	_, err = io.Copy(block, rd)
@@ -296,7 +456,7 @@ func getBlock(canpath string, wr io.Writer) (err error) {
 	defer Return(&err)
 	db, err := opendb()
 	Ck(err)
-	path, err := pb.Path{}.New(db, canpath)
+	path, err := db.Resolve(canpath)
 	Ck(err)
 	// XXX from here on down is the same as in putBlock and should be
 	// moved to a common ioBlock(dst, src) (err error) {} function
@@ -337,7 +497,7 @@ func putTree(algo string, canpaths []string) (tree *pb.Tree, err error) {
 	}
 	var children []pb.Object
 	for _, canpath := range canpaths {
-		path, err := pb.Path{}.New(db, canpath)
+		path, err := db.Resolve(canpath)
 		if err != nil {
 			return nil, err
 		}
@@ -358,7 +518,7 @@ func getTree(canpath string) (tree *pb.Tree, err error) {
 	defer Return(&err)
 	db, err := opendb()
 	Ck(err)
-	path, err := pb.Path{}.New(db, canpath)
+	path, err := db.Resolve(canpath)
 	Ck(err)
 	tree, err = db.GetTree(path)
 	Ck(err)
@@ -372,7 +532,7 @@ func linkStream(canpath, name string) (stream *pb.Stream, err error) {
 	if err != nil {
 		return
 	}
-	path, err := pb.Path{}.New(db, canpath)
+	path, err := db.Resolve(canpath)
 	if err != nil {
 		return
 	}
@@ -396,21 +556,50 @@ func getStream(name string) (stream *pb.Stream, err error) {
 	return
 }
 
-func lsStream(name string, all bool) (canpaths []string, err error) {
+// lsStream writes the canpaths of a stream's objects to wr as it
+// walks the stream's tree, so memory use doesn't grow with stream size.
+func lsStream(name string, all bool, wr io.Writer) (err error) {
 	defer Return(&err)
 	db, err := opendb()
 	Ck(err)
 	stream, err := db.OpenStream(name)
 	Ck(err)
-	objs, err := stream.Ls(all)
-	for _, obj := range objs {
-		// fmt.Printf("obj %#v\n", obj)
-		canpath := obj.GetPath().Canon
-		canpaths = append(canpaths, canpath)
+	err = stream.Walk(pb.WalkOpts{All: all}, func(obj pb.Object, depth int) error {
+		_, err := fmt.Fprintln(wr, obj.GetPath().Canon)
+		return err
+	})
+	Ck(err)
+	return
+}
+
+// lsStreams writes the stream labels matching pattern to wr; see
+// pb.Db.ListStreams.
+func lsStreams(pattern string, wr io.Writer) (err error) {
+	defer Return(&err)
+	db, err := opendb()
+	Ck(err)
+	labels, err := db.ListStreams(pattern)
+	Ck(err)
+	for _, label := range labels {
+		fmt.Fprintln(wr, label)
 	}
 	return
 }
 
+func mvStream(name, newname string) (err error) {
+	defer Return(&err)
+	db, err := opendb()
+	Ck(err)
+	return db.RenameStream(name, newname)
+}
+
+func rmStream(name string) (err error) {
+	defer Return(&err)
+	db, err := opendb()
+	Ck(err)
+	return db.DeleteStream(name)
+}
+
 func catStream(name string) (stream *pb.Stream, err error) {
 	defer Return(&err)
 	stream, err = getStream(name)
@@ -425,7 +614,7 @@ func catTree(canpath string) (tree *pb.Tree, err error) {
 	if err != nil {
 		return
 	}
-	path, err := pb.Path{}.New(db, canpath)
+	path, err := db.Resolve(canpath)
 	Ck(err)
 	tree, err = db.GetTree(path)
 	Ck(err)
@@ -433,32 +622,213 @@ func catTree(canpath string) (tree *pb.Tree, err error) {
 }
 
 func putStream(algo string, name string, rd io.Reader) (stream *pb.Stream, err error) {
-	// XXX add -q flag to keep it from printing output
+	defer Return(&err)
+	db, err := opendb()
+	Ck(err)
+	stream, err = db.CreateStream(algo, name)
+	Ck(err)
+	_, err = io.Copy(stream, rd)
+	Ck(err)
+	err = stream.Close()
+	Ck(err)
+	return
+}
 
+// gc collects unreachable objects and writes a report to wr.
+func gc(opts pb.GCOpts, pins []string, wr io.Writer) (err error) {
+	defer Return(&err)
 	db, err := opendb()
-	if err != nil {
-		return
+	Ck(err)
+	for _, pin := range pins {
+		path, err := db.Resolve(pin)
+		Ck(err)
+		opts.Pins = append(opts.Pins, path)
 	}
-	tree, err := db.PutStream(algo, rd)
-	if err != nil {
-		return
+	report, err := db.GC(opts)
+	Ck(err)
+	verb := "removed"
+	if opts.DryRun {
+		verb = "unreachable"
 	}
-	if tree == nil {
-		panic("tree is nil")
+	for _, obj := range report.Unreachable {
+		fmt.Fprintf(wr, "%s %s %d\n", verb, obj.Path.Canon, obj.Size)
 	}
-	stream, err = tree.LinkStream(name)
-	if err != nil {
-		return
+	fmt.Fprintf(wr, "%d blocks (%d bytes), %d trees (%d bytes) %s; %d reachable, %d too recent\n",
+		report.Blocks, report.BlockBytes, report.Trees, report.TreeBytes, verb,
+		report.Reachable, report.Recent)
+	return
+}
+
+func repack(max int64, wr io.Writer) (err error) {
+	defer Return(&err)
+	db, err := opendb()
+	Ck(err)
+	report, err := db.Repack(pb.RepackOpts{MaxObject: max})
+	Ck(err)
+	fmt.Fprintf(wr, "%d objects (%d bytes) packed into %d packs\n",
+		report.Objects, report.Bytes, report.Packs)
+	return
+}
+
+func export(roots []string, wr io.Writer) (err error) {
+	defer Return(&err)
+	db, err := opendb()
+	Ck(err)
+	_, err = db.Export(wr, roots)
+	Ck(err)
+	return
+}
+
+// importBundle imports the bundle in filename, or stdin if filename
+// is "-".
+func importBundle(filename string, wr io.Writer) (err error) {
+	defer Return(&err)
+	db, err := opendb()
+	Ck(err)
+	rd := os.Stdin
+	if filename != "-" {
+		rd, err = os.Open(filename)
+		Ck(err)
+		defer rd.Close()
 	}
+	report, err := db.Import(rd)
+	Ck(err)
+	fmt.Fprintf(wr, "%d objects (%d bytes) imported, %d already present, %d labels set\n",
+		report.Objects, report.Bytes, report.Present, report.Labels)
 	return
 }
 
+// syncStream pushes the stream to, or pulls it from, the db in
+// otherdir.
+func syncStream(push bool, otherdir, name string, force bool, wr io.Writer) (err error) {
+	defer Return(&err)
+	db, err := opendb()
+	Ck(err)
+	other, err := pb.Open(otherdir)
+	Ck(err)
+	opts := pb.SyncOpts{Force: force}
+	var report *pb.SyncReport
+	if push {
+		report, err = db.Push(other, name, opts)
+	} else {
+		report, err = db.Pull(other, name, opts)
+	}
+	Ck(err)
+	fmt.Fprintf(wr, "%d trees, %d blocks (%d bytes) copied, %d trees skipped\n",
+		report.Trees, report.Blocks, report.Bytes, report.Skipped)
+	fmt.Fprintf(wr, "stream/%s -> %s\n", name, report.New.Canon)
+	return
+}
+
+func rotateKey(keyfile string, wr io.Writer) (err error) {
+	defer Return(&err)
+	db, err := opendb()
+	Ck(err)
+	report, err := db.RotateKey(keyfile)
+	Ck(err)
+	fmt.Fprintf(wr, "%d objects rewritten, %d packs unpacked\n", report.Objects, report.Packs)
+	return
+}
+
+// migrate upgrades the db in place, or into newdir, optionally
+// switching tree format and compression.  A compress of "none" turns
+// compression off; an empty one keeps the db's setting.
+func migrate(newdir string, treeVersion int, compress string, wr io.Writer) (err error) {
+	defer Return(&err)
+	db, err := opendb()
+	Ck(err)
+	opts := pb.MigrateOpts{Dir: newdir, TreeVersion: treeVersion}
+	switch compress {
+	case "":
+	case "none":
+		none := pb.CompressNone
+		opts.Compress = &none
+	default:
+		opts.Compress = &compress
+	}
+	report, err := db.Migrate(opts)
+	Ck(err)
+	fmt.Fprintf(wr, "%d blocks and %d trees rewritten, %d packs unpacked, %d labels moved, %d objects moved to object/\n",
+		report.Blocks, report.Trees, report.Packs, report.Labels, report.Moved)
+	return
+}
+
+// relayout moves the db's objects to a new subdir nesting depth.
+func relayout(depth int, wr io.Writer) (err error) {
+	defer Return(&err)
+	db, err := opendb()
+	Ck(err)
+	report, err := db.Relayout(depth)
+	Ck(err)
+	fmt.Fprintf(wr, "%d objects moved, %d labels relinked\n", report.Objects, report.Labels)
+	return
+}
+
+// logStream writes the history of a stream label to wr, newest first.
+func logStream(name string, wr io.Writer) (err error) {
+	defer Return(&err)
+	db, err := opendb()
+	Ck(err)
+	entries, err := db.History(name)
+	Ck(err)
+	ErrnoIf(len(entries) == 0, syscall.ENOENT, "no history for stream: %s", name)
+	for i := len(entries) - 1; i >= 0; i-- {
+		entry := entries[i]
+		old := entry.Old
+		if old == "" {
+			old = "-"
+		}
+		fmt.Fprintf(wr, "@{%d} %s %s uid=%d %s -> %s\n", len(entries)-1-i,
+			entry.Time.Local().Format(time.RFC3339), entry.Op, entry.Uid, old, entry.New)
+	}
+	return
+}
+
+// resetStream points a stream label at target, which is either a
+// canpath or a history selector such as @2 or @{2026-10-01}.
+func resetStream(name, target string) (path *pb.Path, err error) {
+	defer Return(&err)
+	db, err := opendb()
+	Ck(err)
+	if strings.HasPrefix(target, "@") {
+		selector := strings.TrimPrefix(target, "@")
+		if !strings.HasPrefix(selector, "{") {
+			selector = "{" + selector + "}"
+		}
+		path, err = db.ResolveLabel(name + "@" + selector)
+		Ck(err)
+	} else {
+		path, err = db.Resolve(target)
+		Ck(err)
+	}
+	err = db.ResetLabel(name, path)
+	Ck(err)
+	return
+}
+
+func fsck(quarantine bool, wr io.Writer) (ok bool, err error) {
+	defer Return(&err)
+	db, err := opendb()
+	Ck(err)
+	report, err := db.Fsck(pb.FsckOpts{Quarantine: quarantine})
+	Ck(err)
+	for _, problem := range report.Problems {
+		fmt.Fprintln(wr, problem)
+	}
+	for _, rel := range report.Quarantined {
+		fmt.Fprintf(wr, "quarantined %s\n", rel)
+	}
+	fmt.Fprintf(wr, "%d objects, %d labels, %d problems\n",
+		report.Objects, report.Labels, len(report.Problems))
+	return report.Ok(), nil
+}
+
 func canon2abs(canpath string) (abspath string, err error) {
 	db, err := opendb()
 	if err != nil {
 		return
 	}
-	path, err := pb.Path{}.New(db, canpath)
+	path, err := db.Resolve(canpath)
 	if err != nil {
 		return
 	}
@@ -470,7 +840,7 @@ func abs2canon(abspath string) (canpath string, err error) {
 	if err != nil {
 		return
 	}
-	path, err := pb.Path{}.New(db, abspath)
+	path, err := db.Resolve(abspath)
 	if err != nil {
 		return
 	}
@@ -502,7 +872,7 @@ func execute(scriptPath string, args ...string) (stdout, stderr io.Reader, rc in
 	// fmt.Printf("algo!! %s\n", algo)
 
 	// prepend "tree/" to interpreter addr
-	interpreterPath, err := pb.Path{}.New(db, "tree/"+interpreterAddr)
+	interpreterPath, err := db.Resolve("tree/" + interpreterAddr)
 	if err != nil {
 		return
 	}
@@ -514,7 +884,7 @@ func execute(scriptPath string, args ...string) (stdout, stderr io.Reader, rc in
 	}
 
 	// send script file to db.PutStream()
-	roottree, err := db.PutStream(algo, file)
+	roottree, err := db.PutStream(algo, file, pb.PutStreamOpts{})
 	if err != nil {
 		return
 	}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"fmt"
+	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
@@ -9,6 +10,7 @@ import (
 	gofuse "github.com/hanwen/go-fuse/v2/fuse"
 	pb "github.com/t7a/pitbase/db"
 	"github.com/t7a/pitbase/fuse"
+	"github.com/t7a/pitbase/gateway"
 
 	"github.com/docopt/docopt-go"
 	. "github.com/stevegt/goadapt"
@@ -19,6 +21,7 @@ const usage = `pitd
 Usage:
   pitd init <dbdir> 
   pitd serve <dbdir> <mountpoint>
+  pitd http <dbdir> <addr>
 
 Options:
   -h --help     Show this screen.
@@ -28,8 +31,10 @@ Options:
 type Opts struct {
 	Init       bool
 	Serve      bool
+	Http       bool
 	Dbdir      string
 	Mountpoint string
+	Addr       string
 }
 
 func main() {
@@ -69,6 +74,11 @@ func Run() (rc int, msg string) {
 		Ck(err)
 	}
 
+	if opts.Http {
+		err := serveHTTP(dbdir, opts.Addr)
+		Ck(err)
+	}
+
 	return
 }
 
@@ -109,6 +119,17 @@ func serve(dbdir, mountpoint string) (err error) {
 	return
 }
 
+// serveHTTP serves the db read-only over HTTP on addr, e.g.
+// "localhost:8080"; see the gateway package for the endpoints.
+func serveHTTP(dbdir, addr string) (err error) {
+	defer Return(&err)
+	db, err := opendb(dbdir)
+	Ck(err)
+	err = http.ListenAndServe(addr, gateway.Handler(db))
+	Ck(err)
+	return
+}
+
 func umount(server *gofuse.Server) {
 	if server != nil {
 		server.Unmount()
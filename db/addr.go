@@ -0,0 +1,118 @@
+package db
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	. "github.com/stevegt/goadapt"
+)
+
+// Besides canpaths, an object can be named in forms that make sense
+// without a db layout in mind:
+//
+//   - a digest, algo:hex, as in OCI, e.g. sha256:3d4f...; it doesn't
+//     say what class the object is, so Path.New asks the stored header
+//   - a URI, pb://class/algo/hex, e.g. pb://tree/sha256/3d4f...
+//   - a multihash, the compact binary form of a digest, for messages;
+//     see Multihash
+//
+// Path.New accepts all of these.
+
+// uriScheme starts an address URI.
+const uriScheme = "pb://"
+
+// addrPath returns the path form of raw if raw is a digest or a URI,
+// or raw as is.  raw is only a digest if the part before the colon is
+// an algo we know, so a file name like notes:draft is left alone.
+func addrPath(raw string) string {
+	if strings.HasPrefix(raw, uriScheme) {
+		return strings.TrimPrefix(raw, uriScheme)
+	}
+	if !strings.Contains(raw, "/") && strings.Contains(raw, ":") {
+		parts := strings.SplitN(raw, ":", 2)
+		if knownAlgo(parts[0]) {
+			return filepath.Join(unifiedDir, parts[0], parts[1])
+		}
+	}
+	return raw
+}
+
+// knownAlgo says whether algo is a hash algo pitbase implements,
+// plain or keyed.  Whether the db allows it is up to checkAlgo.
+func knownAlgo(algo string) bool {
+	_, err := newHash(strings.TrimPrefix(algo, keyedPrefix))
+	return err == nil
+}
+
+// Digest returns the object's address as a digest, algo:hex.
+func (path *Path) Digest() string {
+	return path.Algo + ":" + path.Hash
+}
+
+// URI returns the object's address as a URI, pb://class/algo/hex.
+func (path *Path) URI() string {
+	return uriScheme + path.Canon
+}
+
+// multihashCodes maps algos to their multihash function codes.  The
+// keyed algos have no registered codes, so they use codes from the
+// multicodec private use range.
+var multihashCodes = map[string]uint64{
+	"sha256":      0x12,
+	"sha512":      0x13,
+	"hmac-sha256": 0x300012,
+	"hmac-sha512": 0x300013,
+}
+
+// Multihash returns the object's address as a multihash: the algo's
+// code and the digest's length, both as unsigned varints, followed by
+// the digest.  Like a digest, it leaves the class out.
+func (path *Path) Multihash() (buf []byte, err error) {
+	return EncodeMultihash(path.Digest())
+}
+
+// FromMultihash returns the path of the object whose address is the
+// multihash buf.  Since a multihash doesn't say what class the object
+// is, the object has to be in db.
+func (path Path) FromMultihash(db *Db, buf []byte) (res *Path, err error) {
+	defer Return(&err)
+	digest, err := DecodeMultihash(buf)
+	Ck(err)
+	return path.New(db, digest)
+}
+
+// EncodeMultihash converts a digest, algo:hex, to a multihash.
+func EncodeMultihash(digest string) (buf []byte, err error) {
+	defer Return(&err)
+	parts := strings.SplitN(digest, ":", 2)
+	ErrnoIf(len(parts) != 2, syscall.EINVAL, "malformed digest: %s", digest)
+	code, ok := multihashCodes[parts[0]]
+	if !ok {
+		return nil, fmt.Errorf("%w: no multihash code: %s", syscall.ENOSYS, parts[0])
+	}
+	binhash, err := hex.DecodeString(parts[1])
+	ErrnoIf(err != nil || len(binhash) == 0 || !isHex(parts[1]), syscall.EINVAL, "malformed digest: %s", digest)
+	buf = make([]byte, 2*binary.MaxVarintLen64, 2*binary.MaxVarintLen64+len(binhash))
+	n := binary.PutUvarint(buf, code)
+	n += binary.PutUvarint(buf[n:], uint64(len(binhash)))
+	return append(buf[:n], binhash...), nil
+}
+
+// DecodeMultihash converts a multihash to a digest, algo:hex.
+func DecodeMultihash(buf []byte) (digest string, err error) {
+	defer Return(&err)
+	code, n := binary.Uvarint(buf)
+	ErrnoIf(n <= 0, syscall.EINVAL, "malformed multihash: %x", buf)
+	size, m := binary.Uvarint(buf[n:])
+	ErrnoIf(m <= 0 || size != uint64(len(buf)-n-m), syscall.EINVAL, "malformed multihash: %x", buf)
+	for algo, c := range multihashCodes {
+		if c == code {
+			return algo + ":" + bin2hex(buf[n+m:]), nil
+		}
+	}
+	return "", fmt.Errorf("%w: unknown multihash code: %#x", syscall.ENOSYS, code)
+}
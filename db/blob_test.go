@@ -11,7 +11,7 @@ func TestBlock(t *testing.T) {
 
 	hash := "303f7138f2be7b918fbd55af43653760b16f6b13a046fa0d71dd7a3909b64486"
 	canpath := "block/sha256/303f7138f2be7b918fbd55af43653760b16f6b13a046fa0d71dd7a3909b64486"
-	relpath := "block/sha256/303/f71/303f7138f2be7b918fbd55af43653760b16f6b13a046fa0d71dd7a3909b64486"
+	relpath := "object/sha256/303/f71/303f7138f2be7b918fbd55af43653760b16f6b13a046fa0d71dd7a3909b64486"
 	file, err := CreateWorm(db, "block", "sha256")
 	tassert(t, err == nil, "File.New err %v", err)
 	b := Block{}.New(db, file)
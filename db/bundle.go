@@ -0,0 +1,249 @@
+package db
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"syscall"
+
+	. "github.com/stevegt/goadapt"
+)
+
+// A bundle is a self-contained, streamable archive of object graphs,
+// for moving streams between dbs that don't share a filesystem.  It
+// is text headers and raw object bodies:
+//
+//	pitbase-bundle 1
+//	secret <id>                      only from a keyed db
+//	root <canpath>                   one per root
+//	label <name> <canpath>           one per root given as a label
+//	                                 (blank line ends the header)
+//	object <canpath> <length>        then length bytes of plain body,
+//	...                              children before their trees
+//	end
+//
+// Bodies are plain, whatever compression or encryption the exporting
+// db uses, and the importing db stores them its own way.  Since a
+// tree comes after everything it refers to, Import can check each
+// tree's entries as soon as the tree is stored.
+
+const bundleMagic = "pitbase-bundle 1"
+
+// BundleReport is returned by Db.Export and Db.Import.
+type BundleReport struct {
+	Objects int   // objects written to or imported from the bundle
+	Present int   // objects the importing db already had
+	Bytes   int64 // body bytes written or imported
+	Labels  int   // labels exported or set
+}
+
+// bundleRoot resolves an Export root, which is either a canpath, a
+// stream label, possibly with a history selector, or an abbreviated
+// hash; see Resolve.  label is the bare
+// label name, or empty for a canpath.
+func (db *Db) bundleRoot(spec string) (path *Path, label string, err error) {
+	defer Return(&err)
+	path, err = Path{}.New(db, spec)
+	if err == nil && (path.Class == "block" || path.Class == "tree") {
+		ErrnoIf(!db.Exists(path), syscall.ENOENT, "not found: %s", spec)
+		return path, "", nil
+	}
+	label, _, _, err = splitLabelSpec(spec)
+	Ck(err)
+	path, err = db.ResolveLabel(spec)
+	if errors.Is(err, syscall.ENOENT) {
+		// maybe an abbreviated hash; labels win, as refs do in git
+		abbrev, rerr := db.Resolve(spec)
+		if rerr == nil {
+			return abbrev, "", nil
+		}
+	}
+	Ck(err)
+	return
+}
+
+// Export writes a bundle holding everything reachable from roots.
+// Each root is a canpath or a stream label; labels are recorded in
+// the bundle so Import can recreate them.
+func (db *Db) Export(w io.Writer, roots []string) (report *BundleReport, err error) {
+	defer Return(&err)
+	report = &BundleReport{}
+	bw := bufio.NewWriter(w)
+
+	var paths []*Path
+	fmt.Fprintf(bw, "%s\n", bundleMagic)
+	if id := db.SecretID(); id != "" {
+		fmt.Fprintf(bw, "secret %s\n", id)
+	}
+	var labels []string
+	for _, spec := range roots {
+		path, label, err := db.bundleRoot(spec)
+		Ck(err)
+		paths = append(paths, path)
+		fmt.Fprintf(bw, "root %s\n", path.Canon)
+		if label != "" {
+			labels = append(labels, fmt.Sprintf("label %s %s\n", label, path.Canon))
+		}
+	}
+	for _, line := range labels {
+		bw.WriteString(line)
+		report.Labels++
+	}
+	bw.WriteString("\n")
+
+	sent := make(map[string]bool)
+	send := func(obj Object) (err error) {
+		defer Return(&err)
+		path := obj.GetPath()
+		if sent[path.Canon] {
+			return
+		}
+		sent[path.Canon] = true
+		file, err := OpenWorm(db, path)
+		Ck(err)
+		defer file.Close()
+		size, err := file.Size()
+		Ck(err)
+		fmt.Fprintf(bw, "object %s %d\n", path.Canon, size)
+		n, err := io.Copy(bw, file)
+		Ck(err)
+		Assert(n == size, "%s: expected %d bytes, got %d", path.Canon, size, n)
+		report.Objects++
+		report.Bytes += n
+		return
+	}
+	for _, path := range paths {
+		obj, err := db.ObjectFromPath(path)
+		Ck(err)
+		tree, ok := obj.(*Tree)
+		if !ok {
+			err = send(obj)
+			Ck(err)
+			continue
+		}
+		err = tree.Walk(WalkOpts{Order: PostOrder, All: true, Dedup: true}, func(obj Object, depth int) error {
+			return send(obj)
+		})
+		Ck(err)
+	}
+	bw.WriteString("end\n")
+	err = bw.Flush()
+	Ck(err)
+	return
+}
+
+// Import reads a bundle written by Export.  Each object is hashed as
+// it is stored and isn't published unless it matches its address.
+// Objects the db already has are skipped.  Once every object is in,
+// Import points the bundle's labels at their trees.
+func (db *Db) Import(r io.Reader) (report *BundleReport, err error) {
+	defer Return(&err)
+	report = &BundleReport{}
+	br := bufio.NewReader(r)
+	readLine := func() (fields []string, err error) {
+		line, err := br.ReadString('\n')
+		if err == io.EOF {
+			return nil, fmt.Errorf("%w: bundle truncated", syscall.EINVAL)
+		}
+		if err != nil {
+			return
+		}
+		return strings.Fields(line), nil
+	}
+
+	fields, err := readLine()
+	Ck(err)
+	ErrnoIf(strings.Join(fields, " ") != bundleMagic, syscall.EINVAL, "not a pitbase bundle")
+
+	// header
+	var roots []*Path
+	var labels []string
+	var labelPaths []*Path
+	var secret string
+	for {
+		fields, err := readLine()
+		Ck(err)
+		if len(fields) == 0 {
+			break
+		}
+		switch {
+		case fields[0] == "secret" && len(fields) == 2:
+			secret = fields[1]
+		case fields[0] == "root" && len(fields) == 2:
+			path, err := objectPath(db, fields[1])
+			Ck(err)
+			roots = append(roots, path)
+		case fields[0] == "label" && len(fields) == 3:
+			err = ValidateLabel(fields[1])
+			Ck(err)
+			path, err := objectPath(db, fields[2])
+			Ck(err)
+			labels = append(labels, fields[1])
+			labelPaths = append(labelPaths, path)
+		default:
+			return nil, fmt.Errorf("%w: malformed bundle header line: %q", syscall.EINVAL, strings.Join(fields, " "))
+		}
+	}
+	ErrnoIf(secret != db.SecretID(), syscall.EINVAL, "bundle and db have different secrets")
+
+	// objects
+	for {
+		fields, err := readLine()
+		Ck(err)
+		if len(fields) == 1 && fields[0] == "end" {
+			break
+		}
+		ErrnoIf(len(fields) != 3 || fields[0] != "object", syscall.EINVAL, "malformed bundle object line: %q", strings.Join(fields, " "))
+		path, err := objectPath(db, fields[1])
+		Ck(err)
+		size, err := strconv.ParseInt(fields[2], 10, 64)
+		Ck(err)
+		if db.Exists(path) {
+			_, err = io.CopyN(ioutil.Discard, br, size)
+			Ck(err)
+			report.Present++
+			continue
+		}
+		file, err := createExpected(db, path)
+		Ck(err)
+		_, err = io.CopyN(file, br, size)
+		Ck(err)
+		err = file.Close()
+		if err != nil {
+			// keep HashMismatchError intact for callers
+			return report, err
+		}
+		if path.Class == "tree" {
+			// don't leave a tree whose entries weren't sent, or
+			// whose entry sizes are wrong
+			err = db.checkTreeSizes(path)
+			if err != nil {
+				db.Rm(path)
+				return report, fmt.Errorf("%w: bundle tree %s: %v", syscall.EINVAL, path.Canon, err)
+			}
+		}
+		report.Objects++
+		report.Bytes += size
+	}
+
+	for _, path := range roots {
+		ErrnoIf(!db.Exists(path), syscall.EINVAL, "bundle is missing root %s", path.Canon)
+	}
+	for i, label := range labels {
+		target, err := db.labelTarget(label)
+		Ck(err)
+		if target != nil && target.Canon == labelPaths[i].Canon {
+			continue
+		}
+		tree, err := db.GetTree(labelPaths[i])
+		Ck(err)
+		err = db.linkLabel(label, tree, "import")
+		Ck(err)
+		report.Labels++
+	}
+	return
+}
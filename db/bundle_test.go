@@ -0,0 +1,108 @@
+package db
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestBundle(t *testing.T) {
+	src := setup(t, nil)
+	tree, err := src.PutStream("sha256", strings.NewReader(strings.Repeat("some stream data\n", 1000)), PutStreamOpts{})
+	tck(t, err)
+	_, err = tree.LinkStream("images/base")
+	tck(t, err)
+	block, err := src.PutBlock("sha256", mkbuf("loose block\n"))
+	tck(t, err)
+
+	var buf bytes.Buffer
+	report, err := src.Export(&buf, []string{"images/base", block.Path.Canon})
+	tck(t, err)
+	tassert(t, report.Labels == 1, "report %+v", report)
+	bundle := buf.Bytes()
+	tassert(t, bytes.HasPrefix(bundle, []byte(bundleMagic+"\nroot "+tree.Path.Canon+"\n")), "header %q", bundle[:80])
+
+	// import into a db with different storage settings
+	dst := setup(t, &Db{Compress: CompressFlate})
+	report2, err := dst.Import(bytes.NewReader(bundle))
+	tck(t, err)
+	tassert(t, report2.Objects == report.Objects && report2.Present == 0, "exported %+v imported %+v", report, report2)
+	tassert(t, report2.Labels == 1, "report %+v", report2)
+	stream, err := dst.OpenStream("images/base")
+	tck(t, err)
+	got, err := ioutil.ReadAll(stream)
+	tck(t, err)
+	tassert(t, string(got) == strings.Repeat("some stream data\n", 1000), "stream content %q", got)
+	path, err := Path{}.New(dst, block.Path.Canon)
+	tck(t, err)
+	tassert(t, dst.Exists(path), "root block not imported")
+	entries, err := dst.History("images/base")
+	tck(t, err)
+	tassert(t, len(entries) == 1 && entries[0].Op == "import", "history %v", entries)
+
+	// importing again copies nothing
+	report2, err = dst.Import(bytes.NewReader(bundle))
+	tck(t, err)
+	tassert(t, report2.Objects == 0 && report2.Present == report.Objects && report2.Labels == 0, "report %+v", report2)
+
+	// corrupt content isn't published
+	bad := bytes.Replace(bundle, []byte("loose block"), []byte("loose clock"), 1)
+	dst2 := setup(t, nil)
+	_, err = dst2.Import(bytes.NewReader(bad))
+	_, ok := err.(*HashMismatchError)
+	tassert(t, ok, "expected HashMismatchError, got %v", err)
+	path, err = Path{}.New(dst2, block.Path.Canon)
+	tck(t, err)
+	tassert(t, !dst2.Exists(path), "corrupt block published")
+
+	// truncated bundles don't set labels
+	dst3 := setup(t, nil)
+	_, err = dst3.Import(bytes.NewReader(bundle[:len(bundle)-10]))
+	tassert(t, err != nil, "truncated bundle imported")
+	labels, err := dst3.ListStreams("")
+	tck(t, err)
+	tassert(t, len(labels) == 0, "labels %v", labels)
+
+	// keyed dbs only trade with the same secret
+	keyed := setup(t, &Db{Keyed: true})
+	_, err = keyed.Import(bytes.NewReader(bundle))
+	tassert(t, err != nil, "keyed db imported plain bundle")
+}
+
+func TestBundleHostile(t *testing.T) {
+	src := setup(t, nil)
+	block, err := src.PutBlock("sha256", mkbuf("hello"))
+	tck(t, err)
+	hash := block.Path.Hash
+	dst := setup(t, &Db{Poly: src.Poly})
+	// per-class dirs, where the class is a dir name
+	dst.FormatVersion = FormatLegacy
+
+	for _, canon := range []string{
+		"../sha256/" + hash,
+		"block/../../sha256/" + hash,
+		"stream/evil",
+		"nosuch/sha256/" + hash,
+		"block//sha256/" + hash,
+		"block/sha256/xyz/" + hash,
+		"block/sha256/" + hash + "/..",
+	} {
+		bundle := fmt.Sprintf("%s\n\nobject %s 5\nhelloend\n", bundleMagic, canon)
+		_, err = dst.Import(strings.NewReader(bundle))
+		tassert(t, errors.Is(err, syscall.EINVAL), "%s: expected EINVAL, got %v", canon, err)
+		bundle = fmt.Sprintf("%s\nroot %s\n\nend\n", bundleMagic, canon)
+		_, err = dst.Import(strings.NewReader(bundle))
+		tassert(t, errors.Is(err, syscall.EINVAL), "%s root: expected EINVAL, got %v", canon, err)
+	}
+	for _, dir := range []string{filepath.Dir(dst.Dir), dst.Dir} {
+		for _, name := range []string{"sha256", "nosuch"} {
+			tassert(t, !exists(filepath.Join(dir, name)), "wrote %s in %s", name, dir)
+		}
+	}
+	tassert(t, !exists(filepath.Join(dst.Dir, "stream", "evil")), "imported a label as an object")
+}
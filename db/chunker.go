@@ -1,9 +1,13 @@
 package db
 
 import (
+	"fmt"
 	"io"
+	"syscall"
 
+	"github.com/pkg/errors"
 	resticRabin "github.com/restic/chunker"
+	. "github.com/stevegt/goadapt"
 )
 
 const (
@@ -16,6 +20,67 @@ const (
 	defMaxSize = 8 * miB
 )
 
+// Chunkers for Db.Chunker and PutStreamOpts.Chunker.  Existing dbs
+// have no Chunker setting and use rabin.
+const (
+	ChunkRabin   = "rabin"
+	ChunkFastCDC = "fastcdc"
+	ChunkFixed   = "fixed"
+)
+
+// Chunker splits a stream into blocks.  Start begins a new stream.
+// Next returns the data of the next chunk, which is only valid until
+// the following call to Next, or io.EOF after the last chunk.  A
+// chunker must always split the same stream in the same places, or
+// dedup breaks; see the golden tests in chunker_test.go.
+type Chunker interface {
+	Start(rd io.Reader)
+	Next() (data []byte, err error)
+}
+
+// checkChunker makes sure name is a chunker we support.
+func checkChunker(name string) (err error) {
+	switch name {
+	case "", ChunkRabin, ChunkFastCDC, ChunkFixed:
+		return
+	}
+	return fmt.Errorf("%w: unsupported chunker: %s", syscall.EINVAL, name)
+}
+
+// chunker returns the db's chunker, falling back to rabin for dbs
+// created before Chunker was added to config.json.
+func (db *Db) chunker() string {
+	if db.Chunker == "" {
+		return ChunkRabin
+	}
+	return db.Chunker
+}
+
+// newChunker returns the chunker called name, or the db's chunker if
+// name is empty, set up with the db's chunking parameters.
+func (db *Db) newChunker(name string) (chunker Chunker, err error) {
+	defer Return(&err)
+	if name == "" {
+		name = db.chunker()
+	}
+	err = checkChunker(name)
+	Ck(err)
+	minSize, maxSize := db.MinSize, db.MaxSize
+	if minSize == 0 {
+		minSize = defMinSize
+	}
+	if maxSize == 0 {
+		maxSize = defMaxSize
+	}
+	switch name {
+	case ChunkFastCDC:
+		return fastCDC{MinSize: minSize, MaxSize: maxSize}.Init(), nil
+	case ChunkFixed:
+		return &fixed{Size: maxSize}, nil
+	}
+	return rabin{Poly: db.Poly, MinSize: minSize, MaxSize: maxSize}.Init()
+}
+
 // rabin lightly wraps restic's chunker on the slight chance that we
 // might need to replace it someday.
 // XXX restic's Next() does copies rather than passing pointers --
@@ -25,6 +90,7 @@ type rabin struct {
 	C       *resticRabin.Chunker
 	MinSize uint
 	MaxSize uint
+	buf     []byte
 }
 
 // type chunk resticRabin.Chunk
@@ -76,9 +142,12 @@ func (c *Rabin) Run(buf []byte) (src io.Writer, chunks chan *Chunk) {
 
 func (c *rabin) Start(rd io.Reader) {
 	c.C = resticRabin.NewWithBoundaries(rd, c.Poly, c.MinSize, c.MaxSize)
+	// restic's Next appends the chunk to buf, so buf never has to
+	// grow
+	c.buf = make([]byte, c.MaxSize+1)
 }
 
-func (c *rabin) Next(buf []byte) (chunk resticRabin.Chunk, err error) {
+func (c *rabin) Next() (data []byte, err error) {
 	// restic chunker.Next() is underdocumented -- as of this writing
 	// it says:
 	//
@@ -106,8 +175,35 @@ func (c *rabin) Next(buf []byte) (chunk resticRabin.Chunk, err error) {
 	//
 	//
 
-	// buf := make([]byte, 100000000)
-	chunk, err = c.C.Next(buf)
+	chunk, err := c.C.Next(c.buf)
+	if errors.Cause(err) == io.EOF {
+		return nil, io.EOF
+	}
+	return chunk.Data, err
+}
+
+// fixed splits a stream into blocks of Size bytes; only the last
+// block can be shorter.  Inserting a byte moves every later boundary,
+// so it's only good for data that's rewritten in place, such as disk
+// images.
+type fixed struct {
+	Size uint
+	rd   io.Reader
+	buf  []byte
+}
 
-	return
+func (c *fixed) Start(rd io.Reader) {
+	c.rd = rd
+	c.buf = make([]byte, c.Size)
+}
+
+func (c *fixed) Next() (data []byte, err error) {
+	n, err := io.ReadFull(c.rd, c.buf)
+	switch {
+	case err == io.EOF:
+		return nil, io.EOF
+	case err == io.ErrUnexpectedEOF:
+		return c.buf[:n], nil
+	}
+	return c.buf[:n], err
 }
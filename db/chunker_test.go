@@ -2,14 +2,17 @@ package db
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
 	"fmt"
 	"io"
 	"math"
 	"math/rand"
+	"reflect"
 	"testing"
+	"testing/iotest"
 
 	"github.com/hlubek/readercomp"
-	"github.com/pkg/errors"
 )
 
 // XXX replace testStream with randStream
@@ -59,24 +62,119 @@ func TestChunker(t *testing.T) {
 	// chunk it
 	chunker.Start(stream)
 
-	buf := make([]byte, 9*miB) // XXX we need to understand buffer size
 	var gotstream []byte
 	for {
-		chunk, err := chunker.Next(buf)
-		if errors.Cause(err) == io.EOF {
+		chunk, err := chunker.Next()
+		if err == io.EOF {
 			fmt.Println("EOF")
 			break
 		}
+		tassert(t, err == nil, "%v", err)
 		fmt.Printf(".")
-		expect := stream.Data[chunk.Start : chunk.Start+chunk.Length]
-		tassert(t, bytes.Compare(expect, chunk.Data) == 0, "chunk: expected %v got %v", expect, chunk.Data)
-		gotstream = append(gotstream, chunk.Data...)
+		start := len(gotstream)
+		expect := stream.Data[start : start+len(chunk)]
+		tassert(t, bytes.Compare(expect, chunk) == 0, "chunk: expected %v got %v", expect, chunk)
+		gotstream = append(gotstream, chunk...)
 	}
 	gotsize := len(gotstream)
 	tassert(t, size == int(gotsize), "size: expected %d got %d", size, gotsize)
 	tassert(t, bytes.Compare(stream.Data, gotstream) == 0, "chunk: stream vs. gotstream mismatch")
 }
 
+// goldenData returns size bytes of pseudo-random data that, unlike
+// math/rand's, can't change between Go versions: the sha256 of each
+// block number, in turn.
+func goldenData(size int) []byte {
+	var buf []byte
+	for i := uint64(0); len(buf) < size; i++ {
+		var n [8]byte
+		binary.BigEndian.PutUint64(n[:], i)
+		sum := sha256.Sum256(n[:])
+		buf = append(buf, sum[:]...)
+	}
+	return buf[:size]
+}
+
+// chunkSizes returns the sizes of the chunks chunker splits rd into.
+func chunkSizes(t *testing.T, chunker Chunker, rd io.Reader) (sizes []int) {
+	t.Helper()
+	chunker.Start(rd)
+	for {
+		chunk, err := chunker.Next()
+		if err == io.EOF {
+			return
+		}
+		tck(t, err)
+		sizes = append(sizes, len(chunk))
+	}
+}
+
+// TestChunkerGolden pins each chunker's boundaries.  If this fails,
+// the chunker no longer splits streams the way it did, so existing
+// dbs would stop deduplicating new data against old.  Don't update
+// the golden sizes; fix the chunker.
+func TestChunkerGolden(t *testing.T) {
+	db := setup(t, &Db{Poly: 0x25d92e975e1aa3, MinSize: 256 * kiB, MaxSize: 2 * miB})
+	data := goldenData(4 * miB)
+	golden := map[string][]int{
+		ChunkRabin:   {1748867, 1146215, 1299222},
+		ChunkFastCDC: {794534, 539344, 640243, 548068, 561400, 559655, 495908, 55152},
+		ChunkFixed:   {2 * miB, 2 * miB},
+	}
+	for _, name := range []string{ChunkRabin, ChunkFastCDC, ChunkFixed} {
+		chunker, err := db.newChunker(name)
+		tck(t, err)
+		sizes := chunkSizes(t, chunker, bytes.NewReader(data))
+		tassert(t, reflect.DeepEqual(sizes, golden[name]), "%s: expected %v, got %#v", name, golden[name], sizes)
+		// boundaries don't depend on how the stream is read
+		sizes = chunkSizes(t, chunker, iotest.HalfReader(bytes.NewReader(data)))
+		tassert(t, reflect.DeepEqual(sizes, golden[name]), "%s: expected %v, got %#v with short reads", name, golden[name], sizes)
+	}
+
+	// an insert only moves nearby boundaries of content-defined
+	// chunkers
+	edited := append(append(append([]byte{}, data[:kiB]...), "inserted"...), data[kiB:]...)
+	for _, name := range []string{ChunkRabin, ChunkFastCDC} {
+		chunker, err := db.newChunker(name)
+		tck(t, err)
+		sizes := chunkSizes(t, chunker, bytes.NewReader(edited))
+		want := golden[name]
+		tassert(t, len(sizes) == len(want) && sizes[0] == want[0]+len("inserted"), "%s: got %v", name, sizes)
+		tassert(t, reflect.DeepEqual(sizes[1:], want[1:]), "%s: expected %v, got %v", name, want[1:], sizes[1:])
+	}
+
+	_, err := db.newChunker("bogus")
+	tassert(t, err != nil, "expected error for an unknown chunker")
+}
+
+func TestPutStreamChunkers(t *testing.T) {
+	db := setup(t, &Db{MinSize: 64, MaxSize: 1024, Chunker: ChunkFastCDC})
+	db2, err := Open(db.Dir)
+	tck(t, err)
+	tassert(t, db2.Chunker == ChunkFastCDC, "chunker not persisted: %q", db2.Chunker)
+
+	data := goldenData(64 * kiB)
+	leaves := map[string]int{}
+	for _, name := range []string{"", ChunkRabin, ChunkFastCDC, ChunkFixed} {
+		tree, err := db.PutStream("sha256", bytes.NewReader(data), PutStreamOpts{Chunker: name})
+		tck(t, err)
+		ok, err := readercomp.Equal(bytes.NewReader(data), tree, 4096)
+		tck(t, err)
+		tassert(t, ok, "%s: stream mismatch", name)
+		blocks, err := tree.Leaves()
+		tck(t, err)
+		leaves[name] = len(blocks)
+	}
+	// the db's chunker is the default
+	tassert(t, leaves[""] == leaves[ChunkFastCDC], "leaves %v", leaves)
+	tassert(t, leaves[ChunkFixed] == 64, "leaves %v", leaves)
+
+	_, err = db.PutStream("sha256", bytes.NewReader(data), PutStreamOpts{Chunker: "bogus"})
+	tassert(t, err != nil, "expected error for an unknown chunker")
+	_, err = Db{Dir: t.TempDir() + "/x", Chunker: "bogus"}.Create()
+	tassert(t, err != nil, "expected error for an unknown chunker")
+}
+
 func TestPutStreamBig(t *testing.T) {
 	stream := RandStream(100 * miB)
 	db := setup(t, nil)
@@ -92,7 +190,7 @@ func TestPutStreamSmall(t *testing.T) {
 
 func testPutStream(t *testing.T, db *Db, stream *randStream) {
 
-	tree, err := db.PutStream("sha256", stream)
+	tree, err := db.PutStream("sha256", stream, PutStreamOpts{})
 	tassert(t, err == nil, "PutStream(): %v", err)
 	tassert(t, tree != nil, "PutStream() tree is nil")
 
@@ -146,3 +244,56 @@ func TestChunkerWrite(t *testing.T) {
 
 }
 */
+
+func TestPutStreamBalanced(t *testing.T) {
+	db := setup(t, &Db{MinSize: 64, MaxSize: 128, Fanout: 3})
+	tassert(t, db.Fanout == 3, "fanout not persisted: %v", db.Fanout)
+	stream := RandStream(10000)
+	tree, err := db.PutStream("sha256", stream, PutStreamOpts{})
+	tassert(t, err == nil, "PutStream(): %v", err)
+
+	leaves, err := tree.Leaves()
+	tck(t, err)
+	n := len(leaves)
+	tassert(t, n > 27, "expected more than 27 leaves, got %d", n)
+
+	// every leaf should be at the same depth, and that depth should
+	// be ceil(log3(n))
+	expect := 0
+	for x := 1; x < n; x *= 3 {
+		expect++
+	}
+	depths := map[int]int{}
+	var walk func(tree *Tree, depth int)
+	walk = func(tree *Tree, depth int) {
+		entries, err := tree.Entries()
+		tck(t, err)
+		tassert(t, len(entries) <= 3, "tree %s has %d entries", tree.Path.Canon, len(entries))
+		for _, entry := range entries {
+			switch child := entry.(type) {
+			case *Tree:
+				walk(child, depth+1)
+			case *Block:
+				depths[depth+1]++
+			}
+		}
+	}
+	walk(tree, 0)
+	tassert(t, len(depths) == 1, "leaves at multiple depths: %v", depths)
+	tassert(t, depths[expect] == n, "expected %d leaves at depth %d, got %v", n, expect, depths)
+
+	stream.Rewind()
+	ok, err := readercomp.Equal(stream, tree, 4096)
+	tassert(t, err == nil, "readercomp.Equal: %v", err)
+	tassert(t, ok, "stream mismatch")
+}
+
+func TestPutStreamEmpty(t *testing.T) {
+	db := setup(t, nil)
+	tree, err := db.PutStream("sha256", RandStream(0), PutStreamOpts{})
+	tassert(t, err == nil, "PutStream(): %v", err)
+	tassert(t, tree != nil, "PutStream() tree is nil")
+	size, err := tree.Size()
+	tck(t, err)
+	tassert(t, size == 0, "expected empty tree, got size %d", size)
+}
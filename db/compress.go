@@ -0,0 +1,261 @@
+package db
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+
+	. "github.com/stevegt/goadapt"
+)
+
+// An object's stored header is its class name, optionally followed by
+// space-separated key=value flags describing how the body is stored,
+// and a newline:
+//
+//	block\n
+//	block flate=00000000000000001234\n
+//	tree aesgcm=1f2e3d4c5b6a7988:0011223344556677\n
+//
+// The flags are not part of the object's address; the hash always
+// covers the bare "class\n" header plus the plain body, so the same
+// data has the same address however it is stored.
+//
+// flate=<n> means the body is compressed with compress/flate and is n
+// bytes long uncompressed.  n is zero-padded to a fixed width so the
+// header can be patched in place once the body has been written.
+//
+// aesgcm=<keyid>:<salt> means the body is encrypted; see crypt.go.
+// Compression happens before encryption.
+
+// maxHeader is the longest stored header we'll try to parse.
+const maxHeader = 256
+
+// flateWidth is the width of the zero-padded flate length.
+const flateWidth = 20
+
+// Compression settings for Db.Compress.
+const (
+	CompressNone  = ""
+	CompressFlate = "flate"
+)
+
+// checkCompress makes sure method is a compression setting we support.
+func checkCompress(method string) (err error) {
+	switch method {
+	case CompressNone, CompressFlate:
+		return
+	}
+	return fmt.Errorf("%w: unsupported compression: %s", syscall.EINVAL, method)
+}
+
+// storedHeader describes an object's stored header.
+type storedHeader struct {
+	length int64  // length of the header line, newline included
+	flate  bool   // body is compressed
+	ulen   int64  // uncompressed body length if flate
+	key    string // id of the encryption key, if encrypted
+	salt   []byte // subkey salt, or an older object's nonce prefix, if encrypted
+}
+
+// line returns the stored header line for an object of class.
+func (hdr storedHeader) line(class string) string {
+	s := class
+	if hdr.flate {
+		s += fmt.Sprintf(" %s=%0*d", CompressFlate, flateWidth, hdr.ulen)
+	}
+	if hdr.key != "" {
+		s += fmt.Sprintf(" aesgcm=%s:%s", hdr.key, bin2hex(hdr.salt))
+	}
+	return s + "\n"
+}
+
+// readHeader reads and parses the stored header at the start of raw,
+// checking that it is for class.
+func readHeader(raw *io.SectionReader, class string) (hdr storedHeader, err error) {
+	defer Return(&err)
+	buf := make([]byte, maxHeader)
+	n, err := raw.ReadAt(buf, 0)
+	if err == io.EOF {
+		err = nil
+	}
+	Ck(err)
+	buf = buf[:n]
+	end := bytes.IndexByte(buf, '\n')
+	ErrnoIf(end < 0, syscall.EINVAL, "malformed header: %q", buf)
+	hdr.length = int64(end + 1)
+	fields := strings.Split(string(buf[:end]), " ")
+	ErrnoIf(fields[0] != class, syscall.EINVAL, "malformed header: %q", buf[:end+1])
+	for _, field := range fields[1:] {
+		kv := strings.SplitN(field, "=", 2)
+		ErrnoIf(len(kv) != 2, syscall.EINVAL, "malformed header flag: %q", field)
+		switch kv[0] {
+		case "flate":
+			hdr.flate = true
+			hdr.ulen, err = strconv.ParseInt(kv[1], 10, 64)
+			Ck(err)
+		case "aesgcm":
+			parts := strings.Split(kv[1], ":")
+			ErrnoIf(len(parts) != 2, syscall.EINVAL, "malformed header flag: %q", field)
+			hdr.key = parts[0]
+			hdr.salt, err = hex.DecodeString(parts[1])
+			Ck(err)
+			ErrnoIf(len(hdr.salt) != saltSize && len(hdr.salt) != noncePrefixSize, syscall.EINVAL, "malformed header flag: %q", field)
+		default:
+			return hdr, fmt.Errorf("%w: unsupported header flag: %s", syscall.ENOSYS, field)
+		}
+	}
+	return
+}
+
+// peekClass returns the class named in the stored header at the start
+// of raw, whatever it is.
+func peekClass(raw *io.SectionReader) (class string, err error) {
+	defer Return(&err)
+	buf := make([]byte, maxHeader)
+	n, err := raw.ReadAt(buf, 0)
+	if err == io.EOF {
+		err = nil
+	}
+	Ck(err)
+	buf = buf[:n]
+	end := bytes.IndexAny(buf, " \n")
+	ErrnoIf(end < 0, syscall.EINVAL, "malformed header: %q", buf)
+	class = string(buf[:end])
+	for _, known := range objectClasses {
+		if class == known {
+			return
+		}
+	}
+	return "", fmt.Errorf("%w: unknown class in header: %q", syscall.EINVAL, class)
+}
+
+// openBody returns a reader for the body of the object stored in raw,
+// with the header stripped and the body decrypted and decompressed if
+// need be.  If raw is all of the loose file fh, a plain body reads
+// through fh itself, sharing its seek offset; fh may be nil.
+func (db *Db) openBody(fh *os.File, raw *io.SectionReader, class string) (body io.ReadSeeker, size int64, err error) {
+	defer Return(&err)
+	hdr, err := readHeader(raw, class)
+	Ck(err)
+	stored := io.NewSectionReader(raw, hdr.length, raw.Size()-hdr.length)
+	if hdr.key != "" {
+		dec, err := db.newDecrypter(stored, hdr, class)
+		if err != nil {
+			// keep the errno visible to callers
+			return nil, 0, err
+		}
+		stored = io.NewSectionReader(dec, 0, dec.size)
+	}
+	if hdr.flate {
+		return &inflater{src: stored, size: hdr.ulen}, hdr.ulen, nil
+	}
+	if fh != nil && hdr.key == "" {
+		_, err = fh.Seek(hdr.length, io.SeekStart)
+		Ck(err)
+		return &fileBody{fh: fh, start: hdr.length}, stored.Size(), nil
+	}
+	return stored, stored.Size(), nil
+}
+
+// fileBody is the body of an uncompressed loose object: the object's
+// file with the header hidden.
+type fileBody struct {
+	fh    *os.File
+	start int64 // header length
+}
+
+func (b *fileBody) Read(buf []byte) (n int, err error) {
+	return b.fh.Read(buf)
+}
+
+func (b *fileBody) Seek(offset int64, whence int) (pos int64, err error) {
+	if whence == io.SeekStart {
+		// add header length to offset to get file seek position
+		offset += b.start
+	}
+	pos, err = b.fh.Seek(offset, whence)
+	if err != nil {
+		return
+	}
+	// don't let callers seek backwards into header
+	if pos < b.start {
+		return pos - b.start, fmt.Errorf("%w: seek into header", syscall.EINVAL)
+	}
+	return pos - b.start, nil
+}
+
+// inflater presents a seekable view of a flate-compressed body.
+// Seeking forward decompresses and discards; seeking backward starts
+// over from the beginning of the compressed data.
+type inflater struct {
+	src  *io.SectionReader // compressed data
+	size int64             // uncompressed size
+	pos  int64
+	zr   io.ReadCloser
+}
+
+func (z *inflater) Read(buf []byte) (n int, err error) {
+	if z.pos >= z.size {
+		return 0, io.EOF
+	}
+	if z.zr == nil {
+		_, err = z.src.Seek(0, io.SeekStart)
+		if err != nil {
+			return
+		}
+		z.zr = flate.NewReader(z.src)
+	}
+	if remaining := z.size - z.pos; int64(len(buf)) > remaining {
+		buf = buf[:remaining]
+	}
+	n, err = z.zr.Read(buf)
+	z.pos += int64(n)
+	if err == io.EOF {
+		if z.pos < z.size {
+			err = io.ErrUnexpectedEOF
+		} else if n > 0 {
+			// the next Read returns EOF
+			err = nil
+		}
+	}
+	return
+}
+
+func (z *inflater) Seek(offset int64, whence int) (pos int64, err error) {
+	switch whence {
+	case io.SeekStart:
+		pos = offset
+	case io.SeekCurrent:
+		pos = z.pos + offset
+	case io.SeekEnd:
+		pos = z.size + offset
+	default:
+		return z.pos, fmt.Errorf("%w: bad whence %d", syscall.EINVAL, whence)
+	}
+	if pos < 0 {
+		return z.pos, fmt.Errorf("%w: negative position %d", syscall.EINVAL, pos)
+	}
+	if pos < z.pos {
+		// start over
+		if z.zr != nil {
+			z.zr.Close()
+			z.zr = nil
+		}
+		z.pos = 0
+	}
+	if pos > z.size {
+		// like a file, reads past the end just return EOF
+		_, err = io.CopyN(ioutil.Discard, z, z.size-z.pos)
+		z.pos = pos
+		return
+	}
+	_, err = io.CopyN(ioutil.Discard, z, pos-z.pos)
+	return z.pos, err
+}
@@ -0,0 +1,87 @@
+package db
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestCompress(t *testing.T) {
+	plain := setup(t, nil)
+	db := setup(t, &Db{Compress: CompressFlate})
+
+	var lines []string
+	for i := 0; i < 500; i++ {
+		lines = append(lines, fmt.Sprintf("log line %d: nothing to see here", i))
+	}
+	data := []byte(strings.Join(lines, "\n"))
+
+	block, err := db.PutBlock("sha256", data)
+	tck(t, err)
+	expect, err := plain.PutBlock("sha256", data)
+	tck(t, err)
+	// same address either way
+	tassert(t, block.Path.Canon == expect.Path.Canon, "compressed address %s, plain %s", block.Path.Canon, expect.Path.Canon)
+
+	info, err := os.Stat(block.Path.Abs)
+	tck(t, err)
+	tassert(t, info.Size() < int64(len(data))/3, "stored size %d, data %d", info.Size(), len(data))
+	stored, err := ioutil.ReadFile(block.Path.Abs)
+	tck(t, err)
+	tassert(t, bytes.HasPrefix(stored, []byte(storedHeader{flate: true, ulen: int64(len(data))}.line("block"))), "header %q", stored[:40])
+
+	// uncompressed semantics
+	got, err := db.GetBlock(block.Path)
+	tck(t, err)
+	tassert(t, bytes.Equal(data, got), "GetBlock mismatch")
+	size, err := block.Size()
+	tck(t, err)
+	tassert(t, size == int64(len(data)), "size %d", size)
+	for _, pos := range []int64{1000, 10, 5000, 0} {
+		n, err := block.Seek(pos, io.SeekStart)
+		tck(t, err)
+		tassert(t, n == pos, "seek %d got %d", pos, n)
+		buf := make([]byte, 20)
+		_, err = io.ReadFull(block, buf)
+		tck(t, err)
+		tassert(t, bytes.Equal(buf, data[pos:pos+20]), "at %d got %q", pos, buf)
+	}
+	n, err := block.Seek(-5, io.SeekEnd)
+	tck(t, err)
+	tassert(t, n == size-5, "seek from end got %d", n)
+	rest, err := ioutil.ReadAll(block)
+	tck(t, err)
+	tassert(t, bytes.Equal(rest, data[size-5:]), "tail %q", rest)
+
+	// trees stay uncompressed; streams read back through them
+	tree, err := db.PutStream("sha256", bytes.NewReader(data), PutStreamOpts{})
+	tck(t, err)
+	_, err = tree.LinkStream("logs")
+	tck(t, err)
+	stream, err := db.OpenStream("logs")
+	tck(t, err)
+	got, err = ioutil.ReadAll(stream)
+	tck(t, err)
+	tassert(t, bytes.Equal(data, got), "stream mismatch")
+	ok, err := stream.RootNode.Verify()
+	tck(t, err)
+	tassert(t, ok, "verify failed")
+
+	// packed compressed objects still read and verify
+	_, err = db.Repack(RepackOpts{})
+	tck(t, err)
+	tassert(t, !exists(block.Path.Abs), "block not packed")
+	got, err = db.GetBlock(block.Path)
+	tck(t, err)
+	tassert(t, bytes.Equal(data, got), "packed GetBlock mismatch")
+	report, err := db.Fsck(FsckOpts{})
+	tck(t, err)
+	tassert(t, report.Ok(), "fsck problems: %v", report.Problems)
+
+	_, err = Db{Dir: t.TempDir(), Compress: "zstd"}.Create()
+	tassert(t, err != nil, "expected error for unknown compression")
+}
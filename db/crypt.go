@@ -0,0 +1,458 @@
+package db
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	. "github.com/stevegt/goadapt"
+)
+
+// An encrypted db keeps block and tree bodies encrypted on disk with
+// AES-256-GCM.  The key lives in a key file outside the db, named by
+// Db.KeyFile; it holds 32 random bytes, hex encoded.  Addresses are
+// still computed over the plain header and body, so identical plain
+// data dedups as before.
+//
+// An encrypted body is split into segments of segSize plain bytes,
+// each sealed separately so reads can seek without decrypting the
+// whole object.  Each object is sealed with its own subkey, derived
+// with HKDF-SHA256 from the db key and a random saltSize-byte salt
+// stored in the header along with the key id.  Segment i is sealed
+// with the nonce <i>, and the class, segment number, and whether it
+// is the last segment as additional data, so segments can't be
+// reordered, truncated, or moved to another object.  A body always
+// has at least one segment, even if empty.
+//
+// Since no two objects share a subkey, GCM's nonce limits apply per
+// object rather than to every object ever written with a db key, and
+// a 256-bit salt makes repeating a subkey negligible however long a
+// key is kept.  Older objects were sealed with the db key itself and
+// the nonce <prefix><i>, with a random noncePrefixSize-byte prefix in
+// place of the salt; they are still read, and RotateKey rewrites them
+// with a subkey, even when given the key they are already sealed with.
+
+const (
+	keySize         = 32
+	saltSize        = 32
+	noncePrefixSize = 8
+	segSize         = 64 * 1024
+)
+
+// keyring holds the keys an encrypted db can read with, keyed by id.
+type keyring struct {
+	current string // id of the key new objects are written with
+	keys    map[string][]byte
+}
+
+// GenKey writes a new random key to the key file fn, which must not
+// already exist.
+func GenKey(fn string) (err error) {
+	defer Return(&err)
+	key := make([]byte, keySize)
+	_, err = rand.Read(key)
+	Ck(err)
+	fh, err := os.OpenFile(fn, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	Ck(err)
+	defer fh.Close()
+	_, err = fh.WriteString(hex.EncodeToString(key) + "\n")
+	Ck(err)
+	err = fh.Sync()
+	Ck(err)
+	return fh.Close()
+}
+
+// readKey loads the key file fn.  The key id is derived from the key,
+// so the same key always has the same id.
+func readKey(fn string) (id string, key []byte, err error) {
+	defer Return(&err)
+	buf, err := ioutil.ReadFile(fn)
+	Ck(err)
+	key, err = hex.DecodeString(strings.TrimSpace(string(buf)))
+	ErrnoIf(err != nil || len(key) != keySize, syscall.EINVAL, "malformed key file: %s", fn)
+	sum := sha256.Sum256(key)
+	return hex.EncodeToString(sum[:8]), key, nil
+}
+
+// hkdf derives a keySize-byte key from key and salt with HKDF-SHA256
+// (RFC 5869).  One block of output is all we need, so the expand step
+// is a single HMAC.
+func hkdf(key, salt []byte, info string) []byte {
+	extract := hmac.New(sha256.New, salt)
+	extract.Write(key)
+	expand := hmac.New(sha256.New, extract.Sum(nil))
+	expand.Write([]byte(info))
+	expand.Write([]byte{1})
+	return expand.Sum(nil)[:keySize]
+}
+
+// objectAEAD returns the AEAD and nonce prefix for an object sealed
+// with key and the salt from its header.  A salt of noncePrefixSize
+// bytes is the nonce prefix of an object sealed with key itself.
+func objectAEAD(key, salt []byte) (aead cipher.AEAD, prefix []byte, err error) {
+	defer Return(&err)
+	prefix = salt
+	if len(salt) != noncePrefixSize {
+		key = hkdf(key, salt, "pitbase object")
+		prefix = make([]byte, noncePrefixSize)
+	}
+	block, err := aes.NewCipher(key)
+	Ck(err)
+	aead, err = cipher.NewGCM(block)
+	Ck(err)
+	return
+}
+
+// loadKeys loads KeyFile and OldKeyFiles.
+func (db *Db) loadKeys() (err error) {
+	defer Return(&err)
+	db.keys = nil
+	if db.KeyFile == "" {
+		ErrnoIf(len(db.OldKeyFiles) > 0, syscall.EINVAL, "old key files without a key file")
+		return
+	}
+	keys := &keyring{keys: make(map[string][]byte)}
+	for i, fn := range append([]string{db.KeyFile}, db.OldKeyFiles...) {
+		id, key, err := readKey(fn)
+		Ck(err)
+		if i == 0 {
+			keys.current = id
+		}
+		keys.keys[id] = key
+	}
+	db.keys = keys
+	return
+}
+
+// checkKeyFile makes fn absolute and makes sure it isn't inside the
+// db, where anyone who can read the objects could read the key too.
+func (db *Db) checkKeyFile(fn string) (abs string, err error) {
+	defer Return(&err)
+	abs, err = filepath.Abs(fn)
+	Ck(err)
+	dir, err := filepath.Abs(db.Dir)
+	Ck(err)
+	rel, err := filepath.Rel(dir, abs)
+	Ck(err)
+	ErrnoIf(rel == "." || !strings.HasPrefix(rel, ".."), syscall.EINVAL, "key file must be outside the db: %s", fn)
+	return
+}
+
+// segNonce returns the nonce for segment seg of an object.
+func segNonce(prefix []byte, seg uint32) []byte {
+	nonce := make([]byte, noncePrefixSize+4)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[noncePrefixSize:], seg)
+	return nonce
+}
+
+// segData returns the additional data for segment seg of an object.
+func segData(class string, seg uint32, last bool) []byte {
+	return []byte(fmt.Sprintf("%s %d %t", class, seg, last))
+}
+
+// encrypter seals what is written to it segment by segment.  It
+// holds back a full segment until it sees more data, since only
+// Close knows which segment is the last.
+type encrypter struct {
+	w      io.Writer
+	aead   cipher.AEAD
+	class  string
+	prefix []byte
+	seg    uint32
+	buf    []byte
+}
+
+// newEncrypter returns an encrypter writing to w with the db's
+// current key, and the header fields describing it.
+func (db *Db) newEncrypter(w io.Writer, class string) (enc *encrypter, hdr storedHeader, err error) {
+	defer Return(&err)
+	Assert(db.keys != nil)
+	hdr.key = db.keys.current
+	hdr.salt = make([]byte, saltSize)
+	_, err = rand.Read(hdr.salt)
+	Ck(err)
+	aead, prefix, err := objectAEAD(db.keys.keys[hdr.key], hdr.salt)
+	Ck(err)
+	enc = &encrypter{
+		w:      w,
+		aead:   aead,
+		class:  class,
+		prefix: prefix,
+	}
+	return
+}
+
+func (enc *encrypter) Write(data []byte) (n int, err error) {
+	enc.buf = append(enc.buf, data...)
+	for len(enc.buf) > segSize {
+		err = enc.seal(enc.buf[:segSize], false)
+		if err != nil {
+			return
+		}
+		enc.buf = append(enc.buf[:0], enc.buf[segSize:]...)
+	}
+	return len(data), nil
+}
+
+// Close seals the last segment.  It doesn't close the underlying
+// writer.
+func (enc *encrypter) Close() (err error) {
+	err = enc.seal(enc.buf, true)
+	enc.buf = nil
+	return
+}
+
+func (enc *encrypter) seal(plain []byte, last bool) (err error) {
+	Assert(enc.seg < 1<<32-1, "object too large to encrypt")
+	out := enc.aead.Seal(nil, segNonce(enc.prefix, enc.seg), plain, segData(enc.class, enc.seg, last))
+	_, err = enc.w.Write(out)
+	enc.seg++
+	return
+}
+
+// decrypter presents the plain body of an encrypted object as an
+// io.ReaderAt.  It keeps the most recently opened segment.
+type decrypter struct {
+	src    *io.SectionReader // sealed segments
+	aead   cipher.AEAD
+	class  string
+	prefix []byte
+	nseg   int64
+	size   int64 // plain size
+	seg    int64 // index of plain, or -1
+	plain  []byte
+}
+
+// newDecrypter returns a decrypter for the sealed body in src.  It
+// opens the last segment right away, so a wrong key or a truncated
+// body is caught before any reads.
+func (db *Db) newDecrypter(src *io.SectionReader, hdr storedHeader, class string) (dec *decrypter, err error) {
+	var key []byte
+	if db.keys != nil {
+		key = db.keys.keys[hdr.key]
+	}
+	if key == nil {
+		return nil, fmt.Errorf("%w: no key with id %s", syscall.ENOKEY, hdr.key)
+	}
+	aead, prefix, err := objectAEAD(key, hdr.salt)
+	if err != nil {
+		return
+	}
+	overhead := int64(aead.Overhead())
+	stored := src.Size()
+	nseg := (stored + segSize + overhead - 1) / (segSize + overhead)
+	if nseg == 0 || stored-(nseg-1)*(segSize+overhead) < overhead {
+		return nil, fmt.Errorf("%w: encrypted body truncated", syscall.EIO)
+	}
+	dec = &decrypter{
+		src:    src,
+		aead:   aead,
+		class:  class,
+		prefix: prefix,
+		nseg:   nseg,
+		size:   stored - nseg*overhead,
+		seg:    -1,
+	}
+	_, err = dec.segment(nseg - 1)
+	if err != nil {
+		return nil, err
+	}
+	return
+}
+
+// segment returns the plain content of segment i.
+func (dec *decrypter) segment(i int64) (plain []byte, err error) {
+	if i == dec.seg {
+		return dec.plain, nil
+	}
+	sealed := segSize + int64(dec.aead.Overhead())
+	start := i * sealed
+	length := sealed
+	if start+length > dec.src.Size() {
+		length = dec.src.Size() - start
+	}
+	buf := make([]byte, length)
+	_, err = dec.src.ReadAt(buf, start)
+	if err != nil && err != io.EOF {
+		return
+	}
+	last := i == dec.nseg-1
+	plain, err = dec.aead.Open(buf[:0], segNonce(dec.prefix, uint32(i)), buf, segData(dec.class, uint32(i), last))
+	if err != nil {
+		return nil, fmt.Errorf("%w: decrypting segment %d: %v", syscall.EIO, i, err)
+	}
+	dec.seg = i
+	dec.plain = plain
+	return
+}
+
+func (dec *decrypter) ReadAt(buf []byte, off int64) (n int, err error) {
+	for n < len(buf) {
+		if off >= dec.size {
+			return n, io.EOF
+		}
+		i := off / segSize
+		plain, err := dec.segment(i)
+		if err != nil {
+			return n, err
+		}
+		m := copy(buf[n:], plain[off-i*segSize:])
+		n += m
+		off += int64(m)
+	}
+	return
+}
+
+// RotateReport is returned by Db.RotateKey.
+type RotateReport struct {
+	Objects int // objects rewritten with the new key
+	Packs   int // packs unpacked because they held old objects
+}
+
+// RotateKey makes keyfile the db's key and rewrites every object that
+// isn't encrypted with it under a subkey of its own, including objects
+// that aren't encrypted at all, so RotateKey also encrypts an existing
+// plain db.  Packs that hold any such object are unpacked; run Repack
+// afterwards to pack the rewritten objects again.
+//
+// The old key stays in OldKeyFiles until every object has been
+// rewritten, so if RotateKey is interrupted, running it again with the
+// same keyfile picks up where it left off.  Other processes keep
+// writing with the key they opened the db with, so rotate while the
+// db is otherwise idle.
+func (db *Db) RotateKey(keyfile string) (report *RotateReport, err error) {
+	defer Return(&err)
+	report = &RotateReport{}
+	keyfile, err = db.checkKeyFile(keyfile)
+	Ck(err)
+	if keyfile != db.KeyFile {
+		var old []string
+		if db.KeyFile != "" {
+			old = append(old, db.KeyFile)
+		}
+		for _, fn := range db.OldKeyFiles {
+			if fn != keyfile && fn != db.KeyFile {
+				old = append(old, fn)
+			}
+		}
+		db.KeyFile = keyfile
+		db.OldKeyFiles = old
+		err = db.loadKeys()
+		Ck(err)
+		err = db.saveConfig()
+		Ck(err)
+	}
+
+	stale := func(path *Path, raw *io.SectionReader) (ok bool, err error) {
+		hdr, err := readHeader(raw, path.Class)
+		if err != nil {
+			return
+		}
+		return hdr.key != db.keys.current || len(hdr.salt) != saltSize, nil
+	}
+
+	report.Objects, report.Packs, err = db.rewriteStale(stale)
+	Ck(err)
+
+	if len(db.OldKeyFiles) > 0 {
+		db.OldKeyFiles = nil
+		err = db.loadKeys()
+		Ck(err)
+		err = db.saveConfig()
+		Ck(err)
+	}
+	return
+}
+
+// rewriteStale rewrites every object for which stale returns true,
+// given the object's stored form.  Packs that hold any such object
+// are unpacked, since packs are immutable; run Repack afterwards to
+// pack the rewritten objects again.
+func (db *Db) rewriteStale(stale func(path *Path, raw *io.SectionReader) (bool, error)) (objects, packs int, err error) {
+	defer Return(&err)
+
+	// unpack packs holding stale objects
+	var unpack []*pack
+	seen := make(map[string]bool)
+	err = db.walkPacked(func(p *pack, entry packEntry) (err error) {
+		defer Return(&err)
+		if seen[p.file] {
+			return
+		}
+		path, err := Path{}.New(db, entry.canon)
+		Ck(err)
+		fh, raw, err := openPacked(p, entry)
+		Ck(err)
+		defer fh.Close()
+		ok, err := stale(path, raw)
+		Ck(err)
+		if ok {
+			seen[p.file] = true
+			unpack = append(unpack, p)
+		}
+		return
+	})
+	Ck(err)
+	for _, p := range unpack {
+		for _, entry := range p.entries {
+			path, err := Path{}.New(db, entry.canon)
+			Ck(err)
+			err = db.rewrite(path)
+			Ck(err)
+			objects++
+		}
+		err = db.rmPack(p)
+		Ck(err)
+		packs++
+	}
+
+	// rewrite stale loose objects
+	err = db.walkObjects(func(path *Path, info os.FileInfo) (err error) {
+		defer Return(&err)
+		fh, raw, err := db.openRaw(path)
+		Ck(err)
+		ok, err := stale(path, raw)
+		fh.Close()
+		Ck(err)
+		if !ok {
+			return
+		}
+		err = db.rewrite(path)
+		Ck(err)
+		objects++
+		return
+	})
+	Ck(err)
+	return
+}
+
+// rewrite stores the object at path again with the current settings,
+// replacing any loose copy.
+func (db *Db) rewrite(path *Path) (err error) {
+	defer Return(&err)
+	in, err := OpenWorm(db, path)
+	Ck(err)
+	defer in.Close()
+	out, err := CreateWorm(db, path.Class, path.Algo)
+	Ck(err)
+	_, err = io.Copy(out, in)
+	Ck(err)
+	err = out.Close()
+	Ck(err)
+	if out.Path.Canon != path.Canon {
+		return &HashMismatchError{Path: path, Got: out.Path.Hash}
+	}
+	return
+}
@@ -0,0 +1,244 @@
+package db
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func mkkey(t *testing.T) string {
+	fn := filepath.Join(t.TempDir(), "key")
+	err := GenKey(fn)
+	tck(t, err)
+	return fn
+}
+
+// keyOf returns the key id in the stored header of the object at path.
+func keyOf(t *testing.T, db *Db, path *Path) string {
+	fh, raw, err := db.openRaw(path)
+	tck(t, err)
+	defer fh.Close()
+	hdr, err := readHeader(raw, path.Class)
+	tck(t, err)
+	return hdr.key
+}
+
+func TestEncrypt(t *testing.T) {
+	plain := setup(t, nil)
+	db := setup(t, &Db{KeyFile: mkkey(t)})
+
+	// several segments' worth
+	data := make([]byte, 3*segSize+123)
+	rand.New(rand.NewSource(1)).Read(data)
+
+	block, err := db.PutBlock("sha256", data)
+	tck(t, err)
+	expect, err := plain.PutBlock("sha256", data)
+	tck(t, err)
+	tassert(t, block.Path.Canon == expect.Path.Canon, "encrypted address %s, plain %s", block.Path.Canon, expect.Path.Canon)
+	first := block
+	stored, err := ioutil.ReadFile(block.Path.Abs)
+	tck(t, err)
+	tassert(t, !bytes.Contains(stored, data[:64]), "plaintext on disk")
+
+	got, err := db.GetBlock(block.Path)
+	tck(t, err)
+	tassert(t, bytes.Equal(data, got), "GetBlock mismatch")
+	size, err := block.Size()
+	tck(t, err)
+	tassert(t, size == int64(len(data)), "size %d", size)
+	for _, pos := range []int64{segSize - 10, 2 * segSize, 5, int64(len(data)) - 20} {
+		_, err = block.Seek(pos, io.SeekStart)
+		tck(t, err)
+		buf := make([]byte, 20)
+		_, err = io.ReadFull(block, buf)
+		tck(t, err)
+		tassert(t, bytes.Equal(buf, data[pos:pos+20]), "at %d got %x", pos, buf)
+	}
+
+	// empty blocks and trees work too
+	empty, err := db.PutBlock("sha256", nil)
+	tck(t, err)
+	got, err = db.GetBlock(empty.Path)
+	tck(t, err)
+	tassert(t, len(got) == 0, "got %q", got)
+	tree, err := db.PutTree("sha256", block, empty)
+	tck(t, err)
+	stored, err = ioutil.ReadFile(tree.Path.Abs)
+	tck(t, err)
+	tassert(t, !bytes.Contains(stored, []byte(block.Path.Canon)), "tree entries on disk")
+	_, err = tree.LinkStream("s1")
+	tck(t, err)
+	stream, err := db.OpenStream("s1")
+	tck(t, err)
+	got, err = ioutil.ReadAll(stream)
+	tck(t, err)
+	tassert(t, bytes.Equal(data, got), "stream mismatch")
+
+	// compression and encryption stack
+	db.Compress = CompressFlate
+	text := []byte(strings.Repeat("all work and no play\n", 10000))
+	block, err = db.PutBlock("sha256", text)
+	tck(t, err)
+	info, err := os.Stat(block.Path.Abs)
+	tck(t, err)
+	tassert(t, info.Size() < int64(len(text))/10, "stored size %d", info.Size())
+	got, err = db.GetBlock(block.Path)
+	tck(t, err)
+	tassert(t, bytes.Equal(text, got), "compressed GetBlock mismatch")
+
+	report, err := db.Fsck(FsckOpts{})
+	tck(t, err)
+	tassert(t, report.Ok(), "fsck problems: %v", report.Problems)
+
+	// tampering is caught
+	fn := first.Path.Abs
+	stored, err = ioutil.ReadFile(fn)
+	tck(t, err)
+	stored[len(stored)-100] ^= 1
+	err = os.Chmod(fn, 0644)
+	tck(t, err)
+	err = ioutil.WriteFile(fn, stored, 0644)
+	tck(t, err)
+	_, err = db.GetBlock(first.Path)
+	tassert(t, err != nil, "tampered block read")
+	report, err = db.Fsck(FsckOpts{})
+	tck(t, err)
+	tassert(t, len(report.Problems) == 1 && report.Problems[0].Kind == FsckCorrupt, "problems %v", report.Problems)
+
+	// without the key, nothing reads
+	nokey := &Db{Dir: db.Dir, Depth: db.Depth}
+	_, err = nokey.GetBlock(empty.Path)
+	tassert(t, err != nil, "read without key")
+
+	// the key can't live in the db
+	dir := t.TempDir()
+	_, err = Db{Dir: dir, KeyFile: filepath.Join(dir, "key")}.Create()
+	tassert(t, err != nil, "expected error for key inside db")
+}
+
+func TestRotateKey(t *testing.T) {
+	db := setup(t, nil)
+	var blocks []Object
+	for _, s := range []string{"one\n", "two\n", "three\n"} {
+		block, err := db.PutBlock("sha256", mkbuf(s))
+		tck(t, err)
+		blocks = append(blocks, block)
+	}
+	tree, err := db.PutTree("sha256", blocks...)
+	tck(t, err)
+	_, err = tree.LinkStream("s1")
+	tck(t, err)
+	_, err = db.Repack(RepackOpts{})
+	tck(t, err)
+
+	// encrypt a plain db
+	key1 := mkkey(t)
+	report, err := db.RotateKey(key1)
+	tck(t, err)
+	tassert(t, report.Objects == 4 && report.Packs == 1, "report %+v", report)
+	id1 := db.keys.current
+	for _, block := range blocks {
+		tassert(t, keyOf(t, db, block.GetPath()) == id1, "block not encrypted")
+	}
+
+	// rotate, interrupted after the config change
+	key2 := mkkey(t)
+	db.KeyFile = key2
+	db.OldKeyFiles = []string{key1}
+	err = db.loadKeys()
+	tck(t, err)
+	err = db.saveConfig()
+	tck(t, err)
+	err = db.rewrite(blocks[0].GetPath())
+	tck(t, err)
+	db2, err := Open(db.Dir)
+	tck(t, err)
+	report, err = db2.RotateKey(key2)
+	tck(t, err)
+	tassert(t, report.Objects == 3, "report %+v", report)
+	tassert(t, len(db2.OldKeyFiles) == 0, "old keys left: %v", db2.OldKeyFiles)
+
+	// the old key is no longer needed
+	err = os.Remove(key1)
+	tck(t, err)
+	db3, err := Open(db.Dir)
+	tck(t, err)
+	stream, err := db3.OpenStream("s1")
+	tck(t, err)
+	got, err := ioutil.ReadAll(stream)
+	tck(t, err)
+	tassert(t, string(got) == "one\ntwo\nthree\n", "got %q", got)
+	fsck, err := db3.Fsck(FsckOpts{})
+	tck(t, err)
+	tassert(t, fsck.Ok(), "fsck problems: %v", fsck.Problems)
+}
+
+func TestEncryptSalt(t *testing.T) {
+	// RFC 5869 test case 1, first block
+	ikm := bytes.Repeat([]byte{0x0b}, 22)
+	salt := []byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12}
+	okm := hkdf(ikm, salt, "\xf0\xf1\xf2\xf3\xf4\xf5\xf6\xf7\xf8\xf9")
+	tassert(t, bin2hex(okm) == "3cb25f25faacd57a90434f64d0362f2a2d2d0a90cf1a5a4c5db02d56ecc4c5bf", "hkdf %x", okm)
+
+	plain := setup(t, nil)
+	keyfile := mkkey(t)
+	db := setup(t, &Db{KeyFile: keyfile})
+
+	// every object gets its own salt
+	salts := make(map[string]bool)
+	for _, s := range []string{"one\n", "two\n"} {
+		block, err := db.PutBlock("sha256", mkbuf(s))
+		tck(t, err)
+		fh, raw, err := db.openRaw(block.Path)
+		tck(t, err)
+		hdr, err := readHeader(raw, "block")
+		fh.Close()
+		tck(t, err)
+		tassert(t, len(hdr.salt) == saltSize, "salt %x", hdr.salt)
+		salts[bin2hex(hdr.salt)] = true
+	}
+	tassert(t, len(salts) == 2, "salts %v", salts)
+
+	// an object sealed with the db key and a nonce prefix still reads
+	data := []byte("legacy\n")
+	expect, err := plain.PutBlock("sha256", data)
+	tck(t, err)
+	path, err := Path{}.New(db, expect.Path.Canon)
+	tck(t, err)
+	id, key, err := readKey(keyfile)
+	tck(t, err)
+	aead, prefix, err := objectAEAD(key, []byte("8 bytes!"))
+	tck(t, err)
+	stored := []byte(storedHeader{key: id, salt: prefix}.line("block"))
+	stored = append(stored, aead.Seal(nil, segNonce(prefix, 0), data, segData("block", 0, true))...)
+	err = os.MkdirAll(filepath.Dir(path.Abs), 0755)
+	tck(t, err)
+	err = ioutil.WriteFile(path.Abs, stored, 0444)
+	tck(t, err)
+	got, err := db.GetBlock(path)
+	tck(t, err)
+	tassert(t, bytes.Equal(got, data), "got %q", got)
+
+	// rotating to the same key gives it a subkey
+	report, err := db.RotateKey(keyfile)
+	tck(t, err)
+	tassert(t, report.Objects == 1, "report %+v", report)
+	fh, raw, err := db.openRaw(path)
+	tck(t, err)
+	hdr, err := readHeader(raw, "block")
+	fh.Close()
+	tck(t, err)
+	tassert(t, len(hdr.salt) == saltSize, "salt %x", hdr.salt)
+	got, err = db.GetBlock(path)
+	tck(t, err)
+	tassert(t, bytes.Equal(got, data), "got %q", got)
+	fsck, err := db.Fsck(FsckOpts{})
+	tck(t, err)
+	tassert(t, fsck.Ok(), "fsck problems: %v", fsck.Problems)
+}
@@ -7,15 +7,16 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"syscall"
 
-	"github.com/pkg/errors"
 	resticRabin "github.com/restic/chunker"
 	log "github.com/sirupsen/logrus"
 	. "github.com/stevegt/goadapt"
 )
 
 // Db is a key-value database. Dir is the base directory. Depth is the
-// number of subdirectory levels in the block and tree dirs.  We use
+// number of subdirectory levels in the block and tree dirs; Relayout
+// changes it for an existing db.  We use
 // three-character hexadecimal names for the subdirectories, giving us
 // a maximum of 4096 subdirs in a parent dir -- that's a sweet spot.
 // Two-character names (such as what git uses under .git/objects) only
@@ -28,6 +29,33 @@ type Db struct {
 	Poly    resticRabin.Pol // rabin polynomial for chunking
 	MinSize uint            // minimum chunk size
 	MaxSize uint            // maximum chunk size
+	Fanout  int             // maximum number of entries in a PutStream tree
+	// Chunker is how PutStream splits streams into blocks, ChunkRabin
+	// if empty; see chunker.go.
+	Chunker string `json:",omitempty"`
+	// FormatVersion is the db's on-disk format; see migrate.go.
+	FormatVersion int
+	// Compress is the compression for new blocks: CompressNone or
+	// CompressFlate.  Existing objects are read either way.
+	Compress string `json:",omitempty"`
+	// KeyFile is the key that encrypts new objects, if the db is
+	// encrypted.  OldKeyFiles are keys that can still decrypt
+	// objects during a key rotation.  See crypt.go.
+	KeyFile     string   `json:",omitempty"`
+	OldKeyFiles []string `json:",omitempty"`
+	// OldDepth is the Depth an unfinished relayout is moving
+	// objects out of; see relayout.go.
+	OldDepth int `json:",omitempty"`
+	// TreeVersion is the file format for new trees, TreeV1 if
+	// zero; see treefmt.go.
+	TreeVersion int `json:",omitempty"`
+	// Keyed dbs address objects by keyed hash; see secret.go.
+	Keyed  bool         `json:",omitempty"`
+	NoSync bool         `json:"-"` // skip fsyncs; see Db.Sync
+	packs  *packCache   // loaded pack indexes; see pack.go
+	layout *layoutCache // config.json's depths; see relayout.go
+	keys   *keyring     // loaded keys; see crypt.go
+	secret []byte       // keyed hash secret; see secret.go
 }
 
 // Open loads an existing db object from dir.
@@ -46,14 +74,39 @@ func Open(dir string) (db *Db, err error) {
 	if err != nil {
 		return nil, &NotDbError{Dir: dir}
 	}
-	db = &Db{}
+	db = &Db{packs: &packCache{}, layout: &layoutCache{}}
 	err = json.Unmarshal(buf, db)
 	if err != nil {
 		return
 	}
+	db.layout.configDepths(dir)
+
+	err = checkFormat(dir, db.FormatVersion)
+	if err != nil {
+		return
+	}
+
+	err = db.loadKeys()
+	if err != nil {
+		return
+	}
+
+	err = db.loadSecret()
+	if err != nil {
+		return
+	}
+
+	err = db.cleanTmp()
+	if err != nil {
+		return
+	}
 
 	return
 }
+
+// ObjectFromPath returns the block or tree at path.  OpenWorm checks
+// path.Class against the object's stored header, which is where the
+// class of an object/ path came from in the first place.
 func (db *Db) ObjectFromPath(path *Path) (obj Object, err error) {
 	defer Return(&err)
 
@@ -73,6 +126,81 @@ func (db *Db) ObjectFromPath(path *Path) (obj Object, err error) {
 	return
 }
 
+// objectClasses lists the classes of objects.
+var objectClasses = []string{"block", "tree"}
+
+// objectDirs lists the top-level directories that can hold objects:
+// unifiedDir, plus the per-class dirs of older dbs, in lexical order.
+var objectDirs = []string{"block", unifiedDir, "tree"}
+
+// walkObjects calls fn for every object file in the db, in lexical
+// order.
+func (db *Db) walkObjects(fn func(path *Path, info os.FileInfo) error) (err error) {
+	defer Return(&err)
+	for _, top := range objectDirs {
+		dir := filepath.Join(db.Dir, top)
+		if !exists(dir) {
+			continue
+		}
+		err = filepath.Walk(dir, func(abs string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if !info.Mode().IsRegular() {
+				return nil
+			}
+			path, err := Path{}.New(db, abs)
+			if err != nil {
+				return err
+			}
+			// a relayout may have left it somewhere other than
+			// where Path.New puts it
+			path.Abs = abs
+			path.Rel, err = filepath.Rel(db.Dir, abs)
+			if err != nil {
+				return err
+			}
+			return fn(path, info)
+		})
+		Ck(err)
+	}
+	return
+}
+
+// walkLabels calls fn for every stream label in the db, in lexical
+// order.  target is the path of the tree the label points at.  If the
+// symlink can't be resolved, target is nil and lerr says why.  If
+// the label is dangling, i.e. its tree isn't in the db, target is the
+// missing tree's path and lerr wraps ENOENT.
+func (db *Db) walkLabels(fn func(label string, target *Path, lerr error) error) (err error) {
+	defer Return(&err)
+	dir := filepath.Join(db.Dir, "stream")
+	err = filepath.Walk(dir, func(abs string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode()&os.ModeSymlink == 0 {
+			return nil
+		}
+		label, err := filepath.Rel(dir, abs)
+		if err != nil {
+			return err
+		}
+		// the target may be packed, so we check with db.Exists
+		// rather than following the symlink
+		target, lerr := db.labelTarget(label)
+		if lerr == nil && !db.Exists(target) {
+			lerr = fmt.Errorf("%w: %s", syscall.ENOENT, target.Canon)
+		}
+		if lerr != nil {
+			log.Debugf("label %s: %v", label, lerr)
+		}
+		return fn(label, target, lerr)
+	})
+	Ck(err)
+	return
+}
+
 // Create initializes a db directory and its contents
 // XXX Create should call Open
 func (db Db) Create() (out *Db, err error) {
@@ -90,39 +218,89 @@ func (db Db) Create() (out *Db, err error) {
 		Ck(err)
 	}
 
+	err = checkCompress(db.Compress)
+	if err != nil {
+		return nil, err
+	}
+
+	err = checkTreeVersion(db.TreeVersion)
+	Ck(err)
+	err = checkChunker(db.Chunker)
+	Ck(err)
+	db.FormatVersion = FormatCurrent
+
+	if db.KeyFile != "" {
+		db.KeyFile, err = db.checkKeyFile(db.KeyFile)
+		Ck(err)
+		err = db.loadKeys()
+		Ck(err)
+	}
+
 	// set nesting depth
 	if db.Depth < 1 {
 		db.Depth = 2
 	}
 
+	// set tree fanout
+	if db.Fanout < 2 {
+		db.Fanout = defFanout
+	}
+
 	err = mkdir(dir)
 	Ck(err)
 
-	// The block dir is where we store hashed blocks
-	err = mkdir(filepath.Join(dir, "block"))
+	// The object dir is where we store hashed blocks and merkle
+	// tree nodes
+	err = mkdir(filepath.Join(dir, unifiedDir))
 	Ck(err)
 
 	// we store references to trees as stream symlinks
 	err = mkdir(filepath.Join(dir, "stream"))
 	Ck(err)
 
-	// we store merkle tree nodes in tree
-	err = mkdir(filepath.Join(dir, "tree"))
+	// objects are written to tmp and then renamed into place
+	err = mkdir(filepath.Join(dir, "tmp"))
 	Ck(err)
 
+	if db.Keyed {
+		err = db.saveSecret()
+		Ck(err)
+	}
+
 	if db.Poly == 0 {
 		db.Poly, err = resticRabin.RandomPolynomial()
 		Ck(err)
 	}
 
-	buf, err := json.Marshal(db)
-	Ck(err)
-	err = ioutil.WriteFile(filepath.Join(dir, "config.json"), buf, 0644)
+	err = db.saveConfig()
 	Ck(err)
 
+	db.packs = &packCache{}
 	return &db, nil
 }
 
+// saveConfig atomically replaces config.json with db's settings.
+func (db *Db) saveConfig() (err error) {
+	defer Return(&err)
+	buf, err := json.Marshal(db)
+	Ck(err)
+	fh, err := db.tmpFile()
+	Ck(err)
+	defer os.Remove(fh.Name())
+	defer fh.Close()
+	_, err = fh.Write(buf)
+	Ck(err)
+	err = db.syncFile(fh)
+	Ck(err)
+	err = fh.Close()
+	Ck(err)
+	err = os.Chmod(fh.Name(), 0644)
+	Ck(err)
+	err = os.Rename(fh.Name(), filepath.Join(db.Dir, "config.json"))
+	Ck(err)
+	return db.syncDir(db.Dir)
+}
+
 type NotDbError struct {
 	Dir string
 }
@@ -131,15 +309,6 @@ func (e *NotDbError) Error() string {
 	return fmt.Sprintf("not a database: %s", e.Dir)
 }
 
-func (db *Db) tmpFile() (fh *os.File, err error) {
-	dir := db.Dir
-	fh, err = ioutil.TempFile(dir, "*")
-	if err != nil {
-		return
-	}
-	return
-}
-
 // GetBlock retrieves an entire block into buf by reading its file contents.
 func (db *Db) GetBlock(path *Path) (buf []byte, err error) {
 	file, err := OpenWorm(db, path)
@@ -159,63 +328,60 @@ func (db *Db) Rm(path *Path) (err error) {
 	return
 }
 
+// PutStreamOpts controls the behavior of Db.PutStream.
+type PutStreamOpts struct {
+	// Chunker splits the stream into blocks; empty means the db's
+	// Chunker.
+	Chunker string
+	// Workers is the number of goroutines hashing and storing
+	// blocks; zero means one per CPU.
+	Workers int
+}
+
 // PutStream reads blocks from stream, creates a merkle tree with those
 // blocks as leaf nodes, and returns the root node of the new tree.
+// The tree is balanced, with at most db.Fanout entries per node, so
+// its depth grows as O(log n) with the number of blocks.  An empty
+// stream produces a root node with no entries.  Blocks are hashed and
+// stored by opts.Workers goroutines at once, but the tree, and so its
+// address, is the same however many workers there are; see ingest.go.
 // XXX needs to accept label arg
-func (db *Db) PutStream(algo string, rd io.Reader) (rootnode *Tree, err error) {
-	// set chunker parameters
-	chunker, err := rabin{Poly: db.Poly, MinSize: db.MinSize, MaxSize: db.MaxSize}.Init()
-	if err != nil {
-		return
-	}
+func (db *Db) PutStream(algo string, rd io.Reader, opts PutStreamOpts) (rootnode *Tree, err error) {
+	defer Return(&err)
 
-	// create a chunker
-	// XXX should be called e.g. New()
+	// check algo before starting any workers
+	err = db.checkAlgo(algo)
+	Ck(err)
+	chunker, err := db.newChunker(opts.Chunker)
+	Ck(err)
 	chunker.Start(rd)
 
-	// feed rd into chunker until rd hits EOF
-	// XXX hardcoded buffer size of 1 MB, might want to make this configurable
-	// XXX buffer size really only needs to be slightly larger than the max chunk size,
-	// XXX which we should be able to get out of the rabin struct
-	buf := make([]byte, chunker.MaxSize+1) // this might be wrong
-	var oldtree *Tree
-	for {
-		chunk, err := chunker.Next(buf)
-		if errors.Cause(err) == io.EOF {
-			log.Debugf("EOF")
-			break
-		}
-		if err != nil {
-			return nil, err
-		}
-
-		newblock, err := db.PutBlock(algo, chunk.Data)
-		if err != nil {
-			return nil, err
-		}
+	builder := treeBuilder{Db: db, Algo: algo, Fanout: db.fanout()}.New()
 
+	// feed rd into chunker until rd hits EOF
+	ing := ingest{}.New(db, algo, chunker, opts.workers())
+	err = ing.each(func(newblock *Block) error {
 		log.Debugf("newblock %v", newblock)
-		if oldtree == nil {
-			// we're just starting the tree
-			rootnode, err = db.PutTree(algo, newblock)
-			if err != nil {
-				return nil, err
-			}
-		} else {
-			// add the next node
-			rootnode, err = db.PutTree(algo, oldtree, newblock)
-			if err != nil {
-				return nil, err
-			}
-		}
-		log.Debugf("rootnode %v", rootnode)
-		oldtree = rootnode
-	}
-	log.Debugf("oldtree %v", oldtree)
+		return builder.Add(newblock)
+	})
+	Ck(err)
+
+	rootnode, err = builder.Root()
+	Ck(err)
+	log.Debugf("rootnode %v", rootnode)
 
 	return
 }
 
+// fanout returns the configured tree fanout, falling back to the
+// default for databases created before Fanout was added to config.json.
+func (db *Db) fanout() int {
+	if db.Fanout < 2 {
+		return defFanout
+	}
+	return db.Fanout
+}
+
 // PutBlock hashes the block, stores the block in a file named after the hash,
 // and returns the block object.
 func (db *Db) PutBlock(algo string, buf []byte) (b *Block, err error) {
@@ -237,22 +403,37 @@ func (db *Db) PutBlock(algo string, buf []byte) (b *Block, err error) {
 	return
 }
 
-// OpenStream returns an existing Stream object given a label
+// OpenStream returns an existing Stream object given a label.  The
+// label may carry a history selector, as described in ResolveLabel;
+// such streams are read-only snapshots.
 // XXX figure out how to collapse OpenStream and Stream.New
 // into one function, probably by deferring any disk I/O in OpenStream
 // until we hit a Read() or Write().
 // XXX likewise for MkBlock and MkTree
 func (db *Db) OpenStream(label string) (stream *Stream, err error) {
 	defer Return(&err)
-	// XXX sanitize label
-	linkabspath := filepath.Join(db.Dir, "stream", label)
-	treeabspath, err := filepath.EvalSymlinks(linkabspath)
-	if err != nil {
-		return
+	_, _, snapshot, err := splitLabelSpec(label)
+	Ck(err)
+	if snapshot {
+		treepath, err := db.ResolveLabel(label)
+		Ck(err)
+		rootnode, err := db.GetTree(treepath)
+		Ck(err)
+		stream, err = Stream{}.New(db, "", rootnode)
+		Ck(err)
+		stream.Label = label
+		return stream, nil
 	}
-	treepath, err := Path{}.New(db, treeabspath)
+	err = checkStoredLabel(label)
 	Ck(err)
-	log.Debugf("treeabspath %#v treepath %#v", treeabspath, treepath)
+	treepath, err := db.labelTarget(label)
+	Ck(err)
+	if treepath == nil {
+		// report a missing label the way the filesystem would
+		_, err = os.Lstat(filepath.Join(db.Dir, "stream", label))
+		return
+	}
+	log.Debugf("treepath %#v", treepath)
 	rootnode, err := db.GetTree(treepath)
 	if err != nil {
 		return
@@ -282,11 +463,9 @@ func (db *Db) PutTree(algo string, children ...Object) (tree *Tree, err error) {
 	// we can't call loadEntries() here)
 	tree._entries = children
 
-	// concatenate entry paths together
 	// XXX refactor for streaming
-	txt, err := tree.Txt()
+	buf, err := encodeTree(db.treeVersion(), children)
 	Ck(err)
-	buf := []byte(txt)
 
 	var n int
 	n, err = tree.Write(buf)
@@ -14,23 +14,30 @@ Vocabulary:
 - algo: name (string) describing hash algorithm
 - subdir: three-character hexadecimal segment of hash
 - subdirs: one or more subdir segments inserted in abspath or relpath
-	in order to keep directory sizes small; the number of subdirs is fixed
-	at database creation
+	in order to keep directory sizes small; the number of subdirs is set
+	at database creation and can be changed with Relayout
+- class: "block" or "tree"; recorded in the object file's header,
+	which is hashed along with the content
 - block: chunk or block of data; deduplication atom; stored as file
 - tree: list of one or more blocks or trees; stored as file containing block or tree canpaths
+- object dir: object/, which holds every block and tree file; dbs
+	older than FormatUnified keep blocks in block/ and trees in tree/
+	instead
 - rootnode: the top-level tree for a stream
 - stream: ordered set of one or more blocks; stored as a symlink
   pointing at rootnode canpath
 - label: human-readable name of a stream;
   stored as the name of the symlink pointing at rootnode canpath
 - object: block, tree, or stream
-- address: a user-visible path, always points to a tree; canpath without leading "tree/"
-	- XXX Node-only addresses preclude being able to ship blocks around
-		between machines, and we may need to either include "block" or
-		"tree" in addr, or collapse the tree/ and block/ dirs on disk.  If
-		we do collapse the tree/ and block/ dirs into e.g. object/, then
-		we'll also need to change the tree file format to avoid preimage
-		attacks.
+- address: a user-visible path naming any block or tree; the same
+	as the canpath, e.g. tree/sha256/<hash>.  The class tag lets a
+	reader know what it's getting before it fetches anything, and
+	since the class header is hashed, a block can't pose as a tree.
+	An object/<algo>/<hash> path names the same object without the
+	tag; its class is read from the stored header.
+- digest: <algo>:<hash>, an address without the class, as in OCI
+- URI: pb://<canpath>, an address that stands on its own
+- multihash: binary form of a digest, for messages
 
 */
 
@@ -0,0 +1,123 @@
+package db
+
+import (
+	"io"
+)
+
+// fastCDC is a pure-Go FastCDC chunker, after Xia et al., "FastCDC: a
+// Fast and Efficient Content-Defined Chunking Approach for Data
+// Deduplication", USENIX ATC 2016.  It rolls a gear hash over the
+// stream, skipping the first MinSize bytes of each chunk, and cuts
+// where the top bits of the hash are zero.  Normalized chunking makes
+// a cut harder before the average size and easier after it, which
+// keeps chunk sizes close to the average.  The average is the
+// smallest power of two at least twice MinSize, so the default sizes
+// give 1 MiB chunks on average, like rabin's.
+//
+// The gear table is fixed, unlike rabin's per-db polynomial, so every
+// db with the same sizes splits a stream the same way.
+type fastCDC struct {
+	MinSize uint
+	MaxSize uint
+	maskS   uint64 // cut mask before the average size
+	maskL   uint64 // cut mask after it
+	avgSize uint
+	rd      io.Reader
+	buf     []byte
+	start   int // start of the unchunked data in buf
+	eof     bool
+}
+
+// gearSeed seeds the gear table.  Changing it changes every chunk
+// boundary.
+const gearSeed = 0x70697462617365 // "pitbase"
+
+// gear maps each byte to a random 64-bit value for the gear hash.
+var gear = func() (table [256]uint64) {
+	// splitmix64, so the table doesn't depend on math/rand
+	x := uint64(gearSeed)
+	for i := range table {
+		x += 0x9e3779b97f4a7c15
+		z := x
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		table[i] = z ^ (z >> 31)
+	}
+	return
+}()
+
+func (c fastCDC) Init() *fastCDC {
+	bits := uint(1)
+	for (uint(1)<<bits) < 2*c.MinSize && (uint(1)<<(bits+1)) <= c.MaxSize {
+		bits++
+	}
+	c.avgSize = uint(1) << bits
+	c.maskS = topBits(bits + 2)
+	var easy uint
+	if bits > 2 {
+		easy = bits - 2
+	}
+	c.maskL = topBits(easy)
+	return &c
+}
+
+// topBits returns a mask of the top n bits of a uint64.  The gear
+// hash shifts left, so its top bits depend on the most bytes.
+func topBits(n uint) uint64 {
+	return ^uint64(0) << (64 - n)
+}
+
+func (c *fastCDC) Start(rd io.Reader) {
+	c.rd = rd
+	c.buf = make([]byte, 0, c.MaxSize)
+	c.start = 0
+	c.eof = false
+}
+
+func (c *fastCDC) Next() (data []byte, err error) {
+	// move the leftovers to the front and top up the buffer
+	n := copy(c.buf[:cap(c.buf)], c.buf[c.start:])
+	c.buf = c.buf[:n]
+	c.start = 0
+	for !c.eof && len(c.buf) < cap(c.buf) {
+		n, err := c.rd.Read(c.buf[len(c.buf):cap(c.buf)])
+		c.buf = c.buf[:len(c.buf)+n]
+		if err == io.EOF {
+			c.eof = true
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	if len(c.buf) == 0 {
+		return nil, io.EOF
+	}
+	c.start = c.cut(c.buf)
+	return c.buf[:c.start], nil
+}
+
+// cut returns the length of the chunk at the start of buf.
+func (c *fastCDC) cut(buf []byte) int {
+	n := len(buf)
+	if n <= int(c.MinSize) {
+		return n
+	}
+	normal := int(c.avgSize)
+	if normal > n {
+		normal = n
+	}
+	var fp uint64
+	i := int(c.MinSize)
+	for ; i < normal; i++ {
+		fp = (fp << 1) + gear[buf[i]]
+		if fp&c.maskS == 0 {
+			return i + 1
+		}
+	}
+	for ; i < n; i++ {
+		fp = (fp << 1) + gear[buf[i]]
+		if fp&c.maskL == 0 {
+			return i + 1
+		}
+	}
+	return n
+}
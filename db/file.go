@@ -1,8 +1,7 @@
 package db
 
 import (
-	"crypto/sha256"
-	"crypto/sha512"
+	"compress/flate"
 	"fmt"
 	"hash"
 	"io"
@@ -28,7 +27,18 @@ type worm struct {
 	*Path
 	_mode os.FileMode
 	fh    *os.File
+	body  io.ReadSeeker // plain body, without header; see openBody
+	size  int64         // plain body size
 	hash  hash.Hash
+	// write side: data goes through w, which compresses and
+	// encrypts as hdr says before it reaches fh
+	w    io.Writer
+	hdr  storedHeader
+	zw   *flate.Writer
+	enc  *encrypter
+	ulen int64
+	// if set, Close refuses to publish content with another hash
+	expect *Path
 }
 
 func CreateWorm(db *Db, class string, algo string) (file *worm, err error) {
@@ -41,25 +51,32 @@ func CreateWorm(db *Db, class string, algo string) (file *worm, err error) {
 	file.Mode(WRITE)
 	// Set file.hash so file.Write() can feed new data blocks into the
 	// hash algorithm.
-	switch file.Path.Algo {
-	case "sha256":
-		file.hash = sha256.New()
-	case "sha512":
-		file.hash = sha512.New()
-	default:
-		err := fmt.Errorf("%w: %s", syscall.ENOSYS, file.Path.Algo)
+	file.hash, err = db.newHash(algo)
+	if err != nil {
 		return nil, err
 	}
 	return
 }
 
+// createExpected is like CreateWorm, but for content that should end
+// up at path.  Close returns a HashMismatchError instead of
+// publishing anything else.
+func createExpected(db *Db, path *Path) (file *worm, err error) {
+	file, err = CreateWorm(db, path.Class, path.Algo)
+	if err != nil {
+		return
+	}
+	file.expect = path
+	return
+}
+
 func OpenWorm(db *Db, path *Path) (file *worm, err error) {
 	defer Return(&err)
 	file = &worm{}
 	file.Db = db
 	file.Path = path
 	ErrnoIf(len(file.Path.Abs) == 0, syscall.EINVAL, "empty path")
-	ErrnoIf(!exists(file.Path.Abs), syscall.ENOENT, "not found: %s", file.Path.Abs)
+	ErrnoIf(!db.Exists(file.Path), syscall.ENOENT, "not found: %s", file.Path.Abs)
 	file.Mode(READ)
 	return
 }
@@ -78,27 +95,46 @@ func (file *worm) ckopen() (err error) {
 		// open temporary file
 		file.fh, err = file.Db.tmpFile()
 		Ck(err)
+		file.w = file.fh
+		if file.Db.keys != nil {
+			file.enc, file.hdr, err = file.Db.newEncrypter(file.fh, file.Path.Class)
+			Ck(err)
+			file.w = file.enc
+		}
+		if file.Db.Compress == CompressFlate && file.Path.Class == "block" {
+			// ulen is a placeholder; Close patches in the real length
+			file.hdr.flate = true
+			file.zw, err = flate.NewWriter(file.w, flate.DefaultCompression)
+			Ck(err)
+			file.w = file.zw
+		}
 		// write file header
-		header := []byte(file.header())
-		n, err := file.fh.Write(header)
+		stored := []byte(file.hdr.line(file.Path.Class))
+		n, err := file.fh.Write(stored)
 		Ck(err)
-		Assert(n == len(header))
+		Assert(n == len(stored))
 		// add header to hash data to help keep us from accidentally
 		// writing a cryptographic hash reverser
+		header := []byte(file.header())
 		n, err = file.hash.Write(header)
 		Ck(err)
 		Assert(n == len(header))
 	case READ:
-		// open existing file
-		file.fh, err = os.Open(file.Path.Abs)
+		// open existing file, loose or packed
+		var raw *io.SectionReader
+		file.fh, raw, err = file.Db.openRaw(file.Path)
 		Ck(err)
 		// strip file header
-		header := file.header()
-		buf := make([]byte, len(header))
-		n, err := file.fh.Read(buf)
-		Ck(err)
-		if n != len(header) || string(buf) != header {
-			return fmt.Errorf("malformed header: %s file: %s", string(buf), file.Path.Abs)
+		var loose *os.File
+		// loose files are named for their hash, packs aren't
+		if filepath.Base(file.fh.Name()) == file.Path.Hash {
+			loose = file.fh
+		}
+		file.body, file.size, err = file.Db.openBody(loose, raw, file.Path.Class)
+		if err != nil {
+			file.fh.Close()
+			file.fh = nil
+			return fmt.Errorf("%w: file: %s", err, file.Path.Abs)
 		}
 	default:
 		Assert(false)
@@ -119,17 +155,40 @@ func (file *worm) Close() (err error) {
 		file.fh.Close()
 		// log.Debugf("file Close() returning %v for %#v", err, file)
 		file.fh = nil
+		file.body = nil
 		return
 	case WRITE:
 		Assert(file.fh != nil, "writeable file handle is nil: %#v %#v\n", file, file.Path)
 
+		if file.zw != nil {
+			err = file.zw.Close()
+			Ck(err)
+			file.zw = nil
+		}
+		if file.enc != nil {
+			err = file.enc.Close()
+			Ck(err)
+			file.enc = nil
+		}
+		if file.hdr.flate {
+			file.hdr.ulen = file.ulen
+			_, err = file.fh.WriteAt([]byte(file.hdr.line(file.Path.Class)), 0)
+			Ck(err)
+		}
+
 		// this one was writeable, so check err
+		err = file.Db.syncFile(file.fh)
+		Ck(err)
 		err = file.fh.Close()
 		Ck(err)
 
 		// finish computing hash
 		binhash := file.hash.Sum(nil)
 		hexhash := bin2hex(binhash)
+		if file.expect != nil && hexhash != file.expect.Hash {
+			os.Remove(file.fh.Name())
+			return &HashMismatchError{Path: file.expect, Got: hexhash}
+		}
 
 		// now that we know what the data's hash is, we can replace tmp
 		// Path with permanent Path
@@ -140,13 +199,16 @@ func (file *worm) Close() (err error) {
 		Ck(err)
 
 		// make sure subdirs exist
-		dir, _ := filepath.Split(file.Path.Abs)
-		err = os.MkdirAll(dir, 0755)
+		dir := filepath.Dir(file.Path.Abs)
+		err = file.Db.mkdirAll(dir)
 		Ck(err)
 
-		// rename temp file to permanent block file
+		// rename temp file to permanent block file, then sync the
+		// dir so the rename survives a crash
 		err = os.Rename(file.fh.Name(), file.Path.Abs)
 		Ck(err)
+		err = file.Db.syncDir(dir)
+		Ck(err)
 
 		file.Mode(READ)
 
@@ -187,7 +249,7 @@ func (file *worm) Read(buf []byte) (n int, err error) {
 	file.Mode(READ)
 	err = file.ckopen()
 	Ck(err)
-	return file.fh.Read(buf)
+	return file.body.Read(buf)
 }
 
 // XXX deprecate
@@ -197,14 +259,14 @@ func (file *worm) ReadAll() (buf []byte, err error) {
 	Ck(err)
 	for {
 		b := make([]byte, 4096)
-		n, err := file.fh.Read(b)
+		n, err := file.body.Read(b)
+		buf = append(buf, b[:n]...)
 		if errors.Cause(err) == io.EOF {
 			break
 		}
 		if err != nil {
 			return nil, err
 		}
-		buf = append(buf, b[:n]...)
 	}
 	return
 }
@@ -225,7 +287,8 @@ func (file *worm) Rewind() error {
 // header.  In  other words, a caller of Seek(), Size(), or Tell()
 // doesn't need to know the size of the file header, and doesn't need
 // to know that the file header exists at all -- these functions
-// operate on the file body data only.
+// operate on the file body data only.  For a compressed or encrypted
+// object they operate on the plain body.
 func (file *worm) Seek(n int64, whence int) (nout int64, err error) {
 	defer Return(&err)
 
@@ -233,31 +296,17 @@ func (file *worm) Seek(n int64, whence int) (nout int64, err error) {
 	err = file.ckopen()
 	Ck(err)
 
-	hl := int64(len(file.header()))
-	if whence == io.SeekStart {
-		// add header length offset to n to get file seek position
-		n += hl
-	}
-
-	// do the seek
-	nout, err = file.fh.Seek(n, whence)
+	nout, err = file.body.Seek(n, whence)
 	Ck(err)
-	// don't let callers seek backwards into header
-	Assert(nout >= 0)
-	// subtract the header length to get block seek position
-	nout -= hl
-
 	return
 }
 
 func (file *worm) Size() (n int64, err error) {
+	defer Return(&err)
 	file.Mode(READ)
-	info, err := os.Stat(file.Path.Abs)
-	if err != nil {
-		return
-	}
-	hl := int64(len(file.header()))
-	n = info.Size() - hl
+	err = file.ckopen()
+	Ck(err)
+	n = file.size
 	return
 }
 
@@ -293,7 +342,8 @@ func (file *worm) Write(data []byte) (n int, err error) {
 	}
 
 	// write data to disk file
-	n, err = file.fh.Write(data)
+	n, err = file.w.Write(data)
+	file.ulen += int64(n)
 	if err != nil {
 		// panic(fmt.Sprintf("fh: %#v\n", file.fh))
 		return
@@ -0,0 +1,341 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	. "github.com/stevegt/goadapt"
+)
+
+// HashMismatchError is returned when an object's content doesn't
+// hash to its address.
+type HashMismatchError struct {
+	Path *Path
+	Got  string
+}
+
+func (e *HashMismatchError) Error() string {
+	return fmt.Sprintf("hash mismatch: %s: content hashes to %s", e.Path.Canon, e.Got)
+}
+
+// verifyObject re-hashes the object at path, including its class
+// header, and compares the result with path.Hash.
+func (db *Db) verifyObject(path *Path) (err error) {
+	defer Return(&err)
+	fh, raw, err := db.openRaw(path)
+	Ck(err)
+	defer fh.Close()
+	return db.verifyRaw(path, raw)
+}
+
+// verifyRaw checks the stored header and hash of an object's stored
+// form, decrypting and decompressing the body if need be.  Errors are
+// returned unwrapped so callers can tell what went wrong.
+func (db *Db) verifyRaw(path *Path, raw *io.SectionReader) (err error) {
+	h, err := db.newHash(path.Algo)
+	if err != nil {
+		return
+	}
+	body, _, err := db.openBody(nil, raw, path.Class)
+	if err != nil {
+		return
+	}
+	_, err = h.Write([]byte(path.header()))
+	if err != nil {
+		return
+	}
+	_, err = io.Copy(h, body)
+	if err != nil {
+		return
+	}
+	got := bin2hex(h.Sum(nil))
+	if got != path.Hash {
+		return &HashMismatchError{Path: path, Got: got}
+	}
+	return
+}
+
+// fsckKind returns the kind of problem a verifyRaw error indicates.
+func fsckKind(err error) string {
+	switch {
+	case errors.As(err, new(*HashMismatchError)), errors.Is(err, syscall.EIO):
+		return FsckCorrupt
+	case errors.Is(err, syscall.ENOKEY):
+		return FsckNoKey
+	}
+	return FsckHeader
+}
+
+// Problem kinds reported by Fsck.
+const (
+	FsckMalformed = "malformed" // object file name can't be parsed
+	FsckLayout    = "layout"    // object isn't where Path puts it
+	FsckHeader    = "header"    // class header is missing or wrong
+	FsckCorrupt   = "corrupt"   // content doesn't match hash
+	FsckDangling  = "dangling"  // tree entry or label points nowhere
+	FsckTmp       = "tmp"       // orphaned temporary file
+	FsckNoKey     = "nokey"     // encrypted with a key we don't have
+)
+
+// FsckOpts controls the behavior of Db.Fsck.
+type FsckOpts struct {
+	// Quarantine moves malformed, misplaced, and corrupt objects
+	// into the quarantine/ dir, preserving their relative paths.
+	Quarantine bool
+}
+
+// FsckProblem describes one problem found by Db.Fsck.
+type FsckProblem struct {
+	Kind   string
+	Rel    string // path relative to db.Dir
+	Detail string
+}
+
+func (p FsckProblem) String() string {
+	return fmt.Sprintf("%s %s: %s", p.Kind, p.Rel, p.Detail)
+}
+
+// FsckReport is returned by Db.Fsck.
+type FsckReport struct {
+	Objects     int
+	Labels      int
+	Problems    []FsckProblem
+	Quarantined []string // relative paths moved to quarantine/
+}
+
+// Ok returns true if Fsck found no problems.
+func (r *FsckReport) Ok() bool {
+	return len(r.Problems) == 0
+}
+
+func (r *FsckReport) add(kind, rel, format string, args ...interface{}) {
+	r.Problems = append(r.Problems, FsckProblem{Kind: kind, Rel: rel, Detail: fmt.Sprintf(format, args...)})
+}
+
+// Fsck checks the consistency of the whole database.  It re-hashes
+// every object, checks class headers and subdirectory layout, looks
+// for tree entries and stream labels that point at missing objects,
+// and lists orphaned temporary files.  Problems are collected in the
+// returned report rather than stopping the scan; err is only set if
+// the scan itself fails.
+func (db *Db) Fsck(opts FsckOpts) (report *FsckReport, err error) {
+	defer Return(&err)
+	report = &FsckReport{}
+
+	var bad []string
+	for _, top := range objectDirs {
+		dir := filepath.Join(db.Dir, top)
+		if !exists(dir) {
+			continue
+		}
+		err = filepath.Walk(dir, func(abs string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if !info.Mode().IsRegular() {
+				return nil
+			}
+			report.Objects++
+			rel, err := filepath.Rel(db.Dir, abs)
+			if err != nil {
+				return err
+			}
+			if !db.fsckObject(report, rel) {
+				bad = append(bad, rel)
+			}
+			return nil
+		})
+		Ck(err)
+	}
+
+	err = db.fsckPacks(report)
+	Ck(err)
+
+	err = db.walkLabels(func(label string, target *Path, lerr error) error {
+		report.Labels++
+		rel := filepath.Join("stream", label)
+		switch {
+		case target == nil:
+			report.add(FsckDangling, rel, "unresolvable: %v", lerr)
+		case lerr != nil:
+			report.add(FsckDangling, rel, "target missing")
+		case target.Class != "tree":
+			report.add(FsckDangling, rel, "target is not a tree: %s", target.Canon)
+		}
+		return nil
+	})
+	Ck(err)
+
+	err = db.fsckTmp(report)
+	Ck(err)
+
+	if opts.Quarantine {
+		for _, rel := range bad {
+			dst := filepath.Join(db.Dir, "quarantine", rel)
+			err = os.MkdirAll(filepath.Dir(dst), 0755)
+			Ck(err)
+			err = os.Rename(filepath.Join(db.Dir, rel), dst)
+			Ck(err)
+			report.Quarantined = append(report.Quarantined, rel)
+		}
+	}
+
+	return
+}
+
+// fsckObject checks one object file, adding any problems to report.
+// It returns false if the object itself is bad and should be
+// quarantined.
+func (db *Db) fsckObject(report *FsckReport, rel string) (ok bool) {
+	path, err := Path{}.New(db, rel)
+	if err != nil {
+		kind := FsckMalformed
+		parts := strings.SplitN(rel, "/", 2)
+		if len(parts) == 2 && parts[0] == unifiedDir {
+			// the class of an object/ file comes from its
+			// header, so if the name is fine, the header isn't
+			_, perr := Path{}.New(db, filepath.Join(objectClasses[0], parts[1]))
+			if perr == nil {
+				kind = FsckHeader
+			}
+		}
+		report.add(kind, rel, "%v", err)
+		return false
+	}
+	if path.Rel != rel && !db.oldLayout(path, rel) {
+		report.add(FsckLayout, rel, "expected at %s", path.Rel)
+		return false
+	}
+	err = db.verifyObject(path)
+	if err != nil {
+		kind := fsckKind(err)
+		switch e := err.(type) {
+		case *HashMismatchError:
+			report.add(kind, rel, "content hashes to %s", e.Got)
+		default:
+			report.add(kind, rel, "%v", err)
+		}
+		// the object may be fine; we just can't read it
+		return kind == FsckNoKey
+	}
+	if path.Class == "tree" {
+		db.fsckEntries(report, path)
+	}
+	return true
+}
+
+// fsckEntries reports tree entries that don't parse or that point at
+// missing objects.
+func (db *Db) fsckEntries(report *FsckReport, path *Path) {
+	file, err := OpenWorm(db, path)
+	if err != nil {
+		report.add(FsckHeader, path.Rel, "%v", err)
+		return
+	}
+	defer file.Close()
+	_, entries, err := parseTree(db, file)
+	if err != nil {
+		report.add(FsckMalformed, path.Rel, "bad entry: %v", err)
+		return
+	}
+	for _, entry := range entries {
+		if !db.Exists(entry.path) {
+			report.add(FsckDangling, path.Rel, "entry missing: %s", entry.path.Canon)
+			continue
+		}
+		err = db.checkEntrySize(path, entry)
+		if err != nil {
+			report.add(FsckCorrupt, path.Rel, "%v", err)
+		}
+	}
+}
+
+// fsckPacks checks every object in every pack.  Bad packed objects
+// are reported against the pack file; they can't be quarantined
+// individually.
+func (db *Db) fsckPacks(report *FsckReport) (err error) {
+	defer Return(&err)
+	return db.walkPacked(func(p *pack, entry packEntry) (err error) {
+		defer Return(&err)
+		report.Objects++
+		rel, err := filepath.Rel(db.Dir, p.file)
+		Ck(err)
+		path, err := Path{}.New(db, entry.canon)
+		if err != nil {
+			report.add(FsckMalformed, rel, "%v", err)
+			return nil
+		}
+		fh, raw, err := openPacked(p, entry)
+		if err != nil {
+			report.add(FsckDangling, rel, "%v", err)
+			return nil
+		}
+		defer fh.Close()
+		info, err := fh.Stat()
+		Ck(err)
+		if entry.offset+entry.length > info.Size() {
+			report.add(FsckCorrupt, rel, "%s extends past end of pack", entry.canon)
+			return nil
+		}
+		err = db.verifyRaw(path, raw)
+		switch e := err.(type) {
+		case nil:
+		case *HashMismatchError:
+			report.add(FsckCorrupt, rel, "%s hashes to %s", entry.canon, e.Got)
+			return nil
+		default:
+			report.add(fsckKind(err), rel, "%s: %v", entry.canon, err)
+			return nil
+		}
+		if path.Class == "tree" {
+			db.fsckEntries(report, path)
+		}
+		return nil
+	})
+}
+
+// fsckTmp reports temporary files left behind by interrupted writes.
+// Files in tmp/ newer than tmpGrace may belong to a writer that is
+// still running, so they aren't reported.  Any regular file in the db
+// root other than config.json is a leftover from before objects were
+// written via tmp/.
+func (db *Db) fsckTmp(report *FsckReport) (err error) {
+	defer Return(&err)
+	var names []string
+	entries, err := ioutil.ReadDir(db.Dir)
+	Ck(err)
+	for _, entry := range entries {
+		if !entry.Mode().IsRegular() {
+			continue
+		}
+		switch entry.Name() {
+		case "config.json", "lock", "secret":
+			continue
+		}
+		names = append(names, entry.Name())
+	}
+	if exists(db.tmpDir()) {
+		entries, err = ioutil.ReadDir(db.tmpDir())
+		Ck(err)
+		cutoff := time.Now().Add(-tmpGrace)
+		for _, entry := range entries {
+			if !entry.Mode().IsRegular() || entry.ModTime().After(cutoff) {
+				continue
+			}
+			names = append(names, filepath.Join("tmp", entry.Name()))
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		report.add(FsckTmp, name, "orphaned temporary file")
+	}
+	return
+}
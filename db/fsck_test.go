@@ -0,0 +1,82 @@
+package db
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFsck(t *testing.T) {
+	db := setup(t, nil)
+
+	block1, err := db.PutBlock("sha256", mkbuf("blob1value"))
+	tck(t, err)
+	block2, err := db.PutBlock("sha256", mkbuf("blob2value"))
+	tck(t, err)
+	tree, err := db.PutTree("sha256", block1, block2)
+	tck(t, err)
+	_, err = tree.LinkStream("stream1")
+	tck(t, err)
+
+	report, err := db.Fsck(FsckOpts{})
+	tck(t, err)
+	tassert(t, report.Ok(), "unexpected problems: %v", report.Problems)
+	tassert(t, report.Objects == 3, "expected 3 objects, got %d", report.Objects)
+	tassert(t, report.Labels == 1, "expected 1 label, got %d", report.Labels)
+
+	// corrupt one block, remove the other, and leave a stray tmp file
+	err = ioutil.WriteFile(block1.Path.Abs, []byte("block\ncorrupted"), 0644)
+	tck(t, err)
+	ok, err := tree.Verify()
+	tassert(t, !ok, "verify should fail")
+	_, mismatch := err.(*HashMismatchError)
+	tassert(t, mismatch, "expected HashMismatchError, got %v", err)
+
+	err = os.Remove(block2.Path.Abs)
+	tck(t, err)
+	err = ioutil.WriteFile(filepath.Join(db.Dir, "stray"), nil, 0644)
+	tck(t, err)
+
+	report, err = db.Fsck(FsckOpts{Quarantine: true})
+	tck(t, err)
+	kinds := map[string]int{}
+	for _, p := range report.Problems {
+		kinds[p.Kind]++
+	}
+	tassert(t, kinds[FsckCorrupt] == 1, "expected 1 corrupt, got %v", report.Problems)
+	tassert(t, kinds[FsckDangling] == 1, "expected 1 dangling, got %v", report.Problems)
+	tassert(t, kinds[FsckTmp] == 1, "expected 1 tmp, got %v", report.Problems)
+	tassert(t, len(report.Quarantined) == 1 && report.Quarantined[0] == block1.Path.Rel, "quarantined %v", report.Quarantined)
+	tassert(t, !exists(block1.Path.Abs), "corrupt block not moved")
+	tassert(t, exists(filepath.Join(db.Dir, "quarantine", block1.Path.Rel)), "corrupt block not in quarantine")
+
+	// a bad header
+	block3, err := db.PutBlock("sha256", mkbuf("blob3value"))
+	tck(t, err)
+	err = ioutil.WriteFile(block3.Path.Abs, []byte("bogus\nblob3value"), 0644)
+	tck(t, err)
+	report, err = db.Fsck(FsckOpts{})
+	tck(t, err)
+	found := false
+	for _, p := range report.Problems {
+		if p.Kind == FsckHeader && p.Rel == block3.Path.Rel {
+			found = true
+		}
+	}
+	tassert(t, found, "bad header not reported: %v", report.Problems)
+
+	// the class is hashed along with the content, so the wrong
+	// class is corruption
+	err = ioutil.WriteFile(block3.Path.Abs, []byte("tree\nblob3value"), 0644)
+	tck(t, err)
+	report, err = db.Fsck(FsckOpts{})
+	tck(t, err)
+	found = false
+	for _, p := range report.Problems {
+		if p.Kind == FsckCorrupt && p.Rel == block3.Path.Rel {
+			found = true
+		}
+	}
+	tassert(t, found, "wrong class not reported: %v", report.Problems)
+}
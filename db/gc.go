@@ -0,0 +1,277 @@
+package db
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	. "github.com/stevegt/goadapt"
+)
+
+// GCOpts controls the behavior of Db.GC.
+type GCOpts struct {
+	// DryRun reports unreachable objects without deleting them.
+	DryRun bool
+	// Grace protects objects modified less than Grace ago.  This
+	// keeps GC from deleting the objects of a stream that is still
+	// being written and hasn't had its label linked yet.
+	Grace time.Duration
+	// Pins are extra roots in addition to the stream labels.
+	Pins []*Path
+	// Retention makes trees that a label pointed at within the last
+	// Retention roots as well, so the label can still be reset to
+	// them.  Zero ignores label history.
+	Retention time.Duration
+	// SkipDangling lets GC go on past stream labels whose trees are
+	// missing.  Otherwise GC fails on them, since the rest of such a
+	// stream may still be in the db, and fsck should look first.
+	SkipDangling bool
+}
+
+// GCObject describes one unreachable object found by Db.GC.
+type GCObject struct {
+	Path *Path
+	Size int64 // bytes on disk
+}
+
+// GCReport is returned by Db.GC.
+type GCReport struct {
+	Roots       int        // number of root trees and pins walked
+	Reachable   int        // number of reachable objects
+	Unreachable []GCObject // unreachable objects, deleted unless DryRun
+	Recent      int        // unreachable objects kept due to Grace
+	Blocks      int        // number of unreachable blocks
+	BlockBytes  int64      // size of unreachable blocks
+	Trees       int        // number of unreachable trees
+	TreeBytes   int64      // size of unreachable trees
+}
+
+// GC deletes blocks and trees that aren't reachable from any stream
+// label, pin, or recent label history.  It is a simple mark-and-sweep
+// collector: first it walks every tree reachable from a root, marking
+// each object it finds, and then it scans the object dirs, removing
+// any unmarked object older than opts.Grace.
+//
+// Packs can't be changed in place, so GC replaces a pack holding
+// unreachable objects with a new pack of the rest; see sweepPacks.
+func (db *Db) GC(opts GCOpts) (report *GCReport, err error) {
+	defer Return(&err)
+	report = &GCReport{}
+
+	// mark
+	marked := make(map[string]bool)
+	mark := func(root *Path) (err error) {
+		defer Return(&err)
+		report.Roots++
+		obj, err := db.ObjectFromPath(root)
+		Ck(err)
+		tree, ok := obj.(*Tree)
+		if !ok {
+			marked[root.Canon] = true
+			return
+		}
+		err = tree.Walk(WalkOpts{All: true}, func(obj Object, depth int) error {
+			canon := obj.GetPath().Canon
+			if marked[canon] {
+				if _, ok := obj.(*Tree); ok {
+					return SkipTree
+				}
+				return nil
+			}
+			marked[canon] = true
+			return nil
+		})
+		Ck(err)
+		return
+	}
+	// a label we can't follow may still hold objects, so anything
+	// short of a missing tree stops GC before the sweep
+	err = db.walkLabels(func(label string, target *Path, lerr error) error {
+		switch {
+		case target == nil:
+			return fmt.Errorf("gc: stream label %s: %w", label, lerr)
+		case lerr == nil:
+			return mark(target)
+		case opts.SkipDangling:
+			log.Warnf("gc: skipping dangling stream label %s: %v", label, lerr)
+			return nil
+		default:
+			return fmt.Errorf("gc: dangling stream label %s: %w", label, lerr)
+		}
+	})
+	Ck(err)
+	for _, pin := range opts.Pins {
+		err = mark(pin)
+		Ck(err)
+	}
+	if opts.Retention > 0 {
+		since := time.Now().Add(-opts.Retention)
+		err = db.walkHistory(func(label string, entries []HistoryEntry) (err error) {
+			defer Return(&err)
+			for _, entry := range entries {
+				if entry.Time.Before(since) {
+					continue
+				}
+				for _, canon := range []string{entry.Old, entry.New} {
+					if canon == "" || marked[canon] {
+						continue
+					}
+					path, err := Path{}.New(db, canon)
+					Ck(err)
+					if !db.Exists(path) {
+						log.Debugf("gc: history of %s refers to missing %s", label, canon)
+						continue
+					}
+					err = mark(path)
+					Ck(err)
+				}
+			}
+			return
+		})
+		Ck(err)
+	}
+	report.Reachable = len(marked)
+
+	// sweep
+	cutoff := time.Now().Add(-opts.Grace)
+	err = db.walkObjects(func(path *Path, info os.FileInfo) (err error) {
+		if marked[path.Canon] {
+			return
+		}
+		if info.ModTime().After(cutoff) {
+			report.Recent++
+			return
+		}
+		if !opts.DryRun {
+			ok, err := db.sweep(path, cutoff)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				report.Recent++
+				return nil
+			}
+		}
+		report.add(path, info.Size())
+		return
+	})
+	Ck(err)
+	err = db.sweepPacks(marked, cutoff, opts.DryRun, report)
+	Ck(err)
+
+	return
+}
+
+// add counts path, an unreachable object of size bytes.
+func (report *GCReport) add(path *Path, size int64) {
+	report.Unreachable = append(report.Unreachable, GCObject{Path: path, Size: size})
+	switch path.Class {
+	case "block":
+		report.Blocks++
+		report.BlockBytes += size
+	case "tree":
+		report.Trees++
+		report.TreeBytes += size
+	}
+}
+
+// sweepPacks is the sweep for packed objects.  Packs are immutable,
+// so a pack holding unreachable objects is replaced by a new pack of
+// just its reachable ones, or removed if it has none.  A pack's
+// objects are as old as the pack file, so a pack modified after
+// cutoff is left alone.  An unreachable object that was also loose
+// has been reported already.
+func (db *Db) sweepPacks(marked map[string]bool, cutoff time.Time, dryrun bool, report *GCReport) (err error) {
+	defer Return(&err)
+	reported := make(map[string]bool)
+	for _, obj := range report.Unreachable {
+		reported[obj.Path.Canon] = true
+	}
+	cache := &packCache{}
+	_, err = db.loadPacks(cache)
+	Ck(err)
+	var names []string
+	for name := range cache.packs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		p := cache.packs[name]
+		var live []packSource
+		var dead []packEntry
+		for _, entry := range p.entries {
+			if marked[entry.canon] {
+				live = append(live, packedSource(p, entry))
+			} else {
+				dead = append(dead, entry)
+			}
+		}
+		if len(dead) == 0 {
+			continue
+		}
+		info, err := os.Stat(p.file)
+		Ck(err)
+		if info.ModTime().After(cutoff) {
+			report.Recent += len(dead)
+			continue
+		}
+		for _, entry := range dead {
+			if reported[entry.canon] {
+				continue
+			}
+			path, err := Path{}.New(db, entry.canon)
+			Ck(err)
+			report.add(path, entry.length)
+		}
+		if dryrun {
+			continue
+		}
+		if len(live) > 0 {
+			err = db.createPack(live)
+			Ck(err)
+		}
+		log.Debugf("gc: rewrote pack %s without %d objects", name, len(dead))
+		err = db.rmPack(p)
+		Ck(err)
+	}
+	return
+}
+
+// sweep removes the object at path unless it was modified after
+// cutoff, and says whether it did.  A concurrent writer may put the
+// same object again at any time, renaming a fresh copy over the old
+// one, so checking the mtime and then removing the file could remove
+// the fresh copy.  Instead sweep first moves the file into tmp, which
+// is atomic, and checks the mtime of the file it actually got.  If
+// that's a fresh copy, sweep moves it back; any other copy there is
+// the same object, so overwriting it is harmless.
+func (db *Db) sweep(path *Path, cutoff time.Time) (ok bool, err error) {
+	defer Return(&err)
+	fh, err := db.tmpFile()
+	Ck(err)
+	tmp := fh.Name()
+	fh.Close()
+	err = os.Rename(path.Abs, tmp)
+	if os.IsNotExist(err) {
+		// another GC beat us to it
+		os.Remove(tmp)
+		return false, nil
+	}
+	Ck(err)
+	info, err := os.Stat(tmp)
+	Ck(err)
+	if info.ModTime().After(cutoff) {
+		log.Debugf("gc: %s was put again, keeping it", path.Canon)
+		err = os.Rename(tmp, path.Abs)
+		Ck(err)
+		return false, nil
+	}
+	err = os.Remove(tmp)
+	Ck(err)
+	err = db.syncDir(filepath.Dir(path.Abs))
+	Ck(err)
+	return true, nil
+}
@@ -0,0 +1,200 @@
+package db
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestGC(t *testing.T) {
+	db := setup(t, nil)
+
+	// a label that has been moved, leaving its old tree behind
+	block1, err := db.PutBlock("sha256", mkbuf("blob1value"))
+	tck(t, err)
+	tree1, err := db.PutTree("sha256", block1)
+	tck(t, err)
+	_, err = tree1.LinkStream("stream1")
+	tck(t, err)
+	block2, err := db.PutBlock("sha256", mkbuf("blob2value"))
+	tck(t, err)
+	tree2, err := db.PutTree("sha256", block2)
+	tck(t, err)
+	stream, err := tree2.LinkStream("stream1")
+	tck(t, err)
+	stream, err = stream.AppendBlock("sha256", mkbuf("blob3value"))
+	tck(t, err)
+
+	// unreachable garbage
+	garbage, err := db.PutBlock("sha256", mkbuf("garbage"))
+	tck(t, err)
+
+	// a pinned tree that no label points at
+	pinblock, err := db.PutBlock("sha256", mkbuf("pinned"))
+	tck(t, err)
+	pintree, err := db.PutTree("sha256", pinblock)
+	tck(t, err)
+
+	// everything is too new to collect
+	report, err := db.GC(GCOpts{DryRun: true, Grace: time.Hour})
+	tck(t, err)
+	tassert(t, len(report.Unreachable) == 0, "unexpected unreachable objects: %v", report.Unreachable)
+	tassert(t, report.Recent == 5, "expected 5 recent, got %d", report.Recent)
+
+	// dry run
+	report, err = db.GC(GCOpts{DryRun: true, Pins: []*Path{pintree.Path}})
+	tck(t, err)
+	tassert(t, report.Roots == 2, "expected 2 roots, got %d", report.Roots)
+	tassert(t, report.Blocks == 2, "expected 2 blocks, got %d", report.Blocks)
+	tassert(t, report.Trees == 1, "expected 1 tree, got %d", report.Trees)
+	tassert(t, report.BlockBytes == int64(len("block\ngarbage")+len("block\nblob1value")), "block bytes %d", report.BlockBytes)
+	got := map[string]bool{}
+	for _, obj := range report.Unreachable {
+		got[obj.Path.Canon] = true
+		tassert(t, exists(obj.Path.Abs), "dry run removed %s", obj.Path.Canon)
+	}
+	tassert(t, got[garbage.Path.Canon], "garbage not reported: %v", got)
+	tassert(t, got[tree1.Path.Canon], "old root not reported: %v", got)
+
+	// for real, without the pin
+	report, err = db.GC(GCOpts{})
+	tck(t, err)
+	tassert(t, len(report.Unreachable) == 5, "expected 5 unreachable, got %v", report.Unreachable)
+	for _, obj := range report.Unreachable {
+		tassert(t, !exists(obj.Path.Abs), "not removed: %s", obj.Path.Canon)
+	}
+	tassert(t, exists(block2.Path.Abs), "reachable block removed")
+
+	// the stream survives intact
+	gotstream, err := db.OpenStream("stream1")
+	tck(t, err)
+	ok, err := gotstream.RootNode.Verify()
+	tck(t, err)
+	tassert(t, ok, "verify failed")
+
+	// nothing left to collect
+	report, err = db.GC(GCOpts{})
+	tck(t, err)
+	tassert(t, len(report.Unreachable) == 0, "unexpected unreachable objects: %v", report.Unreachable)
+}
+
+func TestGCSweepReput(t *testing.T) {
+	db := setup(t, nil)
+	block, err := db.PutBlock("sha256", mkbuf("garbage"))
+	tck(t, err)
+	old := time.Now().Add(-2 * time.Hour)
+	err = os.Chtimes(block.Path.Abs, old, old)
+	tck(t, err)
+	cutoff := time.Now().Add(-time.Hour)
+
+	// a writer puts the same block again after GC statted it
+	_, err = db.PutBlock("sha256", mkbuf("garbage"))
+	tck(t, err)
+	ok, err := db.sweep(block.Path, cutoff)
+	tck(t, err)
+	tassert(t, !ok, "swept a fresh copy")
+	tassert(t, exists(block.Path.Abs), "fresh copy removed")
+
+	err = os.Chtimes(block.Path.Abs, old, old)
+	tck(t, err)
+	ok, err = db.sweep(block.Path, cutoff)
+	tck(t, err)
+	tassert(t, ok, "old copy not swept")
+	tassert(t, !exists(block.Path.Abs), "old copy not removed")
+
+	// gone already
+	ok, err = db.sweep(block.Path, cutoff)
+	tck(t, err)
+	tassert(t, !ok, "swept a missing object")
+
+	infos, err := ioutil.ReadDir(db.tmpDir())
+	tck(t, err)
+	tassert(t, len(infos) == 0, "left %d temp files", len(infos))
+}
+
+func TestGCDangling(t *testing.T) {
+	db := setup(t, nil)
+	block, err := db.PutBlock("sha256", mkbuf("blob1value"))
+	tck(t, err)
+	tree, err := db.PutTree("sha256", block)
+	tck(t, err)
+	_, err = tree.LinkStream("stream1")
+	tck(t, err)
+	err = os.Remove(tree.Path.Abs)
+	tck(t, err)
+
+	// the block might be all that's left of the stream
+	_, err = db.GC(GCOpts{})
+	tassert(t, errors.Is(err, syscall.ENOENT), "expected ENOENT, got %v", err)
+	tassert(t, exists(block.Path.Abs), "swept a dangling label's block")
+
+	// a symlink we can't follow stops GC too, even with SkipDangling
+	err = os.Symlink("/nowhere", filepath.Join(db.Dir, "stream", "broken"))
+	tck(t, err)
+	_, err = db.GC(GCOpts{SkipDangling: true})
+	tassert(t, err != nil, "expected error for an unresolvable label")
+	tassert(t, exists(block.Path.Abs), "swept with an unresolvable label")
+	err = os.Remove(filepath.Join(db.Dir, "stream", "broken"))
+	tck(t, err)
+
+	report, err := db.GC(GCOpts{SkipDangling: true})
+	tck(t, err)
+	tassert(t, len(report.Unreachable) == 1 && !exists(block.Path.Abs), "unreachable %v", report.Unreachable)
+}
+
+func TestGCPacked(t *testing.T) {
+	db := setup(t, nil)
+	tree, err := db.PutStream("sha256", strings.NewReader(strings.Repeat("some stream data\n", 1000)), PutStreamOpts{})
+	tck(t, err)
+	_, err = tree.LinkStream("stream1")
+	tck(t, err)
+	garbage, err := db.PutBlock("sha256", mkbuf("garbage"))
+	tck(t, err)
+	_, err = db.Repack(RepackOpts{})
+	tck(t, err)
+	tassert(t, !exists(garbage.Path.Abs) && db.Exists(garbage.Path), "garbage wasn't packed")
+	packs, err := filepath.Glob(filepath.Join(db.packDir(), "*.pack"))
+	tck(t, err)
+	tassert(t, len(packs) == 1, "packs %v", packs)
+
+	// a new pack's objects are as recent as the pack
+	report, err := db.GC(GCOpts{Grace: time.Hour})
+	tck(t, err)
+	tassert(t, len(report.Unreachable) == 0 && report.Recent == 1, "unreachable %v, recent %d", report.Unreachable, report.Recent)
+	old := time.Now().Add(-2 * time.Hour)
+	err = os.Chtimes(packs[0], old, old)
+	tck(t, err)
+
+	report, err = db.GC(GCOpts{DryRun: true, Grace: time.Hour})
+	tck(t, err)
+	tassert(t, len(report.Unreachable) == 1 && report.Unreachable[0].Path.Canon == garbage.Path.Canon, "unreachable %v", report.Unreachable)
+	tassert(t, db.Exists(garbage.Path), "dry run removed packed garbage")
+
+	report, err = db.GC(GCOpts{Grace: time.Hour})
+	tck(t, err)
+	tassert(t, len(report.Unreachable) == 1 && report.Blocks == 1, "unreachable %v", report.Unreachable)
+	tassert(t, !db.Exists(garbage.Path), "packed garbage survived")
+	stream, err := db.OpenStream("stream1")
+	tck(t, err)
+	ok, err := stream.RootNode.Verify()
+	tck(t, err)
+	tassert(t, ok, "verify failed")
+	fsck, err := db.Fsck(FsckOpts{})
+	tck(t, err)
+	tassert(t, fsck.Ok(), "fsck problems %v", fsck.Problems)
+
+	// a pack with nothing left alive goes away
+	err = db.DeleteStream("stream1")
+	tck(t, err)
+	report, err = db.GC(GCOpts{})
+	tck(t, err)
+	tassert(t, len(report.Unreachable) > 0, "nothing collected")
+	packs, err = filepath.Glob(filepath.Join(db.packDir(), "*"))
+	tck(t, err)
+	tassert(t, len(packs) == 0, "packs left %v", packs)
+}
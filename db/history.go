@@ -0,0 +1,201 @@
+package db
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	. "github.com/stevegt/goadapt"
+)
+
+// HistoryEntry records one change to a stream label.  Each label has
+// an append-only log of these at history/<label>@log, mirroring the
+// stream/ namespace, with one JSON object per line, oldest first.
+type HistoryEntry struct {
+	Time time.Time `json:"time"`
+	Uid  int       `json:"uid"`
+	Op   string    `json:"op"`            // operation that moved the label
+	Old  string    `json:"old,omitempty"` // previous canpath, empty if new label
+	New  string    `json:"new,omitempty"` // canpath the label now points at, empty if deleted
+}
+
+// historySuffix ends each history file's name.  Labels can't contain
+// "@", so a label's history file never sits where another label's
+// history needs a dir, e.g. after logs is deleted and logs/today is
+// linked.
+const historySuffix = "@log"
+
+func (db *Db) historyFile(label string) string {
+	return filepath.Join(db.Dir, "history", label+historySuffix)
+}
+
+// recordHistory appends an entry to label's history.  The caller must
+// hold the lock.
+func (db *Db) recordHistory(label string, old, new *Path, op string) (err error) {
+	defer Return(&err)
+	entry := HistoryEntry{Time: time.Now().UTC(), Uid: os.Getuid(), Op: op}
+	if old != nil {
+		entry.Old = old.Canon
+	}
+	if new != nil {
+		entry.New = new.Canon
+	}
+	buf, err := json.Marshal(entry)
+	Ck(err)
+	fn := db.historyFile(label)
+	dir := filepath.Dir(fn)
+	err = db.mkdirAll(dir)
+	Ck(err)
+	created := !exists(fn)
+	fh, err := os.OpenFile(fn, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	Ck(err)
+	defer fh.Close()
+	_, err = fh.Write(append(buf, '\n'))
+	Ck(err)
+	err = db.syncFile(fh)
+	Ck(err)
+	if created {
+		err = db.syncDir(dir)
+		Ck(err)
+	}
+	return
+}
+
+// History returns the history of label, oldest first.  A label with
+// no recorded changes has an empty history.
+func (db *Db) History(label string) (entries []HistoryEntry, err error) {
+	defer Return(&err)
+	fh, err := os.Open(db.historyFile(label))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	Ck(err)
+	defer fh.Close()
+	scanner := bufio.NewScanner(fh)
+	for scanner.Scan() {
+		var entry HistoryEntry
+		err = json.Unmarshal(scanner.Bytes(), &entry)
+		Ck(err)
+		entries = append(entries, entry)
+	}
+	err = scanner.Err()
+	Ck(err)
+	return
+}
+
+// walkHistory calls fn with the history of every label that has one,
+// including labels that have since been removed.
+func (db *Db) walkHistory(fn func(label string, entries []HistoryEntry) error) (err error) {
+	defer Return(&err)
+	dir := filepath.Join(db.Dir, "history")
+	if !exists(dir) {
+		return
+	}
+	err = filepath.Walk(dir, func(abs string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() || !strings.HasSuffix(abs, historySuffix) {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, abs)
+		if err != nil {
+			return err
+		}
+		label := strings.TrimSuffix(rel, historySuffix)
+		entries, err := db.History(label)
+		if err != nil {
+			return err
+		}
+		return fn(label, entries)
+	})
+	Ck(err)
+	return
+}
+
+// splitLabelSpec splits a label of the form name@{selector} into its
+// parts.  ok is false if spec has no selector.
+func splitLabelSpec(spec string) (name, selector string, ok bool, err error) {
+	i := strings.Index(spec, "@{")
+	if i < 0 {
+		return spec, "", false, nil
+	}
+	if !strings.HasSuffix(spec, "}") {
+		return "", "", false, fmt.Errorf("%w: malformed label: %s", syscall.EINVAL, spec)
+	}
+	return spec[:i], spec[i+2 : len(spec)-1], true, nil
+}
+
+// historyTimeFormats are the layouts accepted in name@{time}.
+// Times without a zone are local.
+var historyTimeFormats = []string{
+	time.RFC3339,
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04:05",
+	"2006-01-02 15:04",
+	"2006-01-02",
+}
+
+// ResolveLabel returns the path of the tree a label points at.  The
+// label may carry a history selector: name@{n} is the tree the label
+// pointed at n changes ago, with name@{0} being the current tree, and
+// name@{time} is the tree it pointed at as of time, e.g.
+// name@{2026-10-01} for midnight local time on that date.
+func (db *Db) ResolveLabel(spec string) (target *Path, err error) {
+	defer Return(&err)
+	name, selector, ok, err := splitLabelSpec(spec)
+	Ck(err)
+	err = checkStoredLabel(name)
+	Ck(err)
+	if !ok {
+		target, err = db.labelTarget(name)
+		Ck(err)
+		ErrnoIf(target == nil, syscall.ENOENT, "no such stream: %s", name)
+		return
+	}
+	entries, err := db.History(name)
+	Ck(err)
+	var canon string
+	if n, err := strconv.Atoi(selector); err == nil {
+		ErrnoIf(n < 0 || n >= len(entries), syscall.ENOENT, "no such history entry: %s", spec)
+		canon = entries[len(entries)-1-n].New
+		ErrnoIf(canon == "", syscall.ENOENT, "stream %s was deleted as of %s", name, spec)
+	} else {
+		t, err := parseHistoryTime(selector)
+		Ck(err)
+		for _, entry := range entries {
+			if entry.Time.After(t) {
+				break
+			}
+			canon = entry.New
+		}
+		// canon is also empty if the label had been deleted by then
+		ErrnoIf(canon == "", syscall.ENOENT, "no history for %s as of %s", name, selector)
+	}
+	return Path{}.New(db, canon)
+}
+
+func parseHistoryTime(s string) (t time.Time, err error) {
+	for _, layout := range historyTimeFormats {
+		t, err = time.ParseInLocation(layout, s, time.Local)
+		if err == nil {
+			return
+		}
+	}
+	return t, fmt.Errorf("%w: malformed time: %s", syscall.EINVAL, s)
+}
+
+// ResetLabel points label back at target, which is usually a tree
+// from the label's history, and records the reset in the history.
+func (db *Db) ResetLabel(label string, target *Path) (err error) {
+	defer Return(&err)
+	tree, err := db.GetTree(target)
+	Ck(err)
+	return db.linkLabel(label, tree, "reset")
+}
@@ -0,0 +1,92 @@
+package db
+
+import (
+	"testing"
+	"time"
+)
+
+func TestHistory(t *testing.T) {
+	db := setup(t, nil)
+	block1, err := db.PutBlock("sha256", mkbuf("blob1value"))
+	tck(t, err)
+	tree1, err := db.PutTree("sha256", block1)
+	tck(t, err)
+	stream, err := tree1.LinkStream("stream1")
+	tck(t, err)
+	stream, err = stream.AppendBlock("sha256", mkbuf("blob2value"))
+	tck(t, err)
+	tree2 := stream.RootNode
+
+	entries, err := db.History("stream1")
+	tck(t, err)
+	tassert(t, len(entries) == 2, "expected 2 entries, got %v", entries)
+	tassert(t, entries[0].Op == "linkstream" && entries[0].Old == "" && entries[0].New == tree1.Path.Canon, "entry 0 %v", entries[0])
+	tassert(t, entries[1].Op == "append" && entries[1].Old == tree1.Path.Canon && entries[1].New == tree2.Path.Canon, "entry 1 %v", entries[1])
+
+	// @{n}
+	path, err := db.ResolveLabel("stream1@{0}")
+	tck(t, err)
+	tassert(t, path.Canon == tree2.Path.Canon, "@{0} is %s", path.Canon)
+	path, err = db.ResolveLabel("stream1@{1}")
+	tck(t, err)
+	tassert(t, path.Canon == tree1.Path.Canon, "@{1} is %s", path.Canon)
+	_, err = db.ResolveLabel("stream1@{2}")
+	tassert(t, err != nil, "expected error for @{2}")
+
+	// @{time}
+	_, err = db.ResolveLabel("stream1@{2000-01-01}")
+	tassert(t, err != nil, "expected error before any history")
+	snap, err := db.OpenStream("stream1@{" + time.Now().Add(time.Hour).Format(time.RFC3339) + "}")
+	tck(t, err)
+	tassert(t, snap.RootNode.Path.Canon == tree2.Path.Canon, "snapshot is %s", snap.RootNode.Path.Canon)
+	_, err = snap.AppendBlock("sha256", mkbuf("blob3value"))
+	tassert(t, err != nil, "appended to a snapshot")
+
+	// reset
+	err = db.ResetLabel("stream1", tree1.Path)
+	tck(t, err)
+	stream, err = db.OpenStream("stream1")
+	tck(t, err)
+	tassert(t, stream.RootNode.Path.Canon == tree1.Path.Canon, "reset failed")
+	entries, err = db.History("stream1")
+	tck(t, err)
+	tassert(t, len(entries) == 3 && entries[2].Op == "reset", "entries %v", entries)
+
+	// history keeps the abandoned tree alive during retention
+	report, err := db.GC(GCOpts{Retention: time.Hour})
+	tck(t, err)
+	tassert(t, len(report.Unreachable) == 0, "unreachable %v", report.Unreachable)
+	report, err = db.GC(GCOpts{})
+	tck(t, err)
+	tassert(t, report.Trees == 1 && report.Blocks == 1, "expected 1 tree and 1 block, got %d and %d", report.Trees, report.Blocks)
+}
+
+func TestHistoryNestedAfterDelete(t *testing.T) {
+	db := setup(t, nil)
+	block, err := db.PutBlock("sha256", mkbuf("blob1value"))
+	tck(t, err)
+	tree, err := db.PutTree("sha256", block)
+	tck(t, err)
+	_, err = tree.LinkStream("logs")
+	tck(t, err)
+	err = db.DeleteStream("logs")
+	tck(t, err)
+
+	// logs' history stays, and mustn't be in the way of logs/today's
+	_, err = tree.LinkStream("logs/today")
+	tck(t, err)
+	entries, err := db.History("logs")
+	tck(t, err)
+	tassert(t, len(entries) == 2 && entries[1].Op == "delete", "logs entries %v", entries)
+	entries, err = db.History("logs/today")
+	tck(t, err)
+	tassert(t, len(entries) == 1 && entries[0].New == tree.Path.Canon, "logs/today entries %v", entries)
+
+	labels := map[string]bool{}
+	err = db.walkHistory(func(label string, entries []HistoryEntry) error {
+		labels[label] = true
+		return nil
+	})
+	tck(t, err)
+	tassert(t, len(labels) == 2 && labels["logs"] && labels["logs/today"], "walked %v", labels)
+}
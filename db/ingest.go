@@ -0,0 +1,146 @@
+package db
+
+import (
+	"io"
+	"runtime"
+	"sync"
+)
+
+// ingest is a PutStream run.  The chunker runs in its own goroutine
+// and hands each chunk to a pool of workers, which hash and store the
+// chunks as blocks.  The caller builds the tree from the workers'
+// results, putting them back in stream order, so the tree comes out
+// the same as if everything ran in one goroutine.
+//
+// The chunker's buffer is reused by each call to Next, so each chunk
+// is copied into one of the pool's buffers, and the chunker waits
+// for a free buffer before reading on.  There are as many buffers as
+// workers, and chunks are never larger than MaxSize, so an ingest
+// holds at most MaxSize × workers bytes of chunks.
+type ingest struct {
+	db      *Db
+	algo    string
+	chunker Chunker
+	jobs    chan ingestJob
+	results chan ingestResult
+	free    chan []byte   // buffers not holding a chunk
+	stop    chan struct{} // closed to stop the chunker early
+	readErr error         // the chunker's error, once results is closed
+}
+
+type ingestJob struct {
+	seq  int
+	data []byte
+}
+
+type ingestResult struct {
+	seq   int
+	block *Block
+	err   error
+}
+
+// workers returns the number of workers for opts, one per CPU if
+// opts.Workers isn't set.
+func (opts PutStreamOpts) workers() int {
+	if opts.Workers < 1 {
+		return runtime.NumCPU()
+	}
+	return opts.Workers
+}
+
+func (ing ingest) New(db *Db, algo string, chunker Chunker, workers int) *ingest {
+	ing.db = db
+	ing.algo = algo
+	ing.chunker = chunker
+	ing.jobs = make(chan ingestJob)
+	ing.results = make(chan ingestResult, workers)
+	ing.free = make(chan []byte, workers)
+	for i := 0; i < workers; i++ {
+		ing.free <- nil
+	}
+	ing.stop = make(chan struct{})
+
+	go ing.chunk()
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ing.work()
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(ing.results)
+	}()
+	return &ing
+}
+
+// chunk feeds the chunker's output to the workers.
+func (ing *ingest) chunk() {
+	defer close(ing.jobs)
+	for seq := 0; ; seq++ {
+		var buf []byte
+		select {
+		case buf = <-ing.free:
+		case <-ing.stop:
+			return
+		}
+		data, err := ing.chunker.Next()
+		if err != nil {
+			ing.free <- buf
+			if err != io.EOF {
+				ing.readErr = err
+			}
+			return
+		}
+		select {
+		case ing.jobs <- ingestJob{seq: seq, data: append(buf[:0], data...)}:
+		case <-ing.stop:
+			ing.free <- buf
+			return
+		}
+	}
+}
+
+// work stores chunks as blocks until there are no more.
+func (ing *ingest) work() {
+	for job := range ing.jobs {
+		block, err := ing.db.PutBlock(ing.algo, job.data)
+		ing.free <- job.data
+		ing.results <- ingestResult{seq: job.seq, block: block, err: err}
+	}
+}
+
+// each calls fn with each block in stream order.  If fn or a worker
+// fails, each stops the chunker, waits for the workers to finish, and
+// returns the first error.
+func (ing *ingest) each(fn func(block *Block) error) (err error) {
+	pending := make(map[int]*Block)
+	next := 0
+	for res := range ing.results {
+		if err != nil {
+			// draining
+			continue
+		}
+		if res.err != nil {
+			err = res.err
+			close(ing.stop)
+			continue
+		}
+		pending[res.seq] = res.block
+		for block, ok := pending[next]; ok; block, ok = pending[next] {
+			delete(pending, next)
+			next++
+			err = fn(block)
+			if err != nil {
+				close(ing.stop)
+				break
+			}
+		}
+	}
+	if err != nil {
+		return
+	}
+	return ing.readErr
+}
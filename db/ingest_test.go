@@ -0,0 +1,118 @@
+package db
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/hlubek/readercomp"
+)
+
+func TestPutStreamParallel(t *testing.T) {
+	db := setup(t, &Db{MinSize: 64, MaxSize: 512, Fanout: 4})
+	data := goldenData(64 * kiB)
+
+	for _, name := range []string{ChunkRabin, ChunkFastCDC, ChunkFixed} {
+		// build the tree the sequential way, by hand
+		chunker, err := db.newChunker(name)
+		tck(t, err)
+		chunker.Start(bytes.NewReader(data))
+		builder := treeBuilder{Db: db, Algo: "sha256", Fanout: db.fanout()}.New()
+		for {
+			chunk, err := chunker.Next()
+			if err == io.EOF {
+				break
+			}
+			tck(t, err)
+			block, err := db.PutBlock("sha256", chunk)
+			tck(t, err)
+			err = builder.Add(block)
+			tck(t, err)
+		}
+		want, err := builder.Root()
+		tck(t, err)
+
+		for _, workers := range []int{0, 1, 2, 8} {
+			tree, err := db.PutStream("sha256", bytes.NewReader(data), PutStreamOpts{Chunker: name, Workers: workers})
+			tck(t, err)
+			tassert(t, tree.Path.Canon == want.Path.Canon, "%s, %d workers: expected %s, got %s", name, workers, want.Path.Canon, tree.Path.Canon)
+			ok, err := readercomp.Equal(bytes.NewReader(data), tree, 4096)
+			tck(t, err)
+			tassert(t, ok, "%s, %d workers: stream mismatch", name, workers)
+		}
+	}
+}
+
+// countingChunker counts the chunks it hands out.
+type countingChunker struct {
+	Chunker
+	n int32
+}
+
+func (c *countingChunker) Next() (data []byte, err error) {
+	data, err = c.Chunker.Next()
+	if err == nil {
+		atomic.AddInt32(&c.n, 1)
+	}
+	return
+}
+
+func TestIngestBounded(t *testing.T) {
+	db := setup(t, &Db{MinSize: 64, MaxSize: 512})
+	inner, err := db.newChunker(ChunkFixed)
+	tck(t, err)
+	chunker := &countingChunker{Chunker: inner}
+	chunker.Start(bytes.NewReader(goldenData(1 * miB)))
+
+	// while the tree builder is stuck on the first block, the
+	// chunker has to stop, since the workers' buffers fill up
+	workers := 2
+	ing := ingest{}.New(db, "sha256", chunker, workers)
+	stuck := true
+	var blocks int
+	err = ing.each(func(block *Block) error {
+		if stuck {
+			time.Sleep(100 * time.Millisecond)
+			// the one in hand, the ones waiting in results, the
+			// workers' own, and the one the chunker is holding
+			max := int32(1 + 3*workers + 1)
+			n := atomic.LoadInt32(&chunker.n)
+			tassert(t, n <= max, "chunker ran ahead: %d chunks, max %d", n, max)
+			stuck = false
+		}
+		blocks++
+		return nil
+	})
+	tck(t, err)
+	tassert(t, blocks == 2048, "got %d blocks", blocks)
+	tassert(t, len(ing.free) == workers, "%d buffers returned, expected %d", len(ing.free), workers)
+}
+
+// errReader fails after size bytes.
+type errReader struct {
+	size int
+}
+
+func (r *errReader) Read(buf []byte) (n int, err error) {
+	if r.size == 0 {
+		return 0, io.ErrClosedPipe
+	}
+	n = len(buf)
+	if n > r.size {
+		n = r.size
+	}
+	r.size -= n
+	return
+}
+
+func TestPutStreamErrors(t *testing.T) {
+	db := setup(t, &Db{MinSize: 64, MaxSize: 512})
+	_, err := db.PutStream("sha256", &errReader{size: 100 * kiB}, PutStreamOpts{Workers: 4})
+	tassert(t, errors.Is(err, io.ErrClosedPipe), "expected read error, got %v", err)
+
+	_, err = db.PutStream("nosuchalgo", bytes.NewReader(goldenData(100*kiB)), PutStreamOpts{Workers: 4})
+	tassert(t, err != nil, "expected error for a bad algo")
+}
@@ -0,0 +1,340 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"syscall"
+
+	"github.com/google/renameio"
+	log "github.com/sirupsen/logrus"
+	. "github.com/stevegt/goadapt"
+)
+
+// ConflictError is returned by UpdateLabel when the label no longer
+// points at the expected tree.
+type ConflictError struct {
+	Label    string
+	Expected *Path // nil means the label was expected not to exist
+	Actual   *Path // nil means the label doesn't exist
+}
+
+func (e *ConflictError) Error() string {
+	canon := func(path *Path) string {
+		if path == nil {
+			return "(none)"
+		}
+		return path.Canon
+	}
+	return fmt.Sprintf("label conflict: stream/%s: expected %s, found %s",
+		e.Label, canon(e.Expected), canon(e.Actual))
+}
+
+// lock takes an exclusive, db-wide lock on label updates and returns
+// a function that releases it.  The lock is an flock(2) on the lock
+// file in the db root, so it serializes goroutines as well as
+// processes; each call opens its own file description.
+func (db *Db) lock() (unlock func(), err error) {
+	defer Return(&err)
+	fh, err := os.OpenFile(filepath.Join(db.Dir, "lock"), os.O_RDWR|os.O_CREATE, 0644)
+	Ck(err)
+	for {
+		err = syscall.Flock(int(fh.Fd()), syscall.LOCK_EX)
+		if err != syscall.EINTR {
+			break
+		}
+	}
+	if err != nil {
+		fh.Close()
+		Ck(err)
+	}
+	unlock = func() {
+		// closing the file releases the lock
+		fh.Close()
+	}
+	return
+}
+
+// labelTarget returns the path of the tree that label points at, or
+// nil if the label doesn't exist.  The tree itself might not exist if
+// it was removed by GC or by hand.
+func (db *Db) labelTarget(label string) (target *Path, err error) {
+	defer Return(&err)
+	err = checkStoredLabel(label)
+	Ck(err)
+	linkabspath := filepath.Join(db.Dir, "stream", label)
+	src, err := os.Readlink(linkabspath)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	Ck(err)
+	if !filepath.IsAbs(src) {
+		src = filepath.Join(filepath.Dir(linkabspath), src)
+	}
+	target, err = Path{}.New(db, src)
+	if errors.Is(err, syscall.ENOENT) {
+		// a missing object/ path can't say what class it is, but a
+		// label always points at a tree
+		parts := strings.Split(strings.TrimPrefix(src, db.Dir+"/"), "/")
+		if len(parts) >= 3 && parts[0] == unifiedDir {
+			return Path{}.New(db, filepath.Join("tree", parts[1], parts[len(parts)-1]))
+		}
+	}
+	return
+}
+
+// UpdateLabel atomically moves label from old to new.  If the label
+// doesn't currently point at old, it is left alone and a
+// *ConflictError is returned; callers should reload the label and
+// retry.  A nil old means the label must not exist yet.
+func (db *Db) UpdateLabel(label string, old, new *Tree) (err error) {
+	return db.updateLabel(label, old, new, "update")
+}
+
+// updateLabel is UpdateLabel with the operation name recorded in the
+// label's history.
+func (db *Db) updateLabel(label string, old, new *Tree, op string) (err error) {
+	defer Return(&err)
+	unlock, err := db.lock()
+	Ck(err)
+	defer unlock()
+	actual, err := db.labelTarget(label)
+	Ck(err)
+	var expected *Path
+	if old != nil {
+		expected = old.Path
+	}
+	switch {
+	case actual == nil && expected == nil:
+	case actual != nil && expected != nil && actual.Canon == expected.Canon:
+	default:
+		return &ConflictError{Label: label, Expected: expected, Actual: actual}
+	}
+	return db.setLabel(label, actual, new, op)
+}
+
+// linkLabel points the stream label at tree, replacing any existing
+// link.  The tree must already be durable; see sync.go.  op is
+// recorded in the label's history.
+func (db *Db) linkLabel(label string, tree *Tree, op string) (err error) {
+	defer Return(&err)
+	unlock, err := db.lock()
+	Ck(err)
+	defer unlock()
+	actual, err := db.labelTarget(label)
+	Ck(err)
+	return db.setLabel(label, actual, tree, op)
+}
+
+// setLabel does the work for linkLabel and updateLabel.  The caller
+// must hold the lock.  old is the label's current target, if any.
+func (db *Db) setLabel(label string, old *Path, tree *Tree, op string) (err error) {
+	defer Return(&err)
+	if old == nil {
+		err = db.checkLabelPath(label)
+	} else {
+		err = checkStoredLabel(label)
+	}
+	Ck(err)
+	// the history goes first so the label never moves without it
+	err = db.recordHistory(label, old, tree.Path, op)
+	Ck(err)
+	linkabspath := filepath.Join(db.Dir, "stream", label)
+	linkdir := filepath.Dir(linkabspath)
+	err = db.mkdirAll(linkdir)
+	Ck(err)
+	// relative, so the db dir can be moved
+	src, err := filepath.Rel(linkdir, tree.Path.Abs)
+	Ck(err)
+	log.Debugf("linkabspath %#v", linkabspath)
+	err = renameio.Symlink(src, linkabspath)
+	Ck(err)
+	err = db.syncDir(linkdir)
+	Ck(err)
+	return
+}
+
+// labelComponent is the pattern each slash-separated part of a label
+// must match.
+var labelComponent = regexp.MustCompile(`^[A-Za-z0-9_+-][A-Za-z0-9._+-]*$`)
+
+// ValidateLabel checks that label is a legal stream label.  Labels
+// are hierarchical, e.g. images/ubuntu/22.04.  Each slash-separated
+// component may contain ASCII letters, digits, and the characters
+// "._+-", must not start with ".", and is at most 255 bytes long.
+// This keeps labels from escaping the stream/ dir and leaves "@" free
+// for history selectors.
+func ValidateLabel(label string) (err error) {
+	defer Return(&err)
+	ErrnoIf(label == "", syscall.EINVAL, "empty label")
+	for _, part := range strings.Split(label, "/") {
+		ok := labelComponent.MatchString(part) && len(part) <= 255
+		ErrnoIf(!ok, syscall.EINVAL, "invalid label: %q", label)
+	}
+	return
+}
+
+// checkStoredLabel checks a label that may already exist.  Labels
+// made before ValidateLabel existed may break its rules, e.g.
+// alpine:3.12, so existing labels are read, moved, and deleted as they
+// are, as long as they stay inside the stream/ dir.  Only new labels
+// have to pass ValidateLabel.
+func checkStoredLabel(label string) (err error) {
+	defer Return(&err)
+	ErrnoIf(label == "", syscall.EINVAL, "empty label")
+	ok := !filepath.IsAbs(label) && filepath.Clean(label) == label
+	for _, part := range strings.Split(label, "/") {
+		ok = ok && part != "." && part != ".."
+	}
+	ErrnoIf(!ok, syscall.EINVAL, "invalid label: %q", label)
+	return
+}
+
+// checkLabelPath validates label and makes sure it doesn't collide
+// with the hierarchy: no leading part of label may itself be a
+// label, and label may not be a prefix of other labels.
+func (db *Db) checkLabelPath(label string) (err error) {
+	defer Return(&err)
+	err = ValidateLabel(label)
+	Ck(err)
+	parts := strings.Split(label, "/")
+	for i := 1; i < len(parts); i++ {
+		prefix := strings.Join(parts[:i], "/")
+		info, err := os.Lstat(filepath.Join(db.Dir, "stream", prefix))
+		if os.IsNotExist(err) {
+			break
+		}
+		Ck(err)
+		ErrnoIf(!info.IsDir(), syscall.ENOTDIR, "%s is a stream, so %s can't be", prefix, label)
+	}
+	info, err := os.Lstat(filepath.Join(db.Dir, "stream", label))
+	if err == nil {
+		ErrnoIf(info.IsDir(), syscall.EISDIR, "%s is a prefix of other streams", label)
+	}
+	return nil
+}
+
+// ListStreams returns the labels matching pattern, in lexical order.
+// If pattern contains any of the glob characters "*?[", it is matched
+// against each whole label with path.Match, where "*" doesn't match
+// "/".  Otherwise pattern is a label prefix, matched component by
+// component: "images" matches "images" and "images/ubuntu/22.04" but
+// not "images2".  An empty pattern matches every label.
+func (db *Db) ListStreams(pattern string) (labels []string, err error) {
+	defer Return(&err)
+	glob := strings.ContainsAny(pattern, "*?[")
+	if glob {
+		_, err = path.Match(pattern, "")
+		Ck(err)
+	}
+	prefix := strings.TrimSuffix(pattern, "/")
+	err = db.walkLabels(func(label string, target *Path, lerr error) error {
+		var ok bool
+		switch {
+		case glob:
+			ok, _ = path.Match(pattern, label)
+		case prefix == "":
+			ok = true
+		default:
+			ok = label == prefix || strings.HasPrefix(label, prefix+"/")
+		}
+		if ok {
+			labels = append(labels, label)
+		}
+		return nil
+	})
+	Ck(err)
+	return
+}
+
+// RenameStream renames a stream label.  The label's history moves with
+// it, and the rename is recorded there.  newlabel must not exist.
+func (db *Db) RenameStream(oldlabel, newlabel string) (err error) {
+	defer Return(&err)
+	err = checkStoredLabel(oldlabel)
+	Ck(err)
+	err = db.checkLabelPath(newlabel)
+	Ck(err)
+	unlock, err := db.lock()
+	Ck(err)
+	defer unlock()
+	target, err := db.labelTarget(oldlabel)
+	Ck(err)
+	ErrnoIf(target == nil, syscall.ENOENT, "no such stream: %s", oldlabel)
+	actual, err := db.labelTarget(newlabel)
+	Ck(err)
+	ErrnoIf(actual != nil, syscall.EEXIST, "stream exists: %s", newlabel)
+
+	// the history goes first so the new label never exists without it
+	oldhist := db.historyFile(oldlabel)
+	newhist := db.historyFile(newlabel)
+	ErrnoIf(exists(newhist), syscall.EEXIST, "history exists: %s", newlabel)
+	if exists(oldhist) {
+		err = db.mkdirAll(filepath.Dir(newhist))
+		Ck(err)
+		err = os.Rename(oldhist, newhist)
+		Ck(err)
+		err = db.syncDir(filepath.Dir(newhist))
+		Ck(err)
+		err = db.syncDir(filepath.Dir(oldhist))
+		Ck(err)
+		db.rmEmptyDirs(filepath.Dir(oldhist), filepath.Join(db.Dir, "history"))
+	}
+
+	tree, err := db.GetTree(target)
+	Ck(err)
+	err = db.setLabel(newlabel, target, tree, "rename from "+oldlabel)
+	Ck(err)
+	err = db.rmLabel(oldlabel)
+	Ck(err)
+	return
+}
+
+// DeleteStream removes a stream label.  The trees it referred to are
+// left for GC, and the deletion is recorded in the label's history.
+func (db *Db) DeleteStream(label string) (err error) {
+	defer Return(&err)
+	err = checkStoredLabel(label)
+	Ck(err)
+	unlock, err := db.lock()
+	Ck(err)
+	defer unlock()
+	target, err := db.labelTarget(label)
+	Ck(err)
+	ErrnoIf(target == nil, syscall.ENOENT, "no such stream: %s", label)
+	err = db.recordHistory(label, target, nil, "delete")
+	Ck(err)
+	err = db.rmLabel(label)
+	Ck(err)
+	return
+}
+
+// rmLabel removes a label's symlink along with any parent dirs it
+// leaves empty.  The caller must hold the lock.
+func (db *Db) rmLabel(label string) (err error) {
+	defer Return(&err)
+	linkabspath := filepath.Join(db.Dir, "stream", label)
+	err = os.Remove(linkabspath)
+	Ck(err)
+	err = db.syncDir(filepath.Dir(linkabspath))
+	Ck(err)
+	db.rmEmptyDirs(filepath.Dir(linkabspath), filepath.Join(db.Dir, "stream"))
+	return
+}
+
+// rmEmptyDirs removes dir and its parents, stopping at top or at the
+// first dir that isn't empty.
+func (db *Db) rmEmptyDirs(dir, top string) {
+	for dir != top && strings.HasPrefix(dir, top) {
+		// Remove fails on non-empty dirs, which is what stops us
+		if os.Remove(dir) != nil {
+			return
+		}
+		db.syncDir(filepath.Dir(dir))
+		dir = filepath.Dir(dir)
+	}
+}
@@ -0,0 +1,260 @@
+package db
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestUpdateLabel(t *testing.T) {
+	db := setup(t, nil)
+	block1, err := db.PutBlock("sha256", mkbuf("blob1value"))
+	tck(t, err)
+	tree1, err := db.PutTree("sha256", block1)
+	tck(t, err)
+	tree2, err := db.PutTree("sha256", block1, block1)
+	tck(t, err)
+
+	// create
+	err = db.UpdateLabel("stream1", nil, tree1)
+	tck(t, err)
+	err = db.UpdateLabel("stream1", nil, tree2)
+	conflict, ok := err.(*ConflictError)
+	tassert(t, ok, "expected ConflictError, got %v", err)
+	tassert(t, conflict.Expected == nil && conflict.Actual.Canon == tree1.Path.Canon, "conflict %v", conflict)
+
+	// move
+	err = db.UpdateLabel("stream1", tree1, tree2)
+	tck(t, err)
+	err = db.UpdateLabel("stream1", tree1, tree2)
+	_, ok = err.(*ConflictError)
+	tassert(t, ok, "expected ConflictError, got %v", err)
+
+	stream, err := db.OpenStream("stream1")
+	tck(t, err)
+	tassert(t, stream.RootNode.Path.Canon == tree2.Path.Canon, "label not moved")
+}
+
+// appendN appends n blocks named after id to the journal stream.
+func appendN(db *Db, id string, n int) (err error) {
+	stream, err := db.OpenStream("journal")
+	if err != nil {
+		return
+	}
+	for i := 0; i < n; i++ {
+		stream, err = stream.AppendBlock("sha256", []byte(fmt.Sprintf("%s-%d\n", id, i)))
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// TestAppendHelper isn't a real test; TestConcurrentAppend runs it in
+// child processes.
+func TestAppendHelper(t *testing.T) {
+	dir := os.Getenv("PB_APPEND_HELPER_DB")
+	if dir == "" {
+		t.Skip("helper process only")
+	}
+	db, err := Open(dir)
+	tck(t, err)
+	err = appendN(db, os.Getenv("PB_APPEND_HELPER_ID"), 10)
+	tck(t, err)
+}
+
+func TestConcurrentAppend(t *testing.T) {
+	db := setup(t, nil)
+	block, err := db.PutBlock("sha256", mkbuf("start\n"))
+	tck(t, err)
+	tree, err := db.PutTree("sha256", block)
+	tck(t, err)
+	_, err = tree.LinkStream("journal")
+	tck(t, err)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 16)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(id string) {
+			defer wg.Done()
+			errs <- appendN(db, id, 10)
+		}(fmt.Sprintf("g%d", i))
+	}
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(id string) {
+			defer wg.Done()
+			cmd := exec.Command(os.Args[0], "-test.run=^TestAppendHelper$")
+			cmd.Env = append(os.Environ(), "PB_APPEND_HELPER_DB="+db.Dir, "PB_APPEND_HELPER_ID="+id)
+			out, err := cmd.CombinedOutput()
+			if err != nil {
+				err = fmt.Errorf("%v: %s", err, out)
+			}
+			errs <- err
+		}(fmt.Sprintf("p%d", i))
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		tck(t, err)
+	}
+
+	// every append must be there exactly once
+	stream, err := db.OpenStream("journal")
+	tck(t, err)
+	objects, err := stream.Ls(false)
+	tck(t, err)
+	tassert(t, len(objects) == 1+12*10, "expected %d leaves, got %d", 1+12*10, len(objects))
+	got := map[string]int{}
+	for _, obj := range objects {
+		buf, err := db.GetBlock(obj.GetPath())
+		tck(t, err)
+		got[strings.TrimSpace(string(buf))]++
+	}
+	for _, id := range []string{"g0", "g7", "p0", "p3"} {
+		for i := 0; i < 10; i++ {
+			key := fmt.Sprintf("%s-%d", id, i)
+			tassert(t, got[key] == 1, "%s appears %d times", key, got[key])
+		}
+	}
+}
+
+func TestValidateLabel(t *testing.T) {
+	good := []string{"a", "stream1", "images/ubuntu/22.04", "a_b-c+d", "x.y"}
+	for _, label := range good {
+		err := ValidateLabel(label)
+		tassert(t, err == nil, "%q: %v", label, err)
+	}
+	bad := []string{"", "/abs", "a/", "a//b", "..", "../x", "a/../b", ".hidden", "a/.b", "a b", "a@{1}", "a\\b", strings.Repeat("x", 256)}
+	for _, label := range bad {
+		err := ValidateLabel(label)
+		tassert(t, err != nil, "%q: expected error", label)
+	}
+}
+
+func TestStreamNamespace(t *testing.T) {
+	db := setup(t, nil)
+	block, err := db.PutBlock("sha256", mkbuf("blob1value"))
+	tck(t, err)
+	tree, err := db.PutTree("sha256", block)
+	tck(t, err)
+
+	for _, label := range []string{"images/ubuntu/22.04", "images/ubuntu/24.04", "images/alpine", "images2", "logs"} {
+		_, err = tree.LinkStream(label)
+		tck(t, err)
+	}
+	_, err = tree.LinkStream("../escape")
+	tassert(t, err != nil, "expected error for ../escape")
+	_, err = tree.LinkStream("logs/today")
+	tassert(t, err != nil, "expected error for a label under another label")
+	_, err = tree.LinkStream("images/ubuntu")
+	tassert(t, err != nil, "expected error for a label that is a prefix")
+
+	// nested labels resolve
+	stream, err := db.OpenStream("images/ubuntu/22.04")
+	tck(t, err)
+	tassert(t, stream.RootNode.Path.Canon == tree.Path.Canon, "wrong root %s", stream.RootNode.Path.Canon)
+
+	list := func(pattern string) string {
+		labels, err := db.ListStreams(pattern)
+		tck(t, err)
+		return strings.Join(labels, " ")
+	}
+	got := list("")
+	expect := "images/alpine images/ubuntu/22.04 images/ubuntu/24.04 images2 logs"
+	tassert(t, got == expect, "expected %q got %q", expect, got)
+	got = list("images")
+	expect = "images/alpine images/ubuntu/22.04 images/ubuntu/24.04"
+	tassert(t, got == expect, "expected %q got %q", expect, got)
+	got = list("images/*/2?.04")
+	expect = "images/ubuntu/22.04 images/ubuntu/24.04"
+	tassert(t, got == expect, "expected %q got %q", expect, got)
+	got = list("images*")
+	expect = "images2"
+	tassert(t, got == expect, "expected %q got %q", expect, got)
+
+	// rename
+	err = db.RenameStream("images/ubuntu/22.04", "archive/ubuntu/22.04")
+	tck(t, err)
+	err = db.RenameStream("images/ubuntu/24.04", "logs")
+	tassert(t, err != nil, "expected error renaming onto an existing label")
+	_, err = db.OpenStream("images/ubuntu/22.04")
+	tassert(t, err != nil, "old label still exists")
+	entries, err := db.History("archive/ubuntu/22.04")
+	tck(t, err)
+	tassert(t, len(entries) == 2 && entries[0].Op == "linkstream", "history didn't move: %v", entries)
+
+	// delete
+	err = db.DeleteStream("images/ubuntu/24.04")
+	tck(t, err)
+	tassert(t, !exists(filepath.Join(db.Dir, "stream", "images", "ubuntu")), "empty dir left behind")
+	err = db.DeleteStream("images/ubuntu/24.04")
+	tassert(t, err != nil, "expected error deleting a missing label")
+	_, err = db.ResolveLabel("images/ubuntu/24.04@{0}")
+	tassert(t, err != nil, "deleted label resolved")
+	path, err := db.ResolveLabel("images/ubuntu/24.04@{1}")
+	tck(t, err)
+	tassert(t, path.Canon == tree.Path.Canon, "wrong history %s", path.Canon)
+
+	got = list("")
+	expect = "archive/ubuntu/22.04 images/alpine images2 logs"
+	tassert(t, got == expect, "expected %q got %q", expect, got)
+}
+
+func TestLegacyLabel(t *testing.T) {
+	db := setup(t, nil)
+	block, err := db.PutBlock("sha256", mkbuf("blob1value"))
+	tck(t, err)
+	tree, err := db.PutTree("sha256", block)
+	tck(t, err)
+
+	// labels made before ValidateLabel existed are plain symlinks
+	for _, label := range []string{"alpine:3.12", "old:one"} {
+		linkabspath := filepath.Join(db.Dir, "stream", label)
+		err = os.MkdirAll(filepath.Dir(linkabspath), 0755)
+		tck(t, err)
+		src, err := filepath.Rel(filepath.Dir(linkabspath), tree.Path.Abs)
+		tck(t, err)
+		err = os.Symlink(src, linkabspath)
+		tck(t, err)
+	}
+
+	stream, err := db.OpenStream("alpine:3.12")
+	tck(t, err)
+	tassert(t, stream.RootNode.Path.Canon == tree.Path.Canon, "wrong root %s", stream.RootNode.Path.Canon)
+	stream, err = stream.AppendBlock("sha256", mkbuf("blob2value"))
+	tck(t, err)
+	entries, err := db.History("alpine:3.12")
+	tck(t, err)
+	tassert(t, len(entries) == 1 && entries[0].Old == tree.Path.Canon, "history %v", entries)
+
+	report, err := db.Fsck(FsckOpts{})
+	tck(t, err)
+	tassert(t, report.Ok() && report.Labels == 2, "fsck: %d labels, problems %v", report.Labels, report.Problems)
+	report2, err := db.GC(GCOpts{})
+	tck(t, err)
+	tassert(t, len(report2.Unreachable) == 0, "unreachable %v", report2.Unreachable)
+
+	err = db.RenameStream("alpine:3.12", "alpine/3.12")
+	tck(t, err)
+	err = db.DeleteStream("old:one")
+	tck(t, err)
+	labels, err := db.ListStreams("")
+	tck(t, err)
+	tassert(t, strings.Join(labels, " ") == "alpine/3.12", "labels %v", labels)
+
+	// but new labels must follow the rules
+	_, err = tree.LinkStream("new:one")
+	tassert(t, err != nil, "linked an invalid label")
+	err = db.RenameStream("alpine/3.12", "alpine:3.13")
+	tassert(t, err != nil, "renamed to an invalid label")
+	for _, label := range []string{"../escape", "/abs", ".", "a/../b"} {
+		_, err = db.OpenStream(label)
+		tassert(t, err != nil, "opened %q", label)
+	}
+}
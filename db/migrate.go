@@ -0,0 +1,320 @@
+package db
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	log "github.com/sirupsen/logrus"
+	. "github.com/stevegt/goadapt"
+)
+
+// A db's FormatVersion says how it's laid out on disk.  Dbs created
+// before FormatVersion was added to config.json are FormatLegacy.
+// FormatUnified dbs keep all objects in one object/ dir instead of
+// one dir per class; see path.go.  Open refuses dbs newer than
+// FormatCurrent, since it can't know how to read them, and warns
+// about older dbs; Migrate brings a db up to FormatCurrent.
+const (
+	FormatLegacy    = 0
+	FormatVersioned = 1 // first to record FormatVersion
+	FormatUnified   = 2
+	FormatCurrent   = FormatUnified
+)
+
+// formatOldest is the oldest format Open can still read.  Older dbs
+// have to be migrated first.
+const formatOldest = FormatLegacy
+
+// FormatError is returned by Open for a db whose format it can't read.
+type FormatError struct {
+	Dir     string
+	Version int
+}
+
+func (e *FormatError) Error() string {
+	if e.Version > FormatCurrent {
+		return fmt.Sprintf("db format %d is newer than this pitbase supports (%d), upgrade pitbase: %s", e.Version, FormatCurrent, e.Dir)
+	}
+	return fmt.Sprintf("db format %d is too old to open, run 'pb migrate' to upgrade it to format %d: %s", e.Version, FormatCurrent, e.Dir)
+}
+
+// checkFormat makes sure Open can read a db of format version.
+func checkFormat(dir string, version int) (err error) {
+	if version > FormatCurrent || version < formatOldest {
+		return &FormatError{Dir: dir, Version: version}
+	}
+	if version < FormatCurrent {
+		log.Warnf("db format %d is out of date, run 'pb migrate' to upgrade it to format %d: %s", version, FormatCurrent, dir)
+	}
+	return
+}
+
+// MigrateOpts controls the behavior of Db.Migrate.
+type MigrateOpts struct {
+	// Dir is a new db to migrate into.  If empty, the db is migrated
+	// in place.
+	Dir string
+	// TreeVersion is the tree format for the migrated db; zero keeps
+	// the db's setting.
+	TreeVersion int
+	// Compress is the block compression for the migrated db; nil
+	// keeps the db's setting.
+	Compress *string
+}
+
+// MigrateReport is returned by Db.Migrate.
+type MigrateReport struct {
+	Blocks int // blocks rewritten or copied
+	Trees  int // trees re-encoded or copied
+	Packs  int // packs unpacked
+	Labels int // labels moved
+	Moved  int // loose objects moved into the object/ dir
+}
+
+// Migrate brings the db up to FormatCurrent and re-encodes its
+// objects with the settings in opts, either in place or into a new db
+// in opts.Dir.  Every tree is re-encoded in the new tree format, so
+// its address changes, and every label is moved to its tree's new
+// address.  Blocks keep their addresses.  Loose objects of a db
+// older than FormatUnified are moved into the object/ dir.
+//
+// In place, the new settings are saved first, so if Migrate is
+// interrupted, running it again with the same options picks up where
+// it left off; the old trees are left for GC.  Likewise, a migration
+// into a new dir picks up where it left off if opts.Dir already holds
+// the partly-migrated db.  A new db gets the labels but not their
+// history.  Migrate while the db is otherwise idle.
+func (db *Db) Migrate(opts MigrateOpts) (report *MigrateReport, err error) {
+	defer Return(&err)
+	report = &MigrateReport{}
+
+	to := *db
+	if opts.TreeVersion != 0 {
+		to.TreeVersion = opts.TreeVersion
+	}
+	if opts.Compress != nil {
+		to.Compress = *opts.Compress
+	}
+	err = checkTreeVersion(to.TreeVersion)
+	Ck(err)
+	err = checkCompress(to.Compress)
+	Ck(err)
+
+	var dst *Db
+	if opts.Dir == "" || filepath.Clean(opts.Dir) == filepath.Clean(db.Dir) {
+		db.TreeVersion = to.TreeVersion
+		db.Compress = to.Compress
+		err = db.saveConfig()
+		Ck(err)
+		dst = db
+		// trees are never compressed, so only blocks go stale
+		wantFlate := db.Compress == CompressFlate
+		report.Blocks, report.Packs, err = db.rewriteStale(func(path *Path, raw *io.SectionReader) (ok bool, err error) {
+			if path.Class != "block" {
+				return
+			}
+			hdr, err := readHeader(raw, path.Class)
+			if err != nil {
+				return
+			}
+			return hdr.flate != wantFlate, nil
+		})
+		Ck(err)
+	} else {
+		dst, err = db.migrateDst(to, opts.Dir)
+		Ck(err)
+		err = db.eachObject(func(path *Path) (err error) {
+			defer Return(&err)
+			if path.Class != "block" {
+				return
+			}
+			dstpath, err := Path{}.New(dst, path.Canon)
+			Ck(err)
+			if dst.Exists(dstpath) {
+				return
+			}
+			_, err = copyObject(path, dstpath)
+			Ck(err)
+			report.Blocks++
+			return
+		})
+		Ck(err)
+	}
+
+	// every tree, not just the labeled ones, so a new db gets
+	// everything
+	m := &migration{src: db, dst: dst, done: make(map[string]*Path), report: report}
+	err = db.eachObject(func(path *Path) (err error) {
+		if path.Class != "tree" {
+			return
+		}
+		_, err = m.tree(path)
+		return
+	})
+	Ck(err)
+
+	err = db.walkLabels(func(label string, target *Path, lerr error) (err error) {
+		defer Return(&err)
+		if target == nil {
+			return fmt.Errorf("label %s: %w", label, lerr)
+		}
+		if lerr != nil {
+			// dangling labels are fsck's business
+			return
+		}
+		newpath, err := m.tree(target)
+		Ck(err)
+		old, err := dst.labelTarget(label)
+		Ck(err)
+		if old != nil && old.Canon == newpath.Canon {
+			return
+		}
+		var oldtree *Tree
+		if old != nil {
+			oldtree, err = dst.GetTree(old)
+			Ck(err)
+		}
+		newtree, err := dst.GetTree(newpath)
+		Ck(err)
+		err = dst.updateLabel(label, oldtree, newtree, "migrate")
+		Ck(err)
+		report.Labels++
+		return
+	})
+	Ck(err)
+
+	if !dst.unified() {
+		report.Moved, err = dst.unify()
+		Ck(err)
+	}
+
+	if dst.FormatVersion != FormatCurrent {
+		dst.FormatVersion = FormatCurrent
+		err = dst.saveConfig()
+		Ck(err)
+	}
+	// point the labels at where their trees are now
+	_, err = dst.relinkLabels()
+	Ck(err)
+	return
+}
+
+// unify moves the loose objects of a pre-FormatUnified db into
+// unifiedDir.  Readers look there for objects they can't find, so
+// the db stays readable while unify runs; the caller updates
+// FormatVersion when it's done.
+func (db *Db) unify() (moved int, err error) {
+	defer Return(&err)
+	to := *db
+	to.FormatVersion = FormatUnified
+	return db.moveAll(&to)
+}
+
+// migrateDst opens the db in dir that a migration into a new dir left
+// behind, or creates it with the settings in to.
+func (db *Db) migrateDst(to Db, dir string) (dst *Db, err error) {
+	defer Return(&err)
+	if exists(filepath.Join(dir, "config.json")) {
+		dst, err = Open(dir)
+		Ck(err)
+		ErrnoIf(dst.SecretID() != db.SecretID(), syscall.EINVAL, "%s has a different secret", dir)
+		return
+	}
+	to.Dir = dir
+	// everything in the new db is written with the current key
+	to.OldKeyFiles = nil
+	to.FormatVersion = FormatCurrent
+	return to.Create()
+}
+
+// eachObject calls fn for every object in the db, loose or packed.
+func (db *Db) eachObject(fn func(path *Path) error) (err error) {
+	defer Return(&err)
+	err = db.walkObjects(func(path *Path, info os.FileInfo) error {
+		return fn(path)
+	})
+	Ck(err)
+	err = db.walkPacked(func(p *pack, entry packEntry) (err error) {
+		defer Return(&err)
+		path, err := Path{}.New(db, entry.canon)
+		Ck(err)
+		return fn(path)
+	})
+	Ck(err)
+	return
+}
+
+// migration holds the state of a Migrate run.
+type migration struct {
+	src, dst *Db
+	done     map[string]*Path // src tree canpath -> migrated tree path
+	report   *MigrateReport
+}
+
+// tree migrates the tree at path, whose entries must already be in
+// dst, and returns the path of the migrated tree in dst.  A tree
+// that's already in the dst format, and whose subtrees are too, is
+// kept as is.
+func (m *migration) tree(path *Path) (newpath *Path, err error) {
+	defer Return(&err)
+	if newpath, ok := m.done[path.Canon]; ok {
+		return newpath, nil
+	}
+	obj, err := m.src.ObjectFromPath(path)
+	Ck(err)
+	tree := obj.(*Tree)
+	version, entries, err := tree.readTree()
+	Ck(err)
+
+	same := version == m.dst.treeVersion()
+	var children []Object
+	for _, entry := range entries {
+		child := entry.path
+		if child.Class == "tree" {
+			child, err = m.tree(child)
+			Ck(err)
+		} else {
+			child, err = Path{}.New(m.dst, child.Canon)
+			Ck(err)
+		}
+		same = same && child.Canon == entry.path.Canon
+		obj, err := m.dst.ObjectFromPath(child)
+		Ck(err)
+		children = append(children, obj)
+	}
+
+	if same {
+		newpath, err = Path{}.New(m.dst, path.Canon)
+		Ck(err)
+		if !m.dst.Exists(newpath) {
+			_, err = copyObject(path, newpath)
+			Ck(err)
+			m.report.Trees++
+		}
+	} else {
+		// work out the new address first, so a rerun doesn't
+		// rewrite trees it already did
+		buf, err := encodeTree(m.dst.treeVersion(), children)
+		Ck(err)
+		binhash, err := m.dst.Hash(path.Algo, append([]byte(path.header()), buf...))
+		Ck(err)
+		newpath, err = Path{}.New(m.dst, fmt.Sprintf("tree/%s/%s", path.Algo, bin2hex(binhash)))
+		Ck(err)
+		if !m.dst.Exists(newpath) {
+			file, err := createExpected(m.dst, newpath)
+			Ck(err)
+			_, err = file.Write(buf)
+			Ck(err)
+			err = file.Close()
+			if err != nil {
+				return nil, err
+			}
+			m.report.Trees++
+		}
+	}
+	m.done[path.Canon] = newpath
+	return
+}
@@ -0,0 +1,115 @@
+package db
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFormatVersion(t *testing.T) {
+	db := setup(t, nil)
+	tassert(t, db.FormatVersion == FormatCurrent, "format %d", db.FormatVersion)
+
+	// older dbs still open
+	db.FormatVersion = FormatLegacy
+	err := db.saveConfig()
+	tck(t, err)
+	_, err = Open(db.Dir)
+	tck(t, err)
+
+	// newer ones don't
+	db.FormatVersion = FormatCurrent + 1
+	err = db.saveConfig()
+	tck(t, err)
+	_, err = Open(db.Dir)
+	e, ok := err.(*FormatError)
+	tassert(t, ok && e.Version == FormatCurrent+1, "got %v", err)
+}
+
+func TestMigrate(t *testing.T) {
+	db := setup(t, &Db{Fanout: 4})
+	db.FormatVersion = FormatLegacy
+	err := db.saveConfig()
+	tck(t, err)
+	var content string
+	for i := 0; i < 2000; i++ {
+		content += fmt.Sprintf("line %d of the journal\n", i)
+	}
+	tree, err := db.PutStream("sha256", strings.NewReader(content), PutStreamOpts{})
+	tck(t, err)
+	_, err = tree.LinkStream("journal")
+	tck(t, err)
+	_, err = db.Repack(RepackOpts{})
+	tck(t, err)
+
+	readStream := func(db *Db) string {
+		stream, err := db.OpenStream("journal")
+		tck(t, err)
+		buf, err := ioutil.ReadAll(stream)
+		tck(t, err)
+		return string(buf)
+	}
+	treeVersion := func(db *Db, path *Path) int {
+		tree, err := db.GetTree(path)
+		tck(t, err)
+		version, _, err := tree.readTree()
+		tck(t, err)
+		return version
+	}
+
+	// into a new dir
+	newdir := filepath.Join(t.TempDir(), "new")
+	report, err := db.Migrate(MigrateOpts{Dir: newdir, TreeVersion: TreeV2})
+	tck(t, err)
+	tassert(t, report.Blocks > 0 && report.Trees > 0 && report.Labels == 1, "report %+v", report)
+	newdb, err := Open(newdir)
+	tck(t, err)
+	tassert(t, newdb.FormatVersion == FormatCurrent && newdb.TreeVersion == TreeV2, "new db %+v", newdb)
+	tassert(t, readStream(newdb) == content, "new db content differs")
+	root, err := newdb.ResolveLabel("journal")
+	tck(t, err)
+	tassert(t, treeVersion(newdb, root) == TreeV2, "new root not v2")
+	fsck, err := newdb.Fsck(FsckOpts{})
+	tck(t, err)
+	tassert(t, fsck.Ok(), "fsck problems: %v", fsck.Problems)
+	// the source is untouched
+	tassert(t, treeVersion(db, tree.Path) == TreeV1, "source tree changed")
+	// running it again finds nothing to do
+	report, err = db.Migrate(MigrateOpts{Dir: newdir, TreeVersion: TreeV2})
+	tck(t, err)
+	tassert(t, *report == MigrateReport{}, "report %+v", report)
+
+	// in place
+	flate := CompressFlate
+	report, err = db.Migrate(MigrateOpts{TreeVersion: TreeV2, Compress: &flate})
+	tck(t, err)
+	tassert(t, report.Blocks > 0 && report.Packs == 1 && report.Trees > 0 && report.Labels == 1 && report.Moved > 0, "report %+v", report)
+	db2, err := Open(db.Dir)
+	tck(t, err)
+	tassert(t, db2.FormatVersion == FormatCurrent && db2.TreeVersion == TreeV2 && db2.Compress == CompressFlate, "db %+v", db2)
+	tassert(t, readStream(db2) == content, "migrated content differs")
+	tassert(t, !exists(filepath.Join(db.Dir, "tree")), "loose trees not moved")
+	newroot, err := db2.ResolveLabel("journal")
+	tck(t, err)
+	tassert(t, newroot.Canon == root.Canon, "in-place root %s, new dir root %s", newroot.Canon, root.Canon)
+	entries, err := db2.History("journal")
+	tck(t, err)
+	last := entries[len(entries)-1]
+	tassert(t, last.Op == "migrate" && last.Old == tree.Path.Canon, "history %v", entries)
+	leaves, err := tree.Leaves()
+	tck(t, err)
+	fh, raw, err := db2.openRaw(leaves[0].GetPath())
+	tck(t, err)
+	hdr, err := readHeader(raw, "block")
+	fh.Close()
+	tck(t, err)
+	tassert(t, hdr.flate, "block not compressed")
+	report, err = db2.Migrate(MigrateOpts{TreeVersion: TreeV2, Compress: &flate})
+	tck(t, err)
+	tassert(t, *report == MigrateReport{}, "report %+v", report)
+
+	_, err = db2.Migrate(MigrateOpts{TreeVersion: 3})
+	tassert(t, err != nil, "expected error for tree version 3")
+}
@@ -0,0 +1,437 @@
+package db
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+
+	log "github.com/sirupsen/logrus"
+	. "github.com/stevegt/goadapt"
+)
+
+// Packs hold many small objects in one file, to save inodes and
+// seeks.  A pack is a pair of files in the pack/ dir:
+//
+//	pack/<hash>.pack  the objects' file contents, headers included,
+//	                  concatenated
+//	pack/<hash>.idx   one "<canpath> <offset> <length>\n" line per
+//	                  object, sorted by canpath
+//
+// where <hash> is the sha256 of the .pack file.  Packs are immutable.
+// The .idx file is written last, so a pack without one is incomplete
+// and is ignored.  OpenWorm falls back to the packs when an object
+// has no loose file, so callers don't need to know where an object
+// lives.
+
+// packEntry locates one object in a pack.
+type packEntry struct {
+	canon  string
+	offset int64
+	length int64
+}
+
+type pack struct {
+	file    string // absolute path of the .pack file
+	entries []packEntry
+}
+
+// find returns the entry for canon, if the pack has one.
+func (p *pack) find(canon string) (entry packEntry, ok bool) {
+	i := sort.Search(len(p.entries), func(i int) bool {
+		return p.entries[i].canon >= canon
+	})
+	if i < len(p.entries) && p.entries[i].canon == canon {
+		return p.entries[i], true
+	}
+	return
+}
+
+// packCache holds the indexes of the packs we've loaded so far.
+// It's shared by all copies of a Db made from the same Open or
+// Create.
+type packCache struct {
+	mu    sync.Mutex
+	packs map[string]*pack // keyed by .idx file name
+}
+
+func (db *Db) packDir() string {
+	return filepath.Join(db.Dir, "pack")
+}
+
+// packLookup finds the pack holding canon.  If it isn't in any pack
+// we know about, packLookup checks the pack dir for new packs before
+// giving up.
+func (db *Db) packLookup(canon string) (p *pack, entry packEntry, ok bool, err error) {
+	defer Return(&err)
+	cache := db.packs
+	if cache == nil {
+		// a Db that didn't come from Open or Create; don't cache
+		cache = &packCache{}
+	}
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	for pass := 0; pass < 2; pass++ {
+		for _, p = range cache.packs {
+			entry, ok = p.find(canon)
+			if ok {
+				return
+			}
+		}
+		if pass == 0 {
+			var changed bool
+			changed, err = db.loadPacks(cache)
+			Ck(err)
+			if !changed {
+				break
+			}
+		}
+	}
+	return nil, packEntry{}, false, nil
+}
+
+// loadPacks loads any indexes in the pack dir that aren't in cache
+// yet.  The caller must hold cache.mu.
+func (db *Db) loadPacks(cache *packCache) (changed bool, err error) {
+	defer Return(&err)
+	dir := db.packDir()
+	if !exists(dir) {
+		return
+	}
+	names, err := filepath.Glob(filepath.Join(dir, "*.idx"))
+	Ck(err)
+	if cache.packs == nil {
+		cache.packs = make(map[string]*pack)
+	}
+	for _, idx := range names {
+		name := filepath.Base(idx)
+		if cache.packs[name] != nil {
+			continue
+		}
+		p, err := readPackIndex(idx)
+		Ck(err)
+		cache.packs[name] = p
+		changed = true
+	}
+	return
+}
+
+func readPackIndex(idx string) (p *pack, err error) {
+	defer Return(&err)
+	fh, err := os.Open(idx)
+	Ck(err)
+	defer fh.Close()
+	p = &pack{file: strings.TrimSuffix(idx, ".idx") + ".pack"}
+	scanner := bufio.NewScanner(fh)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		ErrnoIf(len(fields) != 3, syscall.EINVAL, "malformed pack index line: %s: %q", idx, scanner.Text())
+		offset, err := strconv.ParseInt(fields[1], 10, 64)
+		Ck(err)
+		length, err := strconv.ParseInt(fields[2], 10, 64)
+		Ck(err)
+		p.entries = append(p.entries, packEntry{canon: fields[0], offset: offset, length: length})
+	}
+	err = scanner.Err()
+	Ck(err)
+	ok := sort.SliceIsSorted(p.entries, func(i, j int) bool {
+		return p.entries[i].canon < p.entries[j].canon
+	})
+	ErrnoIf(!ok, syscall.EINVAL, "pack index not sorted: %s", idx)
+	return
+}
+
+// walkPacked calls fn for every object in every complete pack.
+func (db *Db) walkPacked(fn func(p *pack, entry packEntry) error) (err error) {
+	defer Return(&err)
+	cache := &packCache{}
+	_, err = db.loadPacks(cache)
+	Ck(err)
+	var names []string
+	for name := range cache.packs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		p := cache.packs[name]
+		for _, entry := range p.entries {
+			err = fn(p, entry)
+			Ck(err)
+		}
+	}
+	return
+}
+
+// openRaw opens the stored form of the object at path, stored header
+// included, from its loose file or from a pack.  fh is the file to
+// close when done; raw covers just the object.
+func (db *Db) openRaw(path *Path) (fh *os.File, raw *io.SectionReader, err error) {
+	defer Return(&err)
+	fh, raw, err = openLoose(path.Abs)
+	if err == nil {
+		return
+	}
+	if !os.IsNotExist(err) {
+		Ck(err)
+	}
+	// it may have been packed since we last looked
+	p, entry, ok, err := db.packLookup(path.Canon)
+	Ck(err)
+	if ok {
+		return openPacked(p, entry)
+	}
+	// or moved by a relayout
+	abs, ok := db.movedAbs(path)
+	ErrnoIf(!ok, syscall.ENOENT, "not found: %s", path.Canon)
+	return openLoose(abs)
+}
+
+func openLoose(abs string) (fh *os.File, raw *io.SectionReader, err error) {
+	fh, err = os.Open(abs)
+	if err != nil {
+		return
+	}
+	info, err := fh.Stat()
+	if err != nil {
+		fh.Close()
+		return nil, nil, err
+	}
+	return fh, io.NewSectionReader(fh, 0, info.Size()), nil
+}
+
+func openPacked(p *pack, entry packEntry) (fh *os.File, raw *io.SectionReader, err error) {
+	fh, err = os.Open(p.file)
+	if err != nil {
+		return
+	}
+	return fh, io.NewSectionReader(fh, entry.offset, entry.length), nil
+}
+
+// Exists returns true if the object at path is stored in the db,
+// either as a loose file or in a pack.
+func (db *Db) Exists(path *Path) bool {
+	if exists(path.Abs) {
+		return true
+	}
+	_, _, ok, err := db.packLookup(path.Canon)
+	if err != nil {
+		log.Warnf("pack lookup: %v", err)
+	}
+	if !ok {
+		_, ok = db.movedAbs(path)
+	}
+	return ok
+}
+
+// RepackOpts controls the behavior of Db.Repack.
+type RepackOpts struct {
+	// MaxObject is the size of the largest object, in bytes, that
+	// Repack moves into a pack.  Larger objects stay loose.
+	MaxObject int64
+	// MaxPack starts a new pack when the current one reaches this
+	// many bytes.
+	MaxPack int64
+}
+
+// RepackReport is returned by Db.Repack.
+type RepackReport struct {
+	Packs   int   // number of packs written
+	Objects int   // number of objects moved into packs
+	Bytes   int64 // bytes moved into packs
+}
+
+// default repack limits
+const (
+	defMaxPackObject = 64 * 1024
+	defMaxPack       = 256 * 1024 * 1024
+)
+
+// Repack moves small loose objects into new packs and removes the
+// loose copies.  Trees that a stream label points at stay loose, so
+// the stream/ symlinks keep resolving for ordinary file tools.  GC
+// drops unreachable objects from packs by rewriting them, so running
+// GC before Repack saves packing garbage only to copy it out again.
+func (db *Db) Repack(opts RepackOpts) (report *RepackReport, err error) {
+	defer Return(&err)
+	report = &RepackReport{}
+	if opts.MaxObject <= 0 {
+		opts.MaxObject = defMaxPackObject
+	}
+	if opts.MaxPack <= 0 {
+		opts.MaxPack = defMaxPack
+	}
+
+	keep := make(map[string]bool)
+	err = db.walkLabels(func(label string, target *Path, lerr error) error {
+		if target != nil {
+			keep[target.Canon] = true
+		}
+		return nil
+	})
+	Ck(err)
+
+	var batch []*Path
+	var size int64
+	flush := func() (err error) {
+		defer Return(&err)
+		if len(batch) == 0 {
+			return
+		}
+		err = db.writePack(batch)
+		Ck(err)
+		report.Packs++
+		batch = nil
+		size = 0
+		return
+	}
+	err = db.walkObjects(func(path *Path, info os.FileInfo) (err error) {
+		defer Return(&err)
+		if keep[path.Canon] || info.Size() > opts.MaxObject {
+			return
+		}
+		_, _, packed, err := db.packLookup(path.Canon)
+		Ck(err)
+		if packed {
+			// a loose duplicate of a packed object
+			return db.Rm(path)
+		}
+		batch = append(batch, path)
+		size += info.Size()
+		report.Objects++
+		report.Bytes += info.Size()
+		if size >= opts.MaxPack {
+			err = flush()
+			Ck(err)
+		}
+		return
+	})
+	Ck(err)
+	err = flush()
+	Ck(err)
+	return
+}
+
+// writePack writes the loose objects in paths to a new pack, then
+// removes the loose files.
+func (db *Db) writePack(paths []*Path) (err error) {
+	defer Return(&err)
+	var srcs []packSource
+	for _, path := range paths {
+		abs := path.Abs
+		srcs = append(srcs, packSource{canon: path.Canon, open: func() (io.ReadCloser, error) {
+			return os.Open(abs)
+		}})
+	}
+	err = db.createPack(srcs)
+	Ck(err)
+	for _, path := range paths {
+		err = db.Rm(path)
+		Ck(err)
+	}
+	return
+}
+
+// packSource is an object on its way into a pack: its canpath, and a
+// way to read its stored form, header included.
+type packSource struct {
+	canon string
+	open  func() (io.ReadCloser, error)
+}
+
+// packedSource returns a packSource for an object already in pack p.
+func packedSource(p *pack, entry packEntry) packSource {
+	return packSource{canon: entry.canon, open: func() (io.ReadCloser, error) {
+		fh, raw, err := openPacked(p, entry)
+		if err != nil {
+			return nil, err
+		}
+		return struct {
+			io.Reader
+			io.Closer
+		}{raw, fh}, nil
+	}}
+}
+
+// createPack writes the objects in srcs to a new pack.
+func (db *Db) createPack(srcs []packSource) (err error) {
+	defer Return(&err)
+	sort.Slice(srcs, func(i, j int) bool { return srcs[i].canon < srcs[j].canon })
+
+	packfh, err := db.tmpFile()
+	Ck(err)
+	defer os.Remove(packfh.Name())
+	defer packfh.Close()
+	h := sha256.New()
+	w := io.MultiWriter(packfh, h)
+	var idx strings.Builder
+	var offset int64
+	for _, src := range srcs {
+		rc, err := src.open()
+		Ck(err)
+		n, err := io.Copy(w, rc)
+		rc.Close()
+		Ck(err)
+		fmt.Fprintf(&idx, "%s %d %d\n", src.canon, offset, n)
+		offset += n
+	}
+	err = db.syncFile(packfh)
+	Ck(err)
+	err = packfh.Close()
+	Ck(err)
+
+	idxfh, err := db.tmpFile()
+	Ck(err)
+	defer os.Remove(idxfh.Name())
+	defer idxfh.Close()
+	_, err = idxfh.WriteString(idx.String())
+	Ck(err)
+	err = db.syncFile(idxfh)
+	Ck(err)
+	err = idxfh.Close()
+	Ck(err)
+
+	// the pack goes into place before its index, so any index we can
+	// see refers to a complete pack
+	dir := db.packDir()
+	err = db.mkdirAll(dir)
+	Ck(err)
+	base := filepath.Join(dir, bin2hex(h.Sum(nil)))
+	err = os.Chmod(packfh.Name(), READ)
+	Ck(err)
+	err = os.Rename(packfh.Name(), base+".pack")
+	Ck(err)
+	err = os.Chmod(idxfh.Name(), READ)
+	Ck(err)
+	err = os.Rename(idxfh.Name(), base+".idx")
+	Ck(err)
+	err = db.syncDir(dir)
+	Ck(err)
+	return
+}
+
+// rmPack removes a pack, index first, so a crash in between leaves an
+// incomplete pack that is ignored.  The caller must make sure the
+// pack's objects are stored somewhere else first.
+func (db *Db) rmPack(p *pack) (err error) {
+	defer Return(&err)
+	base := strings.TrimSuffix(p.file, ".pack")
+	err = os.Remove(base + ".idx")
+	Ck(err)
+	err = os.Remove(p.file)
+	Ck(err)
+	err = db.syncDir(db.packDir())
+	Ck(err)
+	if db.packs != nil {
+		db.packs.mu.Lock()
+		delete(db.packs.packs, filepath.Base(base+".idx"))
+		db.packs.mu.Unlock()
+	}
+	return
+}
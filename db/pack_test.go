@@ -0,0 +1,110 @@
+package db
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func countLoose(t *testing.T, db *Db) (n int) {
+	err := db.walkObjects(func(path *Path, info os.FileInfo) error {
+		n++
+		return nil
+	})
+	tck(t, err)
+	return
+}
+
+func TestRepack(t *testing.T) {
+	db := setup(t, nil)
+
+	// a chain-shaped stream, one tree per block
+	var expect []byte
+	block, err := db.PutBlock("sha256", mkbuf("block0\n"))
+	tck(t, err)
+	expect = append(expect, "block0\n"...)
+	tree, err := db.PutTree("sha256", block)
+	tck(t, err)
+	stream, err := tree.LinkStream("journal")
+	tck(t, err)
+	for i := 1; i < 20; i++ {
+		s := fmt.Sprintf("block%d\n", i)
+		stream, err = stream.AppendBlock("sha256", mkbuf(s))
+		tck(t, err)
+		expect = append(expect, s...)
+	}
+	// a big block stays loose
+	big, err := db.PutBlock("sha256", bytes.Repeat([]byte("x"), 1000))
+	tck(t, err)
+
+	loose := countLoose(t, db)
+	tassert(t, loose == 41, "expected 41 loose objects, got %d", loose)
+
+	report, err := db.Repack(RepackOpts{MaxObject: 500})
+	tck(t, err)
+	tassert(t, report.Packs == 1, "expected 1 pack, got %d", report.Packs)
+	// everything but the label's tree and the big block
+	tassert(t, report.Objects == 39, "expected 39 packed objects, got %d", report.Objects)
+	loose = countLoose(t, db)
+	tassert(t, loose == 2, "expected 2 loose objects, got %d", loose)
+	tassert(t, exists(stream.RootNode.Path.Abs), "label target was packed")
+	tassert(t, exists(big.Path.Abs), "big block was packed")
+
+	// reads come from the pack transparently
+	stream, err = db.OpenStream("journal")
+	tck(t, err)
+	got, err := ioutil.ReadAll(stream)
+	tck(t, err)
+	tassert(t, bytes.Equal(expect, got), "expected %q got %q", expect, got)
+	tassert(t, db.Exists(block.Path), "packed block doesn't exist")
+	buf, err := db.GetBlock(block.Path)
+	tck(t, err)
+	tassert(t, string(buf) == "block0\n", "got %q", buf)
+	size, err := stream.RootNode.Size()
+	tck(t, err)
+	tassert(t, size == int64(len(expect)), "size %d", size)
+
+	// a fresh Db sees the pack too
+	db2, err := Open(db.Dir)
+	tck(t, err)
+	buf, err = db2.GetBlock(block.Path)
+	tck(t, err)
+	tassert(t, string(buf) == "block0\n", "got %q", buf)
+
+	ok, err := stream.RootNode.Verify()
+	tck(t, err)
+	tassert(t, ok, "verify failed")
+	fsck, err := db.Fsck(FsckOpts{})
+	tck(t, err)
+	tassert(t, fsck.Ok(), "fsck problems: %v", fsck.Problems)
+	tassert(t, fsck.Objects == 41, "fsck saw %d objects", fsck.Objects)
+
+	// re-putting a packed object leaves a loose duplicate that the
+	// next repack removes
+	_, err = db.PutBlock("sha256", mkbuf("block0\n"))
+	tck(t, err)
+	tassert(t, exists(block.Path.Abs), "duplicate not written")
+	report, err = db.Repack(RepackOpts{MaxObject: 500})
+	tck(t, err)
+	tassert(t, report.Packs == 0, "expected no new packs, got %d", report.Packs)
+	tassert(t, !exists(block.Path.Abs), "duplicate not removed")
+
+	// corruption inside a pack is reported against the pack
+	packs, err := filepath.Glob(filepath.Join(db.Dir, "pack", "*.pack"))
+	tck(t, err)
+	tassert(t, len(packs) == 1, "packs %v", packs)
+	data, err := ioutil.ReadFile(packs[0])
+	tck(t, err)
+	i := bytes.Index(data, []byte("block7"))
+	data[i+5] = '9'
+	err = os.Chmod(packs[0], 0644)
+	tck(t, err)
+	err = ioutil.WriteFile(packs[0], data, 0644)
+	tck(t, err)
+	fsck, err = db.Fsck(FsckOpts{})
+	tck(t, err)
+	tassert(t, len(fsck.Problems) == 1 && fsck.Problems[0].Kind == FsckCorrupt, "problems %v", fsck.Problems)
+}
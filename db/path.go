@@ -1,6 +1,7 @@
 package db
 
 import (
+	"errors"
 	"fmt"
 	"path/filepath"
 	"strings"
@@ -28,15 +29,21 @@ func (path Path) New(db *Db, raw string) (res *Path, err error) {
 	path.Db = db
 	path.Raw = raw
 
+	addr := addrPath(raw)
+	ErrnoIf(strings.Contains(addr, "//"), syscall.EINVAL, "malformed path: %s", raw)
+
 	// XXX need to also or instead call some sort of realpath function
 	// here to deal with symlinks that might exist in the db.Dir path
-	clean := filepath.Clean(raw)
+	clean := filepath.Clean(addr)
 
 	// remove db.Dir
 	index := strings.Index(clean, path.Db.Dir)
 	if index == 0 {
 		clean = strings.Replace(clean, path.Db.Dir+"/", "", 1)
 	}
+	// canpaths come from bundles and other dbs too, so a path that
+	// climbs out of the db dir is refused
+	ErrnoIf(clean == ".." || strings.HasPrefix(clean, "../"), syscall.EINVAL, "malformed path: %s", raw)
 
 	// split into parts
 	parts := strings.Split(clean, "/")
@@ -51,35 +58,126 @@ func (path Path) New(db *Db, raw string) (res *Path, err error) {
 		path.Canon = path.Rel
 	} else {
 		ErrnoIf(len(parts) < 3, syscall.EINVAL, "malformed path: %s", raw)
+		ErrnoIf(!knownClass(path.Class), syscall.EINVAL, "unknown class: %s", raw)
 		path.Algo = parts[1]
+		err = path.Db.checkAlgo(path.Algo)
+		if err != nil {
+			return
+		}
 		// the last part of the path should always be the full hash,
 		// regardless of whether we were given the full or canonical
 		// path
 		path.Hash = parts[len(parts)-1]
+		ErrnoIf(path.Hash == "" || !isHex(path.Hash), syscall.EINVAL, "malformed path: %s", raw)
+		// anything between the algo and the hash must be the hash's
+		// subdirs, at whatever depth
+		mid := parts[2 : len(parts)-1]
+		given, ok := subdirs(path.Hash, len(mid))
+		ErrnoIf(!ok || filepath.Join(mid...) != given, syscall.EINVAL, "malformed path: %s", raw)
 		// log.Debugf("anypath %#v class %#v algo %#v hash %#v", anypath, class, algo, hash)
 
+		if path.Class == unifiedDir {
+			// an object/ path doesn't say what the object is, so
+			// we ask its stored header
+			path.Class, err = path.Db.storedClass(path.Algo, path.Hash)
+			if err != nil {
+				return
+			}
+		}
+
 		// Rel is the relative path of any type of input path.  We
 		// use the nesting depth described in the Db comments.  We use the
 		// full hash value in the last component of the path in order to make
 		// troubleshooting using UNIX tools slightly easier (in contrast to
 		// the way git truncates the leading subdir parts of the hash).
-		var subpath string
-		for i := 0; i < path.Db.Depth; i++ {
-			end := (3 * i) + 3
-			ErrnoIf(len(path.Hash) < end, syscall.EINVAL, "malformed path: %s", raw)
-			subdir := path.Hash[(3 * i):end]
-			subpath = filepath.Join(subpath, subdir)
-		}
-		path.Rel = filepath.Join(path.Class, path.Algo, subpath, path.Hash)
+		subpath, ok := subdirs(path.Hash, path.Db.Depth)
+		ErrnoIf(!ok, syscall.EINVAL, "malformed path: %s", raw)
+		path.Rel = filepath.Join(path.Db.objectDir(path.Class), path.Algo, subpath, path.Hash)
 		path.Abs = filepath.Join(path.Db.Dir, path.Rel)
 		path.Canon = filepath.Join(path.Class, path.Algo, path.Hash)
-		// Addr is a universally-unique address for the data stored at path.
-		path.Addr = filepath.Join(path.Algo, path.Hash)
+		// Addr is a universally-unique address for the data stored
+		// at path.  It's tagged with the class, so it can name a
+		// block as well as a tree.
+		path.Addr = path.Canon
 	}
 
 	return &path, nil
 }
 
+// objectPath is Path.New for a canpath that must name a block or a
+// tree, such as a tree entry or a canpath from a bundle.
+func objectPath(db *Db, raw string) (path *Path, err error) {
+	defer Return(&err)
+	path, err = Path{}.New(db, raw)
+	Ck(err)
+	ErrnoIf(path.Class != "block" && path.Class != "tree", syscall.EINVAL, "not an object: %s", raw)
+	return
+}
+
+// knownClass says whether class is an object class or unifiedDir.
+func knownClass(class string) bool {
+	if class == unifiedDir {
+		return true
+	}
+	for _, c := range objectClasses {
+		if class == c {
+			return true
+		}
+	}
+	return false
+}
+
+// unifiedDir is the top-level dir that holds every object, whatever
+// its class, in a db of FormatUnified or later.  Older dbs keep each
+// class in its own dir.
+const unifiedDir = "object"
+
+// objectDir returns the top-level dir that holds objects of class.
+func (db *Db) objectDir(class string) string {
+	if db.unified() {
+		return unifiedDir
+	}
+	return class
+}
+
+// unified returns true if the db keeps its objects in unifiedDir.
+func (db *Db) unified() bool {
+	return db.FormatVersion >= FormatUnified
+}
+
+// storedClass returns the class named in the stored header of the
+// object with the given algo and hash.
+func (db *Db) storedClass(algo, hash string) (class string, err error) {
+	defer Return(&err)
+	for _, try := range objectClasses {
+		path, err := Path{}.New(db, filepath.Join(try, algo, hash))
+		Ck(err)
+		fh, raw, err := db.openRaw(path)
+		if errors.Is(err, syscall.ENOENT) {
+			// in a unified db this only happens for packed
+			// objects of the other class
+			continue
+		}
+		Ck(err)
+		defer fh.Close()
+		return peekClass(raw)
+	}
+	return "", fmt.Errorf("%w: not found: %s", syscall.ENOENT, filepath.Join(unifiedDir, algo, hash))
+}
+
+// subdirs returns the subdirectories hash is nested in at the given
+// depth, or false if hash is too short to nest that deep.
+func subdirs(hash string, depth int) (subpath string, ok bool) {
+	for i := 0; i < depth; i++ {
+		end := (3 * i) + 3
+		if len(hash) < end {
+			return "", false
+		}
+		subpath = filepath.Join(subpath, hash[(3*i):end])
+	}
+	return subpath, true
+}
+
 func (path *Path) header() string {
 	return fmt.Sprintf(path.Class + "\n")
 }
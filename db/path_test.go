@@ -2,6 +2,7 @@ package db
 
 import (
 	"path/filepath"
+	"strings"
 	"testing"
 )
 
@@ -9,9 +10,9 @@ func TestPath(t *testing.T) {
 	db := setup(t, nil)
 
 	hash := "d2c71afc5848aa2a33ff08621217f24dab485077d95d788c5170995285a5d65d"
-	addr := "sha256/d2c71afc5848aa2a33ff08621217f24dab485077d95d788c5170995285a5d65d"
+	addr := "block/sha256/d2c71afc5848aa2a33ff08621217f24dab485077d95d788c5170995285a5d65d"
 	canpath := "block/sha256/d2c71afc5848aa2a33ff08621217f24dab485077d95d788c5170995285a5d65d"
-	relpath := "block/sha256/d2c/71a/d2c71afc5848aa2a33ff08621217f24dab485077d95d788c5170995285a5d65d"
+	relpath := "object/sha256/d2c/71a/d2c71afc5848aa2a33ff08621217f24dab485077d95d788c5170995285a5d65d"
 
 	path, err := Path{}.New(db, canpath)
 	tassert(t, err == nil, "%#v", err)
@@ -32,4 +33,122 @@ func TestPath(t *testing.T) {
 	got = path.Addr
 	tassert(t, expect == got, "expected %s, got %s", expect, got)
 
+	// older dbs keep each class in its own dir
+	legacy := *db
+	legacy.FormatVersion = FormatVersioned
+	path, err = Path{}.New(&legacy, canpath)
+	tck(t, err)
+	expect = filepath.Join(db.Dir, "block/sha256/d2c/71a", hash)
+	got = path.Abs
+	tassert(t, expect == got, "expected %s, got %s", expect, got)
+}
+
+func TestObjectPath(t *testing.T) {
+	db := setup(t, nil)
+	block, err := db.PutBlock("sha256", mkbuf("blob1value"))
+	tck(t, err)
+	tree, err := db.PutTree("sha256", block)
+	tck(t, err)
+
+	// object/ paths get their class from the stored header
+	for _, want := range []*Path{block.Path, tree.Path} {
+		for _, raw := range []string{
+			filepath.Join("object", want.Algo, want.Hash),
+			want.Rel,
+			want.Abs,
+		} {
+			path, err := Path{}.New(db, raw)
+			tck(t, err)
+			tassert(t, path.Canon == want.Canon && path.Abs == want.Abs, "%s: got %s at %s", raw, path.Canon, path.Abs)
+		}
+	}
+	obj, err := db.ObjectFromPath(tree.Path)
+	tck(t, err)
+	_, ok := obj.(*Tree)
+	tassert(t, ok, "expected a tree, got %T", obj)
+
+	// packed objects too
+	_, err = db.Repack(RepackOpts{})
+	tck(t, err)
+	path, err := Path{}.New(db, filepath.Join("object", tree.Path.Algo, tree.Path.Hash))
+	tck(t, err)
+	tassert(t, path.Class == "tree", "class %s", path.Class)
+
+	_, err = Path{}.New(db, "object/sha256/0000000000000000000000000000000000000000000000000000000000000000")
+	tassert(t, err != nil, "expected error for a missing object")
+
+	// a tree canpath naming a block's hash is wrong, since the class
+	// is part of what's hashed
+	path, err = Path{}.New(db, "tree/sha256/"+block.Path.Hash)
+	tck(t, err)
+	_, err = db.ObjectFromPath(path)
+	tassert(t, err != nil, "expected error for a misclassed canpath")
+}
+
+func TestAddrForms(t *testing.T) {
+	db := setup(t, nil)
+	block, err := db.PutBlock("sha256", mkbuf("blob1value"))
+	tck(t, err)
+	tree, err := db.PutTree("sha256", block)
+	tck(t, err)
+
+	for _, want := range []*Path{block.Path, tree.Path} {
+		digest := want.Digest()
+		expect := "sha256:" + want.Hash
+		tassert(t, digest == expect, "expected %s, got %s", expect, digest)
+		uri := want.URI()
+		expect = "pb://" + want.Canon
+		tassert(t, uri == expect, "expected %s, got %s", expect, uri)
+		for _, raw := range []string{digest, uri} {
+			path, err := Path{}.New(db, raw)
+			tck(t, err)
+			tassert(t, path.Canon == want.Canon && path.Abs == want.Abs, "%s: got %s at %s", raw, path.Canon, path.Abs)
+			tassert(t, path.Digest() == digest && path.URI() == uri, "%s: got %s, %s", raw, path.Digest(), path.URI())
+		}
+
+		mh, err := want.Multihash()
+		tck(t, err)
+		tassert(t, len(mh) == 34 && mh[0] == 0x12 && mh[1] == 32, "multihash %x", mh)
+		got, err := DecodeMultihash(mh)
+		tck(t, err)
+		tassert(t, got == digest, "expected %s, got %s", digest, got)
+		path, err := Path{}.FromMultihash(db, mh)
+		tck(t, err)
+		tassert(t, path.Canon == want.Canon, "expected %s, got %s", want.Canon, path.Canon)
+	}
+
+	// keyed and longer algos round-trip too
+	for _, digest := range []string{
+		"sha512:" + strings.Repeat("ab", 64),
+		"hmac-sha256:" + strings.Repeat("cd", 32),
+	} {
+		mh, err := EncodeMultihash(digest)
+		tck(t, err)
+		got, err := DecodeMultihash(mh)
+		tck(t, err)
+		tassert(t, got == digest, "expected %s, got %s", digest, got)
+	}
+
+	for _, digest := range []string{"sha256", "sha256:", "sha256:xyz", "sha256:ABCD", "md5:abcd"} {
+		_, err := EncodeMultihash(digest)
+		tassert(t, err != nil, "expected error for %s", digest)
+	}
+	for _, mh := range [][]byte{nil, {0x12}, {0x12, 0x20, 0xab}, {0x01, 0x01, 0xab}} {
+		_, err := DecodeMultihash(mh)
+		tassert(t, err != nil, "expected error for %x", mh)
+	}
+
+	_, err = Path{}.New(db, "sha256:0000000000000000000000000000000000000000000000000000000000000000")
+	tassert(t, err != nil, "expected error for a missing object")
+	// only a known algo makes a digest
+	for raw, expect := range map[string]string{
+		"sha256:abcd":      "object/sha256/abcd",
+		"hmac-sha512:abcd": "object/hmac-sha512/abcd",
+		"notes:draft":      "notes:draft",
+		"hmac-md5:abcd":    "hmac-md5:abcd",
+		"md5:abcd":         "md5:abcd",
+	} {
+		got := addrPath(raw)
+		tassert(t, got == expect, "%s: expected %s, got %s", raw, expect, got)
+	}
 }
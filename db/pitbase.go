@@ -6,11 +6,13 @@ import (
 	"crypto/sha512"
 	"encoding/json"
 	"fmt"
+	"hash"
 	"io/ioutil"
 	"os"
 	"runtime"
 	"strconv"
 	"strings"
+	"syscall"
 
 	log "github.com/sirupsen/logrus"
 )
@@ -85,20 +87,25 @@ func GetGID() uint64 {
 // Hash returns the hash of a block using a given algorithm
 // XXX rework to support streaming
 func Hash(algo string, buf []byte) (binhash []byte, err error) {
+	h, err := newHash(algo)
+	if err != nil {
+		return
+	}
+	h.Write(buf)
+	return h.Sum(nil), nil
+}
+
+// newHash returns a streaming hash.Hash for algo.
+func newHash(algo string) (h hash.Hash, err error) {
 	switch algo {
 	case "sha256":
-		d := sha256.Sum256(buf)
-		binhash = make([]byte, len(d))
-		copy(binhash[:], d[0:len(d)])
+		h = sha256.New()
 	case "sha512":
-		d := sha512.Sum512(buf)
-		binhash = make([]byte, len(d))
-		copy(binhash[:], d[0:len(d)])
+		h = sha512.New()
 	default:
-		err = fmt.Errorf("not implemented: %s", algo)
-		return
+		err = fmt.Errorf("%w: %s", syscall.ENOSYS, algo)
 	}
-	return binhash, nil
+	return
 }
 
 /*
@@ -0,0 +1,177 @@
+package db
+
+import (
+	"fmt"
+	"io"
+	"syscall"
+
+	. "github.com/stevegt/goadapt"
+)
+
+// SyncOpts controls the behavior of Db.Push and Db.Pull.
+type SyncOpts struct {
+	// Force syncs between dbs whose chunking settings, tree versions,
+	// or stream algos differ.  The copy is still correct, but the two dbs won't
+	// dedup each other's future writes.  Dbs with different keyed
+	// hash secrets can never sync.
+	Force bool
+}
+
+// SyncReport is returned by Db.Push and Db.Pull.
+type SyncReport struct {
+	Trees   int   // trees copied
+	Blocks  int   // blocks copied
+	Bytes   int64 // body bytes copied
+	Skipped int   // trees the destination already had
+	Old     *Path // destination label's previous target, if any
+	New     *Path // destination label's new target
+}
+
+// Push copies the stream at label, and everything it refers to, to
+// dst, then moves dst's label to the same tree.  See syncStream.
+func (db *Db) Push(dst *Db, label string, opts SyncOpts) (report *SyncReport, err error) {
+	return syncStream(db, dst, label, opts, "push")
+}
+
+// Pull is Push in the other direction: it copies the stream at label
+// from src into db.
+func (db *Db) Pull(src *Db, label string, opts SyncOpts) (report *SyncReport, err error) {
+	return syncStream(src, db, label, opts, "pull")
+}
+
+// checkSync makes sure objects can move from src to dst.
+func checkSync(src, dst *Db, opts SyncOpts) (err error) {
+	if src.SecretID() != dst.SecretID() {
+		return fmt.Errorf("%w: dbs have different secrets", syscall.EINVAL)
+	}
+	if opts.Force {
+		return
+	}
+	if src.Poly != dst.Poly || src.MinSize != dst.MinSize || src.MaxSize != dst.MaxSize || src.chunker() != dst.chunker() {
+		return fmt.Errorf("%w: dbs have different chunking settings", syscall.EINVAL)
+	}
+	if src.treeVersion() != dst.treeVersion() {
+		return fmt.Errorf("%w: dbs have different tree versions", syscall.EINVAL)
+	}
+	return
+}
+
+// syncStream copies the stream at label from src to dst.  The copy
+// walks down from the root tree and skips any subtree whose tree
+// dst already has, since a db never stores a tree before everything
+// under it.  For the same reason, the copy publishes each tree only
+// after its entries.  Objects are copied by content and verified
+// against their addresses, so each db keeps its own compression and
+// encryption settings.
+//
+// dst's label is then moved with compare-and-swap semantics: if
+// another writer moved it while the copy ran, the copied objects
+// stay in dst but the label is left alone and a *ConflictError is
+// returned.  op is recorded in dst's label history.
+func syncStream(src, dst *Db, label string, opts SyncOpts, op string) (report *SyncReport, err error) {
+	defer Return(&err)
+	report = &SyncReport{}
+	err = checkSync(src, dst, opts)
+	Ck(err)
+	err = checkStoredLabel(label)
+	Ck(err)
+
+	root, err := src.labelTarget(label)
+	Ck(err)
+	ErrnoIf(root == nil, syscall.ENOENT, "no such stream: %s", label)
+	dstroot, err := Path{}.New(dst, root.Canon)
+	Ck(err)
+
+	old, err := dst.labelTarget(label)
+	Ck(err)
+	report.Old = old
+	if old != nil && old.Algo != root.Algo && !opts.Force {
+		return report, fmt.Errorf("%w: stream %s uses %s here and %s there", syscall.EINVAL, label, root.Algo, old.Algo)
+	}
+
+	tree, err := src.GetTree(root)
+	Ck(err)
+	copied := make(map[string]bool)
+	err = syncTree(dst, tree, copied, report)
+	Ck(err)
+
+	newtree, err := dst.GetTree(dstroot)
+	Ck(err)
+	var oldtree *Tree
+	if old != nil {
+		if old.Canon == dstroot.Canon {
+			report.New = dstroot
+			return
+		}
+		oldtree, err = dst.GetTree(old)
+		Ck(err)
+	}
+	err = dst.updateLabel(label, oldtree, newtree, op)
+	if err != nil {
+		return report, err
+	}
+	report.New = dstroot
+	return
+}
+
+// syncTree copies tree and whatever dst is missing under it.
+func syncTree(dst *Db, tree *Tree, copied map[string]bool, report *SyncReport) (err error) {
+	defer Return(&err)
+	path, err := objectPath(dst, tree.Path.Canon)
+	Ck(err)
+	if copied[path.Canon] {
+		return
+	}
+	if dst.Exists(path) {
+		report.Skipped++
+		return
+	}
+	entries, err := tree.readEntries()
+	Ck(err)
+	for _, entry := range entries {
+		switch obj := entry.(type) {
+		case *Tree:
+			err = syncTree(dst, obj, copied, report)
+			Ck(err)
+		default:
+			epath, err := objectPath(dst, obj.GetPath().Canon)
+			Ck(err)
+			if copied[epath.Canon] || dst.Exists(epath) {
+				continue
+			}
+			n, err := copyObject(obj.GetPath(), epath)
+			Ck(err)
+			copied[epath.Canon] = true
+			report.Blocks++
+			report.Bytes += n
+		}
+	}
+	n, err := copyObject(tree.Path, path)
+	Ck(err)
+	// the hash doesn't prove a v2 tree's entry sizes are right
+	err = dst.checkTreeSizes(path)
+	if err != nil {
+		dst.Rm(path)
+		return err
+	}
+	copied[path.Canon] = true
+	report.Trees++
+	report.Bytes += n
+	return
+}
+
+// copyObject copies the object at src to dst, which is the same
+// address in another db.
+func copyObject(src, dst *Path) (n int64, err error) {
+	defer Return(&err)
+	in, err := OpenWorm(src.Db, src)
+	Ck(err)
+	defer in.Close()
+	out, err := createExpected(dst.Db, dst)
+	Ck(err)
+	n, err = io.Copy(out, in)
+	Ck(err)
+	err = out.Close()
+	Ck(err)
+	return
+}
@@ -0,0 +1,121 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestPushPull(t *testing.T) {
+	src := setup(t, nil)
+	dst := setup(t, &Db{Poly: src.Poly})
+	other := setup(t, nil)
+
+	var content string
+	for i := 0; i < 50; i++ {
+		content += fmt.Sprintf("line %d of the journal\n", i)
+	}
+	tree, err := src.PutStream("sha256", strings.NewReader(content), PutStreamOpts{})
+	tck(t, err)
+	stream, err := tree.LinkStream("journal")
+	tck(t, err)
+
+	readStream := func(db *Db) string {
+		stream, err := db.OpenStream("journal")
+		tck(t, err)
+		buf, err := ioutil.ReadAll(stream)
+		tck(t, err)
+		return string(buf)
+	}
+
+	report, err := src.Push(dst, "journal", SyncOpts{})
+	tck(t, err)
+	tassert(t, report.Trees > 0 && report.Blocks > 0 && report.Skipped == 0, "report %+v", report)
+	tassert(t, report.Old == nil && report.New.Canon == tree.Path.Canon, "report %+v", report)
+	got := readStream(dst)
+	tassert(t, got == content, "got %q", got)
+	entries, err := dst.History("journal")
+	tck(t, err)
+	tassert(t, len(entries) == 1 && entries[0].Op == "push", "history %v", entries)
+
+	// only what's new moves the second time
+	stream, err = stream.AppendBlock("sha256", []byte("one more line\n"))
+	tck(t, err)
+	content += "one more line\n"
+	report, err = src.Push(dst, "journal", SyncOpts{})
+	tck(t, err)
+	tassert(t, report.Blocks == 1 && report.Skipped > 0, "report %+v", report)
+	tassert(t, report.Old.Canon == tree.Path.Canon, "report %+v", report)
+	got = readStream(dst)
+	tassert(t, got == content, "got %q", got)
+
+	// pushing again changes nothing
+	report, err = src.Push(dst, "journal", SyncOpts{})
+	tck(t, err)
+	tassert(t, report.Trees == 0 && report.Blocks == 0, "report %+v", report)
+
+	// different chunking needs Force
+	_, err = other.Pull(dst, "journal", SyncOpts{})
+	tassert(t, err != nil, "pulled between dbs with different Poly")
+	report, err = other.Pull(dst, "journal", SyncOpts{Force: true})
+	tck(t, err)
+	got = readStream(other)
+	tassert(t, got == content, "got %q", got)
+	entries, err = other.History("journal")
+	tck(t, err)
+	tassert(t, len(entries) == 1 && entries[0].Op == "pull", "history %v", entries)
+
+	// the copies are exact
+	fsck, err := other.Fsck(FsckOpts{})
+	tck(t, err)
+	tassert(t, fsck.Ok() && fsck.Objects == countLoose(t, dst), "fsck %+v", fsck)
+
+	// different secrets never sync
+	keyed := setup(t, &Db{Keyed: true})
+	_, err = src.Push(keyed, "journal", SyncOpts{Force: true})
+	tassert(t, err != nil, "pushed to a db with a different secret")
+
+	_, err = src.Push(dst, "nosuch", SyncOpts{})
+	tassert(t, err != nil, "pushed a missing stream")
+}
+
+func TestPushBadEntry(t *testing.T) {
+	src := setup(t, nil)
+	dst := setup(t, &Db{Poly: src.Poly})
+	dst.FormatVersion = FormatLegacy
+	block, err := src.PutBlock("sha256", mkbuf("hello"))
+	tck(t, err)
+
+	for i, entry := range []string{
+		"../sha256/" + block.Path.Hash,
+		"stream/evil",
+		"nosuch/sha256/" + block.Path.Hash,
+	} {
+		file, err := CreateWorm(src, "tree", "sha256")
+		tck(t, err)
+		_, err = file.Write([]byte(entry + "\n"))
+		tck(t, err)
+		err = file.Close()
+		tck(t, err)
+		// a crafted db, since LinkStream reads the tree first
+		label := fmt.Sprintf("bad%d", i)
+		err = os.Symlink(file.Path.Abs, filepath.Join(src.Dir, "stream", label))
+		tck(t, err)
+
+		_, err = src.Push(dst, label, SyncOpts{})
+		tassert(t, errors.Is(err, syscall.EINVAL), "%s: expected EINVAL, got %v", entry, err)
+		_, err = dst.OpenStream(label)
+		tassert(t, err != nil, "%s: label pushed", entry)
+	}
+	for _, dir := range []string{filepath.Dir(dst.Dir), dst.Dir} {
+		for _, name := range []string{"sha256", "nosuch"} {
+			tassert(t, !exists(filepath.Join(dir, name)), "wrote %s in %s", name, dir)
+		}
+	}
+	tassert(t, !exists(filepath.Join(dst.Dir, "stream", "evil")), "pushed a label as an object")
+}
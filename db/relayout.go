@@ -0,0 +1,252 @@
+package db
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"syscall"
+
+	"github.com/google/renameio"
+	. "github.com/stevegt/goadapt"
+)
+
+// RelayoutReport is returned by Db.Relayout.
+type RelayoutReport struct {
+	Objects int // loose objects moved
+	Labels  int // label symlinks rewritten
+}
+
+// Relayout changes the db's nesting Depth, moving every loose object
+// to where the new depth puts it.  Packed objects aren't affected.
+//
+// The new depth is saved first, with the old one in OldDepth, and each
+// object is hard-linked into its new place before its old name is
+// removed, so readers find every object throughout the move,
+// including readers that opened the db before Relayout started; see
+// movedAbs.  If Relayout is interrupted, running it again with the
+// same depth finishes the job.  OldDepth is cleared at the end.
+// Relayout while the db is otherwise idle.
+func (db *Db) Relayout(depth int) (report *RelayoutReport, err error) {
+	defer Return(&err)
+	ErrnoIf(depth < 1, syscall.EINVAL, "depth must be at least 1: %d", depth)
+	ErrnoIf(db.OldDepth != 0 && depth != db.Depth, syscall.EBUSY, "finish the relayout to depth %d first", db.Depth)
+	report = &RelayoutReport{}
+
+	if depth != db.Depth {
+		db.OldDepth = db.Depth
+		db.Depth = depth
+		err = db.saveConfig()
+		Ck(err)
+	}
+
+	report.Objects, err = db.moveAll(db)
+	Ck(err)
+
+	report.Labels, err = db.relinkLabels()
+	Ck(err)
+
+	if db.OldDepth != 0 {
+		db.OldDepth = 0
+		err = db.saveConfig()
+		Ck(err)
+	}
+	return
+}
+
+// moveAll moves every loose object to where the layout of to puts
+// it, and returns the number moved.
+func (db *Db) moveAll(to *Db) (moved int, err error) {
+	defer Return(&err)
+	// walkObjects tells us where each object actually is
+	var paths []*Path
+	err = db.walkObjects(func(path *Path, info os.FileInfo) error {
+		paths = append(paths, path)
+		return nil
+	})
+	Ck(err)
+	for _, path := range paths {
+		ok, err := db.moveLoose(path, to)
+		Ck(err)
+		if ok {
+			moved++
+		}
+	}
+	return
+}
+
+// moveLoose moves the loose file at path.Abs to where the layout of
+// to puts it, if it isn't there already.  to is db itself, or a copy
+// of it with new layout settings.
+func (db *Db) moveLoose(path *Path, to *Db) (moved bool, err error) {
+	defer Return(&err)
+	dst, err := Path{}.New(to, path.Canon)
+	Ck(err)
+	if dst.Abs == path.Abs {
+		return
+	}
+	dir := filepath.Dir(dst.Abs)
+	err = db.mkdirAll(dir)
+	Ck(err)
+	err = os.Link(path.Abs, dst.Abs)
+	// it's already there if an earlier run was interrupted
+	if !os.IsExist(err) {
+		Ck(err)
+	}
+	err = db.syncDir(dir)
+	Ck(err)
+	err = os.Remove(path.Abs)
+	Ck(err)
+	err = db.syncDir(filepath.Dir(path.Abs))
+	Ck(err)
+	db.rmEmptyDirs(filepath.Dir(path.Abs), db.Dir)
+	return true, nil
+}
+
+// relinkLabels points each label's symlink at its tree's current
+// place.  Labels resolve either way, since labelTarget only looks at
+// the tree's hash, but a stale symlink dangles for everything else.
+// The labels' history isn't touched, since their targets don't
+// change.
+func (db *Db) relinkLabels() (n int, err error) {
+	defer Return(&err)
+	unlock, err := db.lock()
+	Ck(err)
+	defer unlock()
+	err = db.walkLabels(func(label string, target *Path, lerr error) (err error) {
+		defer Return(&err)
+		if lerr != nil {
+			// fsck's business
+			return
+		}
+		linkabspath := filepath.Join(db.Dir, "stream", label)
+		linkdir := filepath.Dir(linkabspath)
+		src, err := filepath.Rel(linkdir, target.Abs)
+		Ck(err)
+		old, err := os.Readlink(linkabspath)
+		Ck(err)
+		if old == src {
+			return
+		}
+		err = renameio.Symlink(src, linkabspath)
+		Ck(err)
+		err = db.syncDir(linkdir)
+		Ck(err)
+		n++
+		return
+	})
+	Ck(err)
+	return
+}
+
+// layoutCache holds the depths config.json names, so that a db can see
+// a relayout another process has started since the db was opened
+// without reading config.json on every miss.  It's shared by all
+// copies of a Db made from the same Open.
+type layoutCache struct {
+	mu     sync.Mutex
+	info   os.FileInfo // config.json as of the last read
+	depths []int       // its Depth and OldDepth
+}
+
+// configDepths returns Depth and OldDepth from the config.json in
+// dir.  saveConfig replaces config.json by renaming a new file over
+// it, so configDepths only reads it again if it's a different file
+// from last time; otherwise it's one stat.
+func (c *layoutCache) configDepths(dir string) []int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	fn := filepath.Join(dir, "config.json")
+	info, err := os.Stat(fn)
+	if err != nil || (c.info != nil && os.SameFile(info, c.info) && info.ModTime().Equal(c.info.ModTime())) {
+		return c.depths
+	}
+	buf, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return c.depths
+	}
+	var cfg struct{ Depth, OldDepth int }
+	if json.Unmarshal(buf, &cfg) != nil {
+		return c.depths
+	}
+	c.info = info
+	c.depths = []int{cfg.Depth, cfg.OldDepth}
+	return c.depths
+}
+
+// otherDepths returns the nesting depths other than db.Depth that a
+// loose object might be at: the one an unfinished relayout is moving
+// objects out of, and, if another process has started a relayout
+// since db was opened, the ones now in config.json.
+func (db *Db) otherDepths() (depths []int) {
+	candidates := []int{db.OldDepth}
+	if db.layout != nil {
+		candidates = append(candidates, db.layout.configDepths(db.Dir)...)
+	}
+	sort.Ints(candidates)
+	for i, depth := range candidates {
+		if depth < 1 || depth == db.Depth || (i > 0 && depth == candidates[i-1]) {
+			continue
+		}
+		depths = append(depths, depth)
+	}
+	return
+}
+
+// movedAbs returns the absolute path of path's loose file if it isn't
+// at path.Abs because a relayout or a migrate has moved it, or is
+// moving it.  Both link each object into its new place before
+// removing the old one, so looking twice catches an object that moved
+// while we looked.  Every miss in Exists comes through here, so if no
+// relayout is under way, the db has nothing to move into unifiedDir,
+// and path was made for the db's current layout, movedAbs doesn't
+// look any further.
+func (db *Db) movedAbs(path *Path) (abs string, ok bool) {
+	if path.Hash == "" {
+		return
+	}
+	others := db.otherDepths()
+	if len(others) == 0 && db.unified() && db.currentLayout(path) {
+		return
+	}
+	depths := append([]int{db.Depth}, others...)
+	// a migrate moves objects from their class dir into unifiedDir
+	var candidates []string
+	for _, top := range []string{unifiedDir, path.Class} {
+		for _, depth := range depths {
+			subpath, ok := subdirs(path.Hash, depth)
+			abs := filepath.Join(db.Dir, top, path.Algo, subpath, path.Hash)
+			if ok && abs != path.Abs {
+				candidates = append(candidates, abs)
+			}
+		}
+	}
+	candidates = append(candidates, path.Abs)
+	for pass := 0; pass < 2; pass++ {
+		for _, abs = range candidates {
+			if exists(abs) {
+				return abs, true
+			}
+		}
+	}
+	return "", false
+}
+
+// currentLayout returns true if path.Rel is where db's layout puts
+// path now.
+func (db *Db) currentLayout(path *Path) bool {
+	subpath, ok := subdirs(path.Hash, db.Depth)
+	return ok && path.Rel == filepath.Join(db.objectDir(path.Class), path.Algo, subpath, path.Hash)
+}
+
+// oldLayout returns true if rel is where an unfinished relayout's
+// OldDepth puts path.
+func (db *Db) oldLayout(path *Path, rel string) bool {
+	if db.OldDepth == 0 {
+		return false
+	}
+	subpath, ok := subdirs(path.Hash, db.OldDepth)
+	return ok && rel == filepath.Join(db.objectDir(path.Class), path.Algo, subpath, path.Hash)
+}
@@ -0,0 +1,87 @@
+package db
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRelayout(t *testing.T) {
+	db := setup(t, &Db{Depth: 1, Fanout: 4})
+	var content string
+	for i := 0; i < 2000; i++ {
+		content += fmt.Sprintf("line %d of the journal\n", i)
+	}
+	tree, err := db.PutStream("sha256", strings.NewReader(content), PutStreamOpts{})
+	tck(t, err)
+	_, err = tree.LinkStream("journal")
+	tck(t, err)
+	leaves, err := tree.Leaves()
+	tck(t, err)
+	leaf := leaves[0].GetPath()
+
+	readStream := func(db *Db) string {
+		stream, err := db.OpenStream("journal")
+		tck(t, err)
+		buf, err := ioutil.ReadAll(stream)
+		tck(t, err)
+		return string(buf)
+	}
+
+	// a reader that opened the db before the relayout
+	stale, err := Open(db.Dir)
+	tck(t, err)
+
+	report, err := db.Relayout(3)
+	tck(t, err)
+	tassert(t, report.Objects > 0 && report.Labels == 1, "report %+v", report)
+	db2, err := Open(db.Dir)
+	tck(t, err)
+	tassert(t, db2.Depth == 3 && db2.OldDepth == 0, "db %+v", db2)
+	path, err := Path{}.New(db2, leaf.Canon)
+	tck(t, err)
+	tassert(t, len(strings.Split(path.Rel, "/")) == 6, "leaf at %s", path.Rel)
+	tassert(t, exists(path.Abs) && !exists(leaf.Abs), "leaf not moved")
+	tassert(t, readStream(db2) == content, "content differs after relayout")
+	tassert(t, readStream(stale) == content, "stale reader can't read")
+	tassert(t, stale.Exists(leaf), "stale reader can't find leaf")
+	// the label's symlink follows its tree
+	_, err = os.Stat(filepath.Join(db.Dir, "stream", "journal"))
+	tck(t, err)
+	fsck, err := db2.Fsck(FsckOpts{})
+	tck(t, err)
+	tassert(t, fsck.Ok(), "fsck problems: %v", fsck.Problems)
+
+	// running it again finds nothing to do
+	report, err = db2.Relayout(3)
+	tck(t, err)
+	tassert(t, *report == RelayoutReport{}, "report %+v", report)
+
+	// an interrupted relayout: the config is saved but only one
+	// object has moved
+	db2.OldDepth = 3
+	db2.Depth = 2
+	err = db2.saveConfig()
+	tck(t, err)
+	moved, err := db2.moveLoose(path, db2)
+	tck(t, err)
+	tassert(t, moved, "leaf not moved")
+	db3, err := Open(db.Dir)
+	tck(t, err)
+	tassert(t, readStream(db3) == content, "content differs mid-relayout")
+	fsck, err = db3.Fsck(FsckOpts{})
+	tck(t, err)
+	tassert(t, fsck.Ok(), "fsck problems mid-relayout: %v", fsck.Problems)
+	_, err = db3.Relayout(1)
+	tassert(t, err != nil, "expected error for a new relayout mid-relayout")
+	report, err = db3.Relayout(2)
+	tck(t, err)
+	tassert(t, report.Objects > 0 && db3.OldDepth == 0, "report %+v, db %+v", report, db3)
+	tassert(t, readStream(db3) == content, "content differs after finishing")
+
+	_, err = db3.Relayout(0)
+	tassert(t, err != nil, "expected error for depth 0")
+}
@@ -0,0 +1,177 @@
+package db
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+
+	. "github.com/stevegt/goadapt"
+)
+
+// minPrefix is the shortest hash prefix Resolve accepts.
+const minPrefix = 4
+
+// AmbiguousError is returned by Resolve when a hash prefix matches
+// more than one object.
+type AmbiguousError struct {
+	Prefix     string
+	Candidates []string // canpaths, sorted
+}
+
+func (e *AmbiguousError) Error() string {
+	return fmt.Sprintf("ambiguous prefix %s matches:\n  %s", e.Prefix, strings.Join(e.Candidates, "\n  "))
+}
+
+// Unwrap makes an ambiguous prefix an invalid argument, as far as
+// errors.Is is concerned.
+func (e *AmbiguousError) Unwrap() error {
+	return syscall.EINVAL
+}
+
+// Resolve returns the path of the object spec names.  spec is
+// anything Path.New takes, or, git-style, an abbreviated address: a
+// unique prefix of the object's hash, at least minPrefix hex digits
+// long, optionally preceded by algo/ or class/algo/, or in digest or
+// URI form, e.g. tree/sha256/3d4f1a, sha256/3d4f1a, sha256:3d4f1a,
+// or just 3d4f1a.  Resolve scans
+// only the subdirs and pack entries the prefix could be in.  If more
+// than one object matches, it returns an *AmbiguousError listing
+// them.  A full canpath is returned as is, without checking that the
+// object exists, so callers see the same errors they would from
+// Path.New.
+func (db *Db) Resolve(spec string) (path *Path, err error) {
+	defer Return(&err)
+	clean := filepath.Clean(addrPath(spec))
+	if strings.HasPrefix(clean, db.Dir+"/") {
+		clean = strings.TrimPrefix(clean, db.Dir+"/")
+	}
+	parts := strings.Split(clean, "/")
+	prefix := parts[len(parts)-1]
+	var class, algo string
+	switch len(parts) {
+	case 1:
+	case 2:
+		algo = parts[0]
+	default:
+		class, algo = parts[0], parts[1]
+	}
+	if class == "stream" {
+		return Path{}.New(db, spec)
+	}
+	if algo != "" {
+		h, err := db.newHash(algo)
+		Ck(err)
+		if class != "" && len(prefix) == 2*h.Size() {
+			return Path{}.New(db, spec)
+		}
+	}
+	ErrnoIf(len(prefix) < minPrefix || !isHex(prefix), syscall.EINVAL, "malformed path: %s", spec)
+
+	matches := make(map[string]*Path)
+	add := func(path *Path) {
+		if class == "" || class == unifiedDir || class == path.Class {
+			matches[path.Canon] = path
+		}
+	}
+	for _, top := range objectDirs {
+		algos := []string{algo}
+		if algo == "" {
+			entries, err := ioutil.ReadDir(filepath.Join(db.Dir, top))
+			if os.IsNotExist(err) {
+				continue
+			}
+			Ck(err)
+			algos = nil
+			for _, entry := range entries {
+				algos = append(algos, entry.Name())
+			}
+		}
+		for _, name := range algos {
+			err = scanPrefix(filepath.Join(db.Dir, top, name), 0, prefix, func(abs string) (err error) {
+				path, err := Path{}.New(db, abs)
+				if err != nil {
+					// fsck's business
+					return nil
+				}
+				add(path)
+				return
+			})
+			Ck(err)
+		}
+	}
+	err = db.walkPacked(func(p *pack, entry packEntry) (err error) {
+		fields := strings.Split(entry.canon, "/")
+		if len(fields) != 3 || !strings.HasPrefix(fields[2], prefix) || (algo != "" && fields[1] != algo) {
+			return
+		}
+		path, err := Path{}.New(db, entry.canon)
+		if err != nil {
+			return nil
+		}
+		add(path)
+		return
+	})
+	Ck(err)
+
+	var candidates []string
+	for canon := range matches {
+		candidates = append(candidates, canon)
+	}
+	ErrnoIf(len(candidates) == 0, syscall.ENOENT, "not found: %s", spec)
+	if len(candidates) == 1 {
+		return matches[candidates[0]], nil
+	}
+	sort.Strings(candidates)
+	return nil, &AmbiguousError{Prefix: spec, Candidates: candidates}
+}
+
+// scanPrefix calls fn for each object file under dir whose name
+// starts with prefix.  dir is level subdirs deep; subdirs that can't
+// hold a match aren't read.
+func scanPrefix(dir string, level int, prefix string, fn func(abs string) error) (err error) {
+	defer Return(&err)
+	entries, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	Ck(err)
+	// the part of prefix a subdir at this level is named for
+	var seg string
+	if start := 3 * level; start < len(prefix) {
+		seg = prefix[start:]
+		if len(seg) > 3 {
+			seg = seg[:3]
+		}
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		abs := filepath.Join(dir, name)
+		switch {
+		case entry.IsDir():
+			if strings.HasPrefix(name, seg) {
+				err = scanPrefix(abs, level+1, prefix, fn)
+				Ck(err)
+			}
+		case entry.Mode().IsRegular():
+			if strings.HasPrefix(name, prefix) {
+				err = fn(abs)
+				Ck(err)
+			}
+		}
+	}
+	return
+}
+
+// isHex returns true if s is all lowercase hex digits.
+func isHex(s string) bool {
+	for _, c := range s {
+		if !strings.ContainsRune("0123456789abcdef", c) {
+			return false
+		}
+	}
+	return true
+}
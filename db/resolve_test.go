@@ -0,0 +1,72 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"syscall"
+	"testing"
+)
+
+func TestResolve(t *testing.T) {
+	db := setup(t, nil)
+
+	// make two blocks whose hashes share a minPrefix-digit prefix
+	seen := make(map[string]*Block)
+	var one, two *Block
+	for i := 0; two == nil; i++ {
+		block, err := db.PutBlock("sha256", mkbuf(fmt.Sprintf("block %d", i)))
+		tck(t, err)
+		prefix := block.Path.Hash[:minPrefix]
+		if seen[prefix] != nil {
+			one, two = seen[prefix], block
+		}
+		seen[prefix] = block
+	}
+	tree, err := db.PutTree("sha256", one, two)
+	tck(t, err)
+
+	check := func(spec string, want *Path) {
+		t.Helper()
+		path, err := db.Resolve(spec)
+		tck(t, err)
+		tassert(t, path.Canon == want.Canon, "%s: got %s, want %s", spec, path.Canon, want.Canon)
+	}
+	// the shortest prefix that tells the two apart
+	n := minPrefix
+	for one.Path.Hash[:n] == two.Path.Hash[:n] {
+		n++
+	}
+	short := one.Path.Hash[:n]
+	check(short, one.Path)
+	check("sha256/"+short, one.Path)
+	check("block/sha256/"+short, one.Path)
+	check("object/sha256/"+short, one.Path)
+	check(one.Path.Canon, one.Path)
+	check(one.Path.Abs, one.Path)
+	check(tree.Path.Hash[:8], tree.Path)
+	check("tree/sha256/"+tree.Path.Hash[:8], tree.Path)
+
+	_, err = db.Resolve("tree/sha256/" + short)
+	tassert(t, errors.Is(err, syscall.ENOENT), "expected ENOENT, got %v", err)
+	_, err = db.Resolve(one.Path.Hash[:3])
+	tassert(t, errors.Is(err, syscall.EINVAL), "expected EINVAL, got %v", err)
+	_, err = db.Resolve("nothex")
+	tassert(t, errors.Is(err, syscall.EINVAL), "expected EINVAL, got %v", err)
+
+	ambiguous := func() {
+		t.Helper()
+		_, err = db.Resolve(one.Path.Hash[:minPrefix])
+		e, ok := err.(*AmbiguousError)
+		tassert(t, ok, "expected AmbiguousError, got %v", err)
+		tassert(t, len(e.Candidates) == 2, "candidates %v", e.Candidates)
+		tassert(t, errors.Is(err, syscall.EINVAL), "not EINVAL: %v", err)
+	}
+	ambiguous()
+
+	// packed objects resolve too, and aren't counted twice
+	_, err = db.Repack(RepackOpts{})
+	tck(t, err)
+	check(short, one.Path)
+	check(tree.Path.Hash[:8], tree.Path)
+	ambiguous()
+}
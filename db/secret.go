@@ -0,0 +1,128 @@
+package db
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	. "github.com/stevegt/goadapt"
+)
+
+// A keyed db addresses objects by HMAC(secret, header||data) instead
+// of a plain hash, so someone who has the plain hash of some private
+// data can't use the db to fetch it.  The secret is random per db and
+// lives in the db's secret file, readable only by the owner.  Keyed
+// algos are named after the plain algo they're built on, e.g.
+// hmac-sha256, and a keyed db accepts nothing else, so objects from
+// dbs with different secrets aren't cross-addressable.
+
+// keyedPrefix marks a keyed algo name.
+const keyedPrefix = "hmac-"
+
+func (db *Db) secretFile() string {
+	return filepath.Join(db.Dir, "secret")
+}
+
+// saveSecret writes db's secret to the db's secret file, generating a
+// random secret first if db doesn't have one yet.
+func (db *Db) saveSecret() (err error) {
+	defer Return(&err)
+	secret := db.secret
+	if secret == nil {
+		secret = make([]byte, sha256.Size)
+		_, err = rand.Read(secret)
+		Ck(err)
+	}
+	fh, err := os.OpenFile(db.secretFile(), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0400)
+	Ck(err)
+	defer fh.Close()
+	_, err = fh.WriteString(hex.EncodeToString(secret) + "\n")
+	Ck(err)
+	err = db.syncFile(fh)
+	Ck(err)
+	err = fh.Close()
+	Ck(err)
+	db.secret = secret
+	return
+}
+
+// loadSecret loads the secret of a keyed db.
+func (db *Db) loadSecret() (err error) {
+	defer Return(&err)
+	db.secret = nil
+	if !db.Keyed {
+		return
+	}
+	buf, err := ioutil.ReadFile(db.secretFile())
+	Ck(err)
+	db.secret, err = hex.DecodeString(strings.TrimSpace(string(buf)))
+	ErrnoIf(err != nil || len(db.secret) == 0, syscall.EINVAL, "malformed secret file: %s", db.secretFile())
+	return
+}
+
+// SecretID returns a fingerprint of a keyed db's secret, or an empty
+// string if the db isn't keyed.  Two dbs can share objects only if
+// their SecretIDs match.
+func (db *Db) SecretID() string {
+	if db.secret == nil {
+		return ""
+	}
+	mac := hmac.New(sha256.New, db.secret)
+	mac.Write([]byte("pitbase secret id\n"))
+	return hex.EncodeToString(mac.Sum(nil)[:8])
+}
+
+// checkAlgo makes sure algo is usable in db: keyed algos only in
+// keyed dbs and plain algos only in plain ones.
+func (db *Db) checkAlgo(algo string) (err error) {
+	keyed := strings.HasPrefix(algo, keyedPrefix)
+	switch {
+	case db.Keyed && !keyed:
+		return fmt.Errorf("%w: keyed db can't use plain algo: %s", syscall.EINVAL, algo)
+	case !db.Keyed && keyed:
+		return fmt.Errorf("%w: keyed algo needs a keyed db: %s", syscall.EINVAL, algo)
+	}
+	return
+}
+
+// newHash returns a streaming hash.Hash for algo, keyed with the db's
+// secret if algo is a keyed algo.
+func (db *Db) newHash(algo string) (h hash.Hash, err error) {
+	err = db.checkAlgo(algo)
+	if err != nil {
+		return
+	}
+	if !db.Keyed {
+		return newHash(algo)
+	}
+	plain := strings.TrimPrefix(algo, keyedPrefix)
+	// make sure the plain algo exists before hmac.New panics on it
+	_, err = newHash(plain)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", syscall.ENOSYS, algo)
+	}
+	Assert(db.secret != nil, "keyed db without secret")
+	return hmac.New(func() hash.Hash {
+		h, _ := newHash(plain)
+		return h
+	}, db.secret), nil
+}
+
+// Hash returns the hash of buf using algo, keyed with the db's secret
+// if algo is a keyed algo.
+func (db *Db) Hash(algo string, buf []byte) (binhash []byte, err error) {
+	h, err := db.newHash(algo)
+	if err != nil {
+		return
+	}
+	h.Write(buf)
+	return h.Sum(nil), nil
+}
@@ -0,0 +1,54 @@
+package db
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestKeyed(t *testing.T) {
+	plain := setup(t, nil)
+	db1 := setup(t, &Db{Keyed: true})
+	db2 := setup(t, &Db{Keyed: true})
+	data := mkbuf("private data\n")
+
+	block1, err := db1.PutBlock("hmac-sha256", data)
+	tck(t, err)
+	block2, err := db2.PutBlock("hmac-sha256", data)
+	tck(t, err)
+	block, err := plain.PutBlock("sha256", data)
+	tck(t, err)
+	tassert(t, strings.HasPrefix(block1.Path.Canon, "block/hmac-sha256/"), "canon %s", block1.Path.Canon)
+	tassert(t, block1.Path.Hash != block2.Path.Hash, "different secrets, same address")
+	tassert(t, block1.Path.Hash != block.Path.Hash, "keyed address matches plain address")
+	binhash, err := db1.Hash("hmac-sha256", append([]byte("block\n"), data...))
+	tck(t, err)
+	tassert(t, bin2hex(binhash) == block1.Path.Hash, "Hash %x, PutBlock %s", binhash, block1.Path.Hash)
+
+	// plain addresses don't work in a keyed db, and vice versa
+	_, err = db1.PutBlock("sha256", data)
+	tassert(t, err != nil, "keyed db accepted plain algo")
+	_, err = Path{}.New(db1, block.Path.Canon)
+	tassert(t, err != nil, "keyed db parsed plain path")
+	_, err = Path{}.New(plain, block1.Path.Canon)
+	tassert(t, err != nil, "plain db parsed keyed path")
+	_, err = plain.PutBlock("hmac-sha256", data)
+	tassert(t, err != nil, "plain db accepted keyed algo")
+	// one db's address means nothing in another
+	path, err := Path{}.New(db2, block1.Path.Canon)
+	tck(t, err)
+	tassert(t, !db2.Exists(path), "keyed address found in other db")
+
+	// the secret survives a reopen
+	db3, err := Open(db1.Dir)
+	tck(t, err)
+	tassert(t, db3.SecretID() == db1.SecretID(), "secret changed")
+	tassert(t, db3.SecretID() != db2.SecretID(), "secrets match")
+	tree, err := db3.PutStream("hmac-sha256", strings.NewReader("a stream of data\n"), PutStreamOpts{})
+	tck(t, err)
+	ok, err := tree.Verify()
+	tck(t, err)
+	tassert(t, ok, "verify failed")
+	report, err := db3.Fsck(FsckOpts{})
+	tck(t, err)
+	tassert(t, report.Ok(), "fsck problems: %v", report.Problems)
+}
@@ -1,9 +1,12 @@
 package db
 
 import (
+	"fmt"
+	"io"
 	"path/filepath"
+	"syscall"
 
-	"github.com/google/renameio"
+	log "github.com/sirupsen/logrus"
 	. "github.com/stevegt/goadapt"
 )
 
@@ -19,7 +22,14 @@ type Stream struct {
 	RootNode *Tree
 	Label    string
 	Path     *Path
-	// chunker     *Rabin
+	// write side, see CreateStream
+	pw   *io.PipeWriter
+	done chan streamResult
+}
+
+type streamResult struct {
+	rootnode *Tree
+	err      error
 }
 
 func (stream Stream) New(db *Db, label string, rootnode *Tree) (out *Stream, err error) {
@@ -27,35 +37,123 @@ func (stream Stream) New(db *Db, label string, rootnode *Tree) (out *Stream, err
 	stream.Db = db
 	stream.Label = label
 	stream.RootNode = rootnode
-	linkrelpath := filepath.Join("stream", label)
-	path, err := Path{}.New(db, linkrelpath)
-	Ck(err)
-	stream.Path = path
+	if label != "" {
+		err = checkStoredLabel(label)
+		Ck(err)
+		linkrelpath := filepath.Join("stream", label)
+		path, err := Path{}.New(db, linkrelpath)
+		Ck(err)
+		stream.Path = path
+	}
 	return &stream, nil
 }
 
-// AppendBlock puts a block in the database, appends it to the Merkle
-// tree as a new leaf node, and then rewrites the stream label's symlink
-// to point at the new tree root.
-func (stream *Stream) AppendBlock(algo string, buf []byte) (newstream *Stream, err error) {
+// CreateStream returns a new, writeable Stream.  Data written to the
+// stream is chunked using the db's chunker parameters, and blocks and
+// trees are stored as they fill.  Close finishes the tree, sets
+// RootNode, and, if label is not empty, links label to the new root
+// node.  The label is not touched until Close, so readers never see a
+// partially-written stream.
+//
+// The caller must always call Close or CloseWithError, even after a
+// failed Write; until then a goroutine is left waiting for more data.
+// CloseWithError abandons the stream without linking label.
+func (db *Db) CreateStream(algo string, label string) (stream *Stream, err error) {
 	defer Return(&err)
-	oldrootnode := stream.RootNode
-	newrootnode, err := oldrootnode.AppendBlock(algo, buf)
-	if err != nil {
-		return
+	if label != "" {
+		err = ValidateLabel(label)
+		Ck(err)
 	}
+	stream, err = Stream{}.New(db, label, nil)
+	Ck(err)
+	// the chunker wants an io.Reader, so we feed it from a pipe
+	pr, pw := io.Pipe()
+	stream.pw = pw
+	stream.done = make(chan streamResult, 1)
+	go func() {
+		rootnode, err := db.PutStream(algo, pr, PutStreamOpts{})
+		// unblock any pending Write() if PutStream bailed out early
+		pr.CloseWithError(err)
+		stream.done <- streamResult{rootnode, err}
+	}()
+	return
+}
+
+// Write writes buf to a stream created by CreateStream.  Supports the
+// io.Writer interface.
+func (stream *Stream) Write(buf []byte) (n int, err error) {
+	if stream.pw == nil {
+		return 0, fmt.Errorf("%w: stream is not writeable: %s", syscall.EBADF, stream.Label)
+	}
+	return stream.pw.Write(buf)
+}
 
-	// rewrite symlink
-	treerel := filepath.Join("..", newrootnode.Path.Rel)
-	linkabs := filepath.Join(stream.Db.Dir, stream.Path.Canon)
-	err = renameio.Symlink(treerel, linkabs)
-	if err != nil {
+// Close finishes a stream created by CreateStream; see CreateStream
+// for details.  Close is a no-op on streams opened for reading.
+func (stream *Stream) Close() (err error) {
+	defer Return(&err)
+	if stream.pw == nil {
 		return
 	}
-	newstream, err = Stream{}.New(stream.Db, stream.Label, newrootnode)
+	err = stream.pw.Close()
 	Ck(err)
+	res := <-stream.done
+	stream.pw = nil
+	Ck(res.err)
+	stream.RootNode = res.rootnode
+	if stream.Label != "" {
+		err = stream.Db.linkLabel(stream.Label, stream.RootNode, "putstream")
+		Ck(err)
+	}
 	return
+}
 
+// CloseWithError abandons a stream created by CreateStream: it stops
+// the chunker, waits for it to finish, and leaves label alone.  The
+// blocks stored so far are left for GC.  cause is returned to any
+// pending Write; if cause is nil, io.ErrClosedPipe is used.
+// CloseWithError is a no-op on streams opened for reading.
+func (stream *Stream) CloseWithError(cause error) (err error) {
+	if stream.pw == nil {
+		return
+	}
+	if cause == nil {
+		cause = io.ErrClosedPipe
+	}
+	stream.pw.CloseWithError(cause)
+	<-stream.done
+	stream.pw = nil
+	return
+}
+
+// maxAppendRetries limits how many times AppendBlock reloads the
+// label after losing a race with another writer.
+const maxAppendRetries = 100
+
+// AppendBlock puts a block in the database, appends it to the Merkle
+// tree as a new leaf node, and then moves the stream label to the new
+// tree root using UpdateLabel.  If another writer moved the label
+// first, AppendBlock reloads the label and appends to the new root
+// instead, so concurrent appends are never lost.
+func (stream *Stream) AppendBlock(algo string, buf []byte) (newstream *Stream, err error) {
+	defer Return(&err)
+	ErrnoIf(stream.Path == nil, syscall.EBADF, "stream has no label: %s", stream.Label)
+	db := stream.Db
+	oldrootnode := stream.RootNode
+	for i := 0; ; i++ {
+		newrootnode, err := oldrootnode.AppendBlock(algo, buf)
+		Ck(err)
+		err = db.updateLabel(stream.Label, oldrootnode, newrootnode, "append")
+		conflict, ok := err.(*ConflictError)
+		if !ok || i >= maxAppendRetries {
+			Ck(err)
+			return Stream{}.New(db, stream.Label, newrootnode)
+		}
+		log.Debugf("AppendBlock retrying: %v", conflict)
+		Assert(conflict.Actual != nil, "stream label removed: %s", stream.Label)
+		oldrootnode, err = db.GetTree(conflict.Actual)
+		Ck(err)
+	}
 }
 
 /*
@@ -76,12 +174,19 @@ func (stream *Stream) Rewind() error {
 }
 
 // Ls lists all of the leaf nodes in a stream and optionally both
-// leaf and inner
+// leaf and inner.  The result is held in memory; use Walk for large
+// streams.
 func (stream *Stream) Ls(all bool) (objects []Object, err error) {
-	// XXX this should be a generator, to prevent memory consumption
-	// with large trees
-	// XXX should be passthrough to tree.Ls()
-	return stream.RootNode.traverse(all)
+	err = stream.Walk(WalkOpts{All: all}, func(obj Object, depth int) error {
+		objects = append(objects, obj)
+		return nil
+	})
+	return
+}
+
+// Walk is a passthrough to the root node's Walk.
+func (stream *Stream) Walk(opts WalkOpts, fn WalkFunc) error {
+	return stream.RootNode.Walk(opts, fn)
 }
 
 /*
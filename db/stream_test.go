@@ -2,10 +2,13 @@ package db
 
 import (
 	"bytes"
+	"errors"
 	"io"
 	"io/ioutil"
 	"math/rand"
+	"runtime"
 	"testing"
+	"time"
 
 	"github.com/hlubek/readercomp"
 )
@@ -201,3 +204,85 @@ func TestStream(t *testing.T) {
 
 }
 */
+
+func TestCreateStream(t *testing.T) {
+	db := setup(t, &Db{MinSize: 64, MaxSize: 1024})
+	size := int64(100 * kiB)
+
+	stream, err := db.CreateStream("sha256", "stream1")
+	tck(t, err)
+	n, err := io.Copy(stream, RandStream(size))
+	tck(t, err)
+	tassert(t, n == size, "n: expected %v got %v", size, n)
+
+	// label isn't published until Close
+	_, err = db.OpenStream("stream1")
+	tassert(t, err != nil, "label linked before Close")
+
+	err = stream.Close()
+	tck(t, err)
+	tassert(t, stream.RootNode != nil, "RootNode is nil after Close")
+
+	gotstream, err := db.OpenStream("stream1")
+	tck(t, err)
+	tassert(t, gotstream.RootNode.Path.Canon == stream.RootNode.Path.Canon, "expected %v got %v", stream.RootNode.Path.Canon, gotstream.RootNode.Path.Canon)
+	ok, err := readercomp.Equal(RandStream(size), gotstream, 4096)
+	tassert(t, err == nil, "readercomp.Equal: %v", err)
+	tassert(t, ok, "stream mismatch")
+
+	// the same data via PutStream should produce the same root
+	tree, err := db.PutStream("sha256", RandStream(size), PutStreamOpts{})
+	tck(t, err)
+	tassert(t, tree.Path.Canon == stream.RootNode.Path.Canon, "expected %v got %v", tree.Path.Canon, stream.RootNode.Path.Canon)
+
+	// unlabeled
+	stream, err = db.CreateStream("sha256", "")
+	tck(t, err)
+	_, err = stream.Write(mkbuf("somedata"))
+	tck(t, err)
+	err = stream.Close()
+	tck(t, err)
+	tassert(t, stream.RootNode != nil, "RootNode is nil after Close")
+
+	// bad algo shows up as a write or close error
+	stream, err = db.CreateStream("sha257", "")
+	tck(t, err)
+	_, err = io.Copy(stream, RandStream(size))
+	if err == nil {
+		err = stream.Close()
+	}
+	tassert(t, err != nil, "expected error from bad algo")
+
+	// read-only streams aren't writeable
+	_, err = gotstream.Write(mkbuf("somedata"))
+	tassert(t, err != nil, "expected error writing to read-only stream")
+}
+
+func TestCreateStreamAbort(t *testing.T) {
+	db := setup(t, &Db{MinSize: 64, MaxSize: 1024})
+	before := runtime.NumGoroutine()
+
+	stream, err := db.CreateStream("sha256", "stream1")
+	tck(t, err)
+	_, err = io.Copy(stream, RandStream(100*kiB))
+	tck(t, err)
+	cause := errors.New("aborted")
+	err = stream.CloseWithError(cause)
+	tck(t, err)
+	_, err = stream.Write(mkbuf("more"))
+	tassert(t, err != nil, "wrote to an abandoned stream")
+
+	_, err = db.OpenStream("stream1")
+	tassert(t, err != nil, "abandoned stream was linked")
+	if exists(db.tmpDir()) {
+		infos, err := ioutil.ReadDir(db.tmpDir())
+		tck(t, err)
+		tassert(t, len(infos) == 0, "left %d temp files", len(infos))
+	}
+
+	// the chunker and its workers are gone
+	for i := 0; runtime.NumGoroutine() > before; i++ {
+		tassert(t, i < 100, "leaked %d goroutines", runtime.NumGoroutine()-before)
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,137 @@
+package db
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	. "github.com/stevegt/goadapt"
+)
+
+// Objects are published in three steps: the temp file is fsynced, it
+// is renamed into place, and then the parent dir is fsynced so the
+// rename itself survives a crash.  Labels are only linked after the
+// objects they refer to have been published this way, so a label can
+// never outlive its tree.
+//
+// Setting Db.NoSync skips all of the fsyncs, which makes bulk imports
+// much faster.  Callers that do this must call Db.Sync before relying
+// on anything they wrote; until then a crash can leave labels pointing
+// at missing or empty objects.
+
+// tmpGrace is how old a temp file must be before Open removes it.  It
+// keeps one process from deleting another's in-progress writes.
+const tmpGrace = time.Hour
+
+func (db *Db) tmpDir() string {
+	return filepath.Join(db.Dir, "tmp")
+}
+
+// tmpFile creates a new temporary file in the tmp dir, creating the
+// dir if needed.
+func (db *Db) tmpFile() (fh *os.File, err error) {
+	dir := db.tmpDir()
+	err = mkdir(dir)
+	if err != nil {
+		return
+	}
+	return ioutil.TempFile(dir, "*")
+}
+
+// cleanTmp removes temp files left behind by writers that crashed or
+// were killed.  Files newer than tmpGrace are left alone.
+func (db *Db) cleanTmp() (err error) {
+	defer Return(&err)
+	dir := db.tmpDir()
+	if !exists(dir) {
+		return
+	}
+	infos, err := ioutil.ReadDir(dir)
+	Ck(err)
+	cutoff := time.Now().Add(-tmpGrace)
+	for _, info := range infos {
+		if !info.Mode().IsRegular() || info.ModTime().After(cutoff) {
+			continue
+		}
+		log.Debugf("removing stale temp file %s", info.Name())
+		err = os.Remove(filepath.Join(dir, info.Name()))
+		if os.IsNotExist(err) {
+			// another process beat us to it
+			continue
+		}
+		Ck(err)
+	}
+	return
+}
+
+// syncFile fsyncs fh unless db.NoSync is set.
+func (db *Db) syncFile(fh *os.File) (err error) {
+	if db.NoSync {
+		return
+	}
+	return fh.Sync()
+}
+
+// syncDir fsyncs dir unless db.NoSync is set.  This is what makes a
+// rename, create, or unlink in dir durable.
+func (db *Db) syncDir(dir string) (err error) {
+	if db.NoSync {
+		return
+	}
+	return fsyncPath(dir)
+}
+
+// mkdirAll is like os.MkdirAll, but also fsyncs the parent of each
+// dir it creates.
+func (db *Db) mkdirAll(dir string) (err error) {
+	defer Return(&err)
+	if exists(dir) {
+		return
+	}
+	parent := filepath.Dir(dir)
+	err = db.mkdirAll(parent)
+	Ck(err)
+	err = os.Mkdir(dir, 0755)
+	if os.IsExist(err) {
+		// created by a concurrent writer
+		return nil
+	}
+	Ck(err)
+	return db.syncDir(parent)
+}
+
+// Sync fsyncs every object, label, and dir in the db.  It is meant to
+// be called after a bulk import done with NoSync set.
+func (db *Db) Sync() (err error) {
+	defer Return(&err)
+	for _, top := range append(objectDirs, "stream") {
+		dir := filepath.Join(db.Dir, top)
+		if !exists(dir) {
+			continue
+		}
+		err = filepath.Walk(dir, func(abs string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			// symlinks are made durable by syncing their dir
+			if !info.IsDir() && !info.Mode().IsRegular() {
+				return nil
+			}
+			return fsyncPath(abs)
+		})
+		Ck(err)
+	}
+	return fsyncPath(db.Dir)
+}
+
+func fsyncPath(path string) (err error) {
+	defer Return(&err)
+	fh, err := os.Open(path)
+	Ck(err)
+	defer fh.Close()
+	err = fh.Sync()
+	Ck(err)
+	return
+}
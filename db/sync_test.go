@@ -0,0 +1,57 @@
+package db
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCleanTmp(t *testing.T) {
+	db := setup(t, nil)
+
+	// a stale temp file from a crashed writer, and a fresh one that
+	// might belong to a writer that is still running
+	stale := filepath.Join(db.tmpDir(), "stale")
+	fresh := filepath.Join(db.tmpDir(), "fresh")
+	for _, fn := range []string{stale, fresh} {
+		err := ioutil.WriteFile(fn, []byte("partial"), 0644)
+		tck(t, err)
+	}
+	old := time.Now().Add(-2 * tmpGrace)
+	err := os.Chtimes(stale, old, old)
+	tck(t, err)
+
+	report, err := db.Fsck(FsckOpts{})
+	tck(t, err)
+	tassert(t, len(report.Problems) == 1 && report.Problems[0].Rel == "tmp/stale", "problems %v", report.Problems)
+
+	_, err = Open(db.Dir)
+	tck(t, err)
+	tassert(t, !exists(stale), "stale temp file not removed")
+	tassert(t, exists(fresh), "fresh temp file removed")
+}
+
+func TestNoSync(t *testing.T) {
+	db := setup(t, &Db{NoSync: true})
+
+	block, err := db.PutBlock("sha256", mkbuf("blob1value"))
+	tck(t, err)
+	tree, err := db.PutTree("sha256", block)
+	tck(t, err)
+	_, err = tree.LinkStream("stream1")
+	tck(t, err)
+	err = db.Sync()
+	tck(t, err)
+
+	// temp files are renamed out of tmp/
+	infos, err := ioutil.ReadDir(db.tmpDir())
+	tck(t, err)
+	tassert(t, len(infos) == 0, "tmp not empty: %v", infos)
+
+	// NoSync isn't persisted
+	db2, err := Open(db.Dir)
+	tck(t, err)
+	tassert(t, !db2.NoSync, "NoSync was saved in config")
+}
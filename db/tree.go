@@ -1,13 +1,11 @@
 package db
 
 import (
-	"bufio"
 	"fmt"
 	"io"
-	"path/filepath"
 	"strings"
+	"syscall"
 
-	"github.com/google/renameio"
 	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
 	. "github.com/stevegt/goadapt"
@@ -17,9 +15,11 @@ import (
 type Tree struct {
 	Db *Db
 	*worm
-	_entries    []Object
-	_leaves     []Object
-	currentLeaf int64
+	_entries []Object
+	// read cursor state
+	leaves *TreeIter // iterator over remaining leaves
+	leaf   Object    // leaf currently being read, if any
+	pos    int64     // current offset in the tree's content
 }
 
 func (tree Tree) New(db *Db, file *worm) *Tree {
@@ -28,13 +28,6 @@ func (tree Tree) New(db *Db, file *worm) *Tree {
 	return &tree
 }
 
-/*
-func (tree *Tree) CurrentLeaf() Object {
-	// XXX use a generator to provide leafs to Read(); reset generator
-	// position on Seek()
-}
-*/
-
 func (tree *Tree) Entries() (entries []Object, err error) {
 	defer Return(&err)
 	if len(tree._entries) == 0 {
@@ -55,6 +48,9 @@ func (tree *Tree) AppendBlock(algo string, buf []byte) (newrootnode *Tree, err e
 
 	// put block
 	block, err := tree.Db.PutBlock(algo, buf)
+	if err != nil {
+		return
+	}
 
 	// put tree for new root of merkle tree
 	newrootnode, err = tree.Db.PutTree(algo, oldrootnode, block)
@@ -74,7 +70,7 @@ func (tree *Tree) XXXCat() (buf []byte, err error) {
 	// db := tree.Db
 
 	// get leaf nodes
-	objects, err := tree.traverse(false)
+	objects, err := tree.Leaves()
 	Ck(err)
 
 	// append leaf node content to buf
@@ -101,13 +97,16 @@ func (tree *Tree) GetPath() *Path {
 	return tree.Path
 }
 
+// Leaves returns all of the leaf nodes under tree.  The result is
+// held in memory; use Walk or Iter for large trees.
 func (tree *Tree) Leaves() (leaves []Object, err error) {
 	defer Return(&err)
-	if len(tree._leaves) == 0 {
-		tree._leaves, err = tree.traverse(false)
-		Ck(err)
-	}
-	return tree._leaves, nil
+	err = tree.Walk(WalkOpts{}, func(obj Object, depth int) error {
+		leaves = append(leaves, obj)
+		return nil
+	})
+	Ck(err)
+	return
 }
 
 // LinkStream makes a symlink named label pointing at tree, and returns
@@ -115,13 +114,11 @@ func (tree *Tree) Leaves() (leaves []Object, err error) {
 // XXX do we need this?  creating the stream with rootnode == nil is risky
 func (tree *Tree) LinkStream(label string) (stream *Stream, err error) {
 	defer Return(&err)
+	err = ValidateLabel(label)
+	Ck(err)
 	stream, err = Stream{}.New(tree.Db, label, tree)
 	Ck(err)
-	src := filepath.Join("..", tree.Path.Rel)
-	// XXX sanitize label
-	linkabspath := filepath.Join(tree.Db.Dir, "stream", label)
-	log.Debugf("linkabspath %#v", linkabspath)
-	err = renameio.Symlink(src, linkabspath)
+	err = tree.Db.linkLabel(label, tree, "linkstream")
 	Ck(err)
 	return
 }
@@ -134,46 +131,26 @@ func (tree *Tree) loadEntries() (err error) {
 	if tree.worm.Path.Abs == "" {
 		return
 	}
-	file := tree.worm
-	scanner := bufio.NewScanner(file)
-	var content []byte
-	var entries []Object
-	for scanner.Scan() {
-		buf := scanner.Bytes()
-		line := string(buf)
-		line = strings.TrimSpace(line)
-		path, err := Path{}.New(tree.Db, line)
-		Ck(err)
-		entry, err := tree.Db.ObjectFromPath(path)
+	tree._entries, err = tree.readEntries()
+	Ck(err)
+	return
+}
+
+// readEntries reads and parses the tree file's entries without
+// caching them in tree.  It opens its own file handle, so it doesn't
+// disturb tree's read cursor.
+func (tree *Tree) readEntries() (entries []Object, err error) {
+	defer Return(&err)
+	_, lines, err := tree.readTree()
+	Ck(err)
+	for _, line := range lines {
+		entry, err := tree.Db.ObjectFromPath(line.path)
 		Ck(err)
 		log.Debugf("entry %#v", entry)
 		entries = append(entries, entry)
-
-		content = append(content, buf...)
-		content = append(content, '\n')
 	}
-	err = scanner.Err()
-	Ck(err, "%v: %q", err, file.Path.Abs)
-
-	tree._entries = entries
-
-	/*
-		// XXX merge this with Verify
-		if verify {
-			// hash content
-			binhash, err := Hash(path.Algo, content)
-			if err != nil {
-				return node, err
-			}
-			// compare hash with path.Hash
-			hex := bin2hex(binhash)
-			if path.Hash != hex {
-				log.Debugf("getTree verify failure path %v content '%s'", path.Abs, content)
-				err = fmt.Errorf("expected %v, calculated %v", path.Hash, hex)
-				return node, err
-			}
-		}
-	*/
+
+	// XXX verify content hash here -- see Verify
 
 	return
 }
@@ -182,52 +159,45 @@ func (tree *Tree) loadEntries() (err error) {
 func (tree *Tree) Read(buf []byte) (bufpos int, err error) {
 	defer Return(&err)
 
-	leaves, err := tree.Leaves()
-	Ck(err)
+	if tree.leaves == nil {
+		tree.leaves = tree.Iter(WalkOpts{})
+	}
 
-	for {
-		if tree.currentLeaf >= int64(len(leaves)) {
-			log.Debugf("tree.Read() reached EOF")
-			err = io.EOF
-			break
+	for bufpos < len(buf) {
+		if tree.leaf == nil {
+			leaf, _, err := tree.leaves.Next()
+			if err == io.EOF {
+				log.Debugf("tree.Read() reached EOF")
+				return bufpos, io.EOF
+			}
+			Ck(err)
+			_, err = leaf.Seek(0, io.SeekStart)
+			Ck(err)
+			tree.leaf = leaf
 		}
-		leaf := leaves[tree.currentLeaf]
-		n, err := leaf.Read(buf[bufpos:])
+		n, err := tree.leaf.Read(buf[bufpos:])
 		bufpos += n
+		tree.pos += int64(n)
 		if errors.Cause(err) == io.EOF {
-			// go's finalizer might close files for us when obj goes
-			// out of scope, and since this was a read-only file
-			// anyway, don't check err after obj.Close()
-			leaf.Close()
-			Assert(n == 0)
-			log.Debugf("tree.Read() done with leaf %v/%v", tree.currentLeaf+1, len(leaves))
-			tree.currentLeaf++
-			// XXX That fact that we're comparing tree.currentLeaf
-			// with int64(len(leaves)) both here and above makes me
-			// think that we likely could refactor this whole
-			// function into a more explicit state engine.  There may
-			// be more edge cases buried here in the meantime.
-			if tree.currentLeaf < int64(len(leaves)) {
-				_, err = leaves[tree.currentLeaf].Seek(0, io.SeekStart)
-				Ck(err)
-			}
+			// io.Reader allows n > 0 along with EOF; we've already
+			// counted those bytes.  go's finalizer might close files
+			// for us when obj goes out of scope, and since this was
+			// a read-only file anyway, don't check err after
+			// obj.Close()
+			tree.leaf.Close()
+			log.Debugf("tree.Read() done with leaf %v", tree.leaf.GetPath().Canon)
+			tree.leaf = nil
 			continue
 		}
 		Ck(err)
-		if bufpos == len(buf) {
-			log.Debugf("buffer full")
-			break
-		}
 	}
 	log.Debugf("returning %v/%v bytes read, err: %v", bufpos, len(buf), err)
-	// log.Debugf("bytes in buf: %v", string(buf))
 	return
 }
 
 func (tree *Tree) Rewind() error {
-	tree.currentLeaf = 0
-	tree._entries = []Object{}
-	return nil
+	_, err := tree.Seek(0, io.SeekStart)
+	return err
 }
 
 // Seek sets the offset for the next Read on tree to offset,
@@ -246,74 +216,183 @@ func (tree *Tree) Seek(offset int64, whence int) (pos int64, err error) {
 	case io.SeekStart:
 		pos = offset
 	case io.SeekCurrent:
-		n, err := tree.Tell()
-		Ck(err)
-		pos = n + offset
+		pos = tree.pos + offset
 	case io.SeekEnd:
 		n, err := tree.Size()
 		Ck(err)
 		pos = n + offset
 	}
+	ErrnoIf(pos < 0, syscall.EINVAL, "negative seek position: %d", pos)
 
-	var total int64
-	leaves, err := tree.Leaves()
+	if tree.leaf != nil {
+		tree.leaf.Close()
+		tree.leaf = nil
+	}
+
+	leaves, leaf, off, err := tree.seekLeaf(pos)
 	Ck(err)
-	for i, leaf := range leaves {
-		size, err := leaf.Size()
+	if leaf != nil {
+		_, err = leaf.Seek(off, io.SeekStart)
 		Ck(err)
-		// add up all leaf sizes until we pass pos
-		total += size
-		if total > pos {
-			// seek in last leaf
-			total -= size
-			leafPos := pos - total
-			// fmt.Printf("total: %v, pos: %v, leafPos: %v\n", total, pos, leafPos)
-			_, err := leaf.Seek(leafPos, io.SeekStart)
+		tree.leaf = leaf
+	}
+	tree.leaves = leaves
+	tree.pos = pos
+
+	return
+}
+
+// seekLeaf returns an iterator over tree's leaves, positioned just
+// past the leaf holding content offset pos, along with that leaf and
+// pos's offset within it.  leaf is nil if pos is at or past the end.
+// seekLeaf descends by entry size, so in a v2 tree it only opens the
+// tree files on the way down to the leaf.
+func (tree *Tree) seekLeaf(pos int64) (iter *TreeIter, leaf Object, off int64, err error) {
+	defer Return(&err)
+	iter = &TreeIter{}
+	node := tree
+	for {
+		_, entries, err := node.readTree()
+		Ck(err)
+		objs := make([]Object, len(entries))
+		for i, entry := range entries {
+			objs[i], err = tree.Db.ObjectFromPath(entry.path)
 			Ck(err)
-			tree.currentLeaf = int64(i)
+		}
+		frame := &iterFrame{tree: node, entries: objs, next: len(objs), entered: true, loaded: true}
+		iter.stack = append(iter.stack, frame)
+
+		var child *Tree
+		for i, obj := range objs {
+			size := entries[i].size
+			if size < 0 {
+				size, err = obj.Size()
+				Ck(err)
+			}
+			if pos >= size {
+				pos -= size
+				continue
+			}
+			frame.next = i + 1
+			child, _ = obj.(*Tree)
+			if child == nil {
+				return iter, obj, pos, nil
+			}
 			break
 		}
+		if child == nil {
+			// past the end
+			return iter, nil, 0, nil
+		}
+		node = child
 	}
-
-	return
 }
 
+// Size returns the length of tree's content.  It adds up the entry
+// sizes recorded in v2 tree files, and only descends into v1 trees.
 func (tree *Tree) Size() (total int64, err error) {
 	defer Return(&err)
-	leaves, err := tree.Leaves()
+	_, entries, err := tree.readTree()
 	Ck(err)
-	for _, leaf := range leaves {
-		size, err := leaf.Size()
-		Ck(err)
+	for _, entry := range entries {
+		size := entry.size
+		if size < 0 {
+			obj, err := tree.Db.ObjectFromPath(entry.path)
+			Ck(err)
+			size, err = obj.Size()
+			obj.Close()
+			Ck(err)
+		}
 		total += size
 	}
 	return
 }
 
-// Tell returns the current seek position in the tree.
-func (tree *Tree) Tell() (total int64, err error) {
+// ReadAt reads len(buf) bytes of tree's content starting at offset
+// off.  It supports the io.ReaderAt interface.  Unlike Read and Seek,
+// ReadAt doesn't use or change tree's read cursor, and it opens its
+// own handles on the trees and leaves it reads, so any number of
+// goroutines may call it at once on the same tree.  Like seekLeaf,
+// each call descends by entry size to the leaves holding the range,
+// so in a v2 tree it only opens the tree files on the way down.
+func (tree *Tree) ReadAt(buf []byte, off int64) (n int, err error) {
 	defer Return(&err)
-	var n int64
-	leaves, err := tree.Leaves()
+	ErrnoIf(off < 0, syscall.EINVAL, "negative offset: %d", off)
+	n, err = tree.readAt(buf, off)
 	Ck(err)
+	if n < len(buf) {
+		return n, io.EOF
+	}
+	return
+}
 
-	// XXX add up all leaf sizes until we get to the current leaf
-	for i, leaf := range leaves {
-		n, err = leaf.Size()
-		Ck(err)
-		if int64(i) == tree.currentLeaf {
-			// add position in current leaf
-			n, err = leaf.Tell()
+// readAt fills as much of buf as tree's content holds, starting at
+// off, descending only into the entries that overlap the range.
+func (tree *Tree) readAt(buf []byte, off int64) (n int, err error) {
+	defer Return(&err)
+	_, entries, err := tree.readTree()
+	Ck(err)
+	for _, entry := range entries {
+		if n == len(buf) {
+			break
+		}
+		var obj Object
+		size := entry.size
+		if size < 0 {
+			// v1 trees don't record sizes
+			obj, err = tree.Db.ObjectFromPath(entry.path)
+			Ck(err)
+			size, err = obj.Size()
+			obj.Close()
+			Ck(err)
+		}
+		if off >= size {
+			off -= size
+			continue
+		}
+		want := buf[n:]
+		if int64(len(want)) > size-off {
+			want = want[:size-off]
+		}
+		var m int
+		if entry.path.Class == "tree" {
+			obj, err = tree.Db.ObjectFromPath(entry.path)
+			Ck(err)
+			m, err = obj.(*Tree).readAt(want, off)
+			Ck(err)
+			if m < len(want) {
+				return n + m, fmt.Errorf("%w: tree %s shorter than expected", syscall.EIO, entry.path.Canon)
+			}
+		} else {
+			m, err = readLeafAt(tree.Db, entry.path, want, off)
 			Ck(err)
-			return total + n, err
 		}
-		total += n
+		n += m
+		off = 0
 	}
-	if tree.currentLeaf == int64(len(leaves)) {
-		return tree.Size()
+	return
+}
+
+// readLeafAt fills buf from the content of the leaf at path, starting
+// at pos.  The leaf must hold at least pos+len(buf) bytes.
+func readLeafAt(db *Db, path *Path, buf []byte, pos int64) (n int, err error) {
+	defer Return(&err)
+	file, err := OpenWorm(db, path)
+	Ck(err)
+	defer file.Close()
+	_, err = file.Seek(pos, io.SeekStart)
+	Ck(err)
+	n, err = io.ReadFull(file, buf)
+	if err == io.ErrUnexpectedEOF || err == io.EOF {
+		return n, fmt.Errorf("%w: leaf %s shorter than expected", syscall.EIO, path.Canon)
 	}
-	err = errors.New("Tree.Tell() reached the end of Tree.Leaves() before encountering tree.currentLeaf")
-	return total, err
+	Ck(err)
+	return
+}
+
+// Tell returns the current seek position in the tree.
+func (tree *Tree) Tell() (n int64, err error) {
+	return tree.pos, nil
 }
 
 // Txt returns the concatenated tree entries
@@ -327,72 +406,97 @@ func (tree *Tree) Txt() (out string, err error) {
 	return
 }
 
-// Verify hashes the node content and compares it to its address
-// XXX move to File
-// XXX refactor to take advantage of streaming
-// XXX right now we only verify trees by default -- what about blocks?
+// Verify re-hashes every tree and block under tree and compares each
+// with its address.  It returns false and a *HashMismatchError at the
+// first mismatch.  Use Db.Fsck to check the whole database.
 func (tree *Tree) Verify() (ok bool, err error) {
 	defer Return(&err)
-	objects, err := tree.traverse(true)
-	Ck(err)
-	for _, obj := range objects {
-		switch child := obj.(type) {
-		case *Block:
-			// XXX add a verify flag to GetBlock and do this there
-			path := child.Path
-			content, err := child.Db.GetBlock(path)
-			Ck(err)
-			// hash content
-			content = append([]byte(path.header()), content...)
-			binhash, err := Hash(path.Algo, content)
-			Ck(err)
-			// compare hash with path.Hash
-			hex := bin2hex(binhash)
-			Assert(path.Hash == hex)
-		case *Tree:
-			path := child.Path
-			log.Debugf("child %#v", child)
-			_, err := tree.Db.getTree(path, true)
-			Ck(err)
-		default:
-			panic(fmt.Sprintf("unhandled type %T", child))
+	var mismatch *HashMismatchError
+	err = tree.Walk(WalkOpts{All: true, Dedup: true}, func(obj Object, depth int) (err error) {
+		err = tree.Db.verifyObject(obj.GetPath())
+		if e, ok := err.(*HashMismatchError); ok {
+			mismatch = e
 		}
+		return
+	})
+	if mismatch != nil {
+		return false, mismatch
 	}
+	Ck(err)
 	return true, nil
 }
 
-// traverse recurses down the tree of nodes returning leaves or optionally all nodes
-func (tree *Tree) traverse(all bool) (objects []Object, err error) {
-	defer Return(&err)
+// defFanout is the default maximum number of entries in each tree
+// built by PutStream.
+const defFanout = 64
+
+// treeBuilder assembles a balanced Merkle tree from a sequence of
+// leaf objects.  levels[0] collects leaves; whenever a level fills up
+// to Fanout entries, those entries are stored as a tree and the new
+// tree is added to the next level up.  Only one partially-filled node
+// per level is held in memory, so building a tree needs O(Fanout *
+// depth) memory regardless of stream length.
+type treeBuilder struct {
+	Db     *Db
+	Algo   string
+	Fanout int
+	levels [][]Object
+}
 
-	if tree.worm == nil {
-		file, err := OpenWorm(tree.Db, tree.Path)
-		Ck(err)
-		tree.worm = file
+func (b treeBuilder) New() *treeBuilder {
+	if b.Fanout < 2 {
+		b.Fanout = defFanout
 	}
+	return &b
+}
 
-	if all {
-		objects = append(objects, tree)
-	}
+// Add appends obj as the next leaf of the tree.
+func (b *treeBuilder) Add(obj Object) (err error) {
+	return b.add(0, obj)
+}
 
-	log.Debugf("traverse tree %#v", tree)
-	entries, err := tree.Entries()
+func (b *treeBuilder) add(level int, obj Object) (err error) {
+	defer Return(&err)
+	if level == len(b.levels) {
+		b.levels = append(b.levels, nil)
+	}
+	b.levels[level] = append(b.levels[level], obj)
+	if len(b.levels[level]) < b.Fanout {
+		return
+	}
+	// level is full -- store it and push it up
+	tree, err := b.Db.PutTree(b.Algo, b.levels[level]...)
 	Ck(err)
-	for _, obj := range entries {
-		log.Debugf("traverse obj %#v", obj)
-		switch child := obj.(type) {
-		case *Tree:
-			childobjs, err := child.traverse(all)
-			if err != nil {
-				return nil, err
+	b.levels[level] = nil
+	return b.add(level+1, tree)
+}
+
+// Root flushes any partially-filled levels and returns the root node.
+// Partial nodes are flushed bottom-up, so later data always ends up
+// to the right of earlier data.
+func (b *treeBuilder) Root() (root *Tree, err error) {
+	defer Return(&err)
+	var carry Object
+	for i, entries := range b.levels {
+		if carry != nil {
+			entries = append(entries, carry)
+			carry = nil
+		}
+		if len(entries) == 0 {
+			continue
+		}
+		if i == len(b.levels)-1 && len(entries) == 1 {
+			if tree, ok := entries[0].(*Tree); ok {
+				// top level holds exactly one tree; that's our root
+				return tree, nil
 			}
-			objects = append(objects, childobjs...)
-		case *Block:
-			objects = append(objects, obj)
-		default:
-			panic(fmt.Sprintf("unhandled type %T", child))
 		}
+		carry, err = b.Db.PutTree(b.Algo, entries...)
+		Ck(err)
 	}
-
-	return
+	if carry == nil {
+		// empty stream
+		return b.Db.PutTree(b.Algo)
+	}
+	return carry.(*Tree), nil
 }
@@ -2,9 +2,15 @@ package db
 
 import (
 	"bytes"
+	"errors"
+	"fmt"
 	"io"
+	"io/ioutil"
 	"math"
 	"math/rand"
+	"os"
+	"strings"
+	"sync"
 	"testing"
 
 	"github.com/hlubek/readercomp"
@@ -204,7 +210,7 @@ func TestTreeSeek(t *testing.T) {
 	// XXX try different tree sizes, including very small
 	treesize := int64(100 * miB)
 	stream := &predictableStream{Size: treesize}
-	tree, err := db.PutStream("sha256", stream)
+	tree, err := db.PutStream("sha256", stream, PutStreamOpts{})
 	tassert(t, err == nil, "PutStream(): %v", err)
 	tassert(t, tree != nil, "PutStream() tree is nil")
 
@@ -240,6 +246,157 @@ func TestTreeSeek(t *testing.T) {
 
 }
 
+// test concurrent ReadAt on one tree
+func TestTreeReadAt(t *testing.T) {
+	db := setup(t, nil)
+	tree, err := db.PutStream("sha256", &predictableStream{Size: 10 * miB}, PutStreamOpts{})
+	tck(t, err)
+	treesize, err := tree.Size()
+	tck(t, err)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(seed int64) {
+			defer wg.Done()
+			rnd := rand.New(rand.NewSource(seed))
+			for i := 0; i < 100; i++ {
+				off := rnd.Int63n(treesize)
+				buf := make([]byte, rnd.Int63n(100000)+1)
+				n, err := tree.ReadAt(buf, off)
+				if off+int64(len(buf)) > treesize {
+					if err != io.EOF || int64(n) != treesize-off {
+						errs <- fmt.Errorf("off %d len %d: got %d, %v", off, len(buf), n, err)
+						return
+					}
+				} else if err != nil || n != len(buf) {
+					errs <- fmt.Errorf("off %d len %d: got %d, %v", off, len(buf), n, err)
+					return
+				}
+				for j := 0; j < n; j++ {
+					if buf[j] != byte((off+int64(j))%256) {
+						errs <- fmt.Errorf("off %d: bad byte at %d", off, j)
+						return
+					}
+				}
+			}
+		}(int64(g))
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+
+	// the read cursor is untouched
+	pos, err := tree.Tell()
+	tck(t, err)
+	tassert(t, pos == 0, "pos %d", pos)
+	n, err := tree.ReadAt(make([]byte, 10), treesize)
+	tassert(t, n == 0 && err == io.EOF, "at end: %d, %v", n, err)
+	_, err = tree.ReadAt(make([]byte, 10), -1)
+	tassert(t, err != nil, "expected error for negative offset")
+}
+
+// ReadAt descends by offset in both tree formats, across leaf and
+// subtree boundaries
+func TestTreeReadAtSpans(t *testing.T) {
+	for _, version := range []int{TreeV1, TreeV2} {
+		db := setup(t, &Db{MinSize: 64, MaxSize: 128, Fanout: 3, TreeVersion: version})
+		data := goldenData(20000)
+		size := int64(len(data))
+		tree, err := db.PutStream("sha256", bytes.NewReader(data), PutStreamOpts{Chunker: ChunkFixed})
+		tck(t, err)
+		for _, span := range [][2]int64{{0, 1}, {127, 2}, {100, 1000}, {3000, 5000}, {size - 300, 300}, {size - 10, 20}} {
+			off, length := span[0], span[1]
+			buf := make([]byte, length)
+			n, err := tree.ReadAt(buf, off)
+			end := off + length
+			if end > size {
+				end = size
+				tassert(t, err == io.EOF, "v%d off %d: expected EOF, got %v", version, off, err)
+			} else {
+				tck(t, err)
+			}
+			tassert(t, bytes.Equal(buf[:n], data[off:end]), "v%d off %d: got %d bytes, expected %d", version, off, n, end-off)
+		}
+	}
+}
+
+func TestTreeV2(t *testing.T) {
+	db := setup(t, &Db{TreeVersion: TreeV2, Fanout: 4})
+	tree, err := db.PutStream("sha256", &predictableStream{Size: 2 * miB}, PutStreamOpts{})
+	tck(t, err)
+	stored, err := ioutil.ReadFile(tree.Path.Abs)
+	tck(t, err)
+	tassert(t, strings.HasPrefix(string(stored), "tree\nv2\n"), "stored %q", stored)
+	size, err := tree.Size()
+	tck(t, err)
+	tassert(t, size == 2*miB-1, "size %d", size)
+	expect := make([]byte, size)
+	for i := range expect {
+		expect[i] = byte(i % 256)
+	}
+
+	// the same content read back through v1 trees
+	v1 := setup(t, &Db{Poly: db.Poly, Fanout: 4})
+	tree1, err := v1.PutStream("sha256", &predictableStream{Size: 2 * miB}, PutStreamOpts{})
+	tck(t, err)
+	tassert(t, tree1.Path.Canon != tree.Path.Canon, "same address for both formats")
+	for _, tr := range []*Tree{tree, tree1} {
+		rand.Seed(42)
+		for i := 0; i < 100; i++ {
+			pos := rand.Int63n(size)
+			_, err = tr.Seek(pos, io.SeekStart)
+			tck(t, err)
+			buf := make([]byte, minInt(1000, size-pos))
+			_, err = io.ReadFull(tr, buf)
+			tck(t, err)
+			tassert(t, bytes.Equal(buf, expect[pos:pos+int64(len(buf))]), "mismatch at %d", pos)
+		}
+		pos, err := tr.Seek(0, io.SeekEnd)
+		tck(t, err)
+		tassert(t, pos == size, "end %d", pos)
+		n, err := tr.Read(make([]byte, 10))
+		tassert(t, n == 0 && err == io.EOF, "read at end: %d, %v", n, err)
+	}
+
+	// sizes come from the tree files, so leaves aren't opened
+	leaves, err := tree.Leaves()
+	tck(t, err)
+	err = os.Remove(leaves[0].GetPath().Abs)
+	tck(t, err)
+	got, err := tree.Size()
+	tck(t, err)
+	tassert(t, got == size, "size %d", got)
+
+	// v2 trees can hold v1 trees and vice versa
+	db.TreeVersion = TreeV1
+	a, err := db.PutBlock("sha256", mkbuf("abc"))
+	tck(t, err)
+	old, err := db.PutTree("sha256", a, a)
+	tck(t, err)
+	db.TreeVersion = TreeV2
+	mixed, err := old.AppendBlock("sha256", mkbuf("de"))
+	tck(t, err)
+	got, err = mixed.Size()
+	tck(t, err)
+	tassert(t, got == 8, "size %d", got)
+	_, err = mixed.Seek(4, io.SeekStart)
+	tck(t, err)
+	buf, err := ioutil.ReadAll(mixed)
+	tck(t, err)
+	tassert(t, string(buf) == "bcde", "got %q", buf)
+	txt, err := mixed.Txt()
+	tck(t, err)
+	lines := strings.Split(strings.TrimSpace(txt), "\n")
+	tassert(t, len(lines) == 2 && lines[0] == old.Path.Canon, "txt %q", txt)
+
+	_, err = Db{Dir: t.TempDir(), TreeVersion: 3}.Create()
+	tassert(t, err != nil, "expected error for tree version 3")
+}
+
 func minInt(a, b int64) int64 {
 	return int64(math.Min(float64(a), float64(b)))
 }
@@ -277,3 +434,69 @@ func TestVerify(t *testing.T) {
 	}
 	tassert(t, ok, "tree verify failed: %v", pretty(tree))
 }
+
+// a v2 tree whose entry sizes lie hashes fine, so fsck, Import, and
+// Push have to check the sizes themselves
+func TestTreeSizeLies(t *testing.T) {
+	src := setup(t, &Db{TreeVersion: TreeV2})
+	block, err := src.PutBlock("sha256", mkbuf("twelve bytes"))
+	tck(t, err)
+	file, err := CreateWorm(src, "tree", "sha256")
+	tck(t, err)
+	_, err = file.Write([]byte(fmt.Sprintf("%s\n%d %s\n", treeV2Magic, 1000, block.Path.Canon)))
+	tck(t, err)
+	err = file.Close()
+	tck(t, err)
+	tree, err := src.GetTree(file.Path)
+	tck(t, err)
+	size, err := tree.Size()
+	tck(t, err)
+	tassert(t, size == 1000, "size %d", size)
+	_, err = tree.LinkStream("liar")
+	tck(t, err)
+
+	report, err := src.Fsck(FsckOpts{})
+	tck(t, err)
+	tassert(t, len(report.Problems) == 1 && report.Problems[0].Kind == FsckCorrupt, "problems %v", report.Problems)
+	tassert(t, strings.Contains(report.Problems[0].Detail, "size mismatch"), "problems %v", report.Problems)
+
+	var buf bytes.Buffer
+	_, err = src.Export(&buf, []string{"liar"})
+	tck(t, err)
+	dst := setup(t, &Db{Poly: src.Poly, TreeVersion: TreeV2})
+	_, err = dst.Import(bytes.NewReader(buf.Bytes()))
+	tassert(t, err != nil && strings.Contains(err.Error(), "size mismatch"), "import: %v", err)
+	path, err := Path{}.New(dst, tree.Path.Canon)
+	tck(t, err)
+	tassert(t, !dst.Exists(path), "lying tree imported")
+
+	_, err = src.Push(dst, "liar", SyncOpts{})
+	tassert(t, errors.As(err, new(*SizeMismatchError)), "push: %v", err)
+	tassert(t, !dst.Exists(path), "lying tree pushed")
+}
+
+// openFds returns the number of open file descriptors, or -1 if the
+// platform doesn't say.
+func openFds() int {
+	infos, err := ioutil.ReadDir("/proc/self/fd")
+	if err != nil {
+		return -1
+	}
+	return len(infos)
+}
+
+func TestTreeV2Fds(t *testing.T) {
+	before := openFds()
+	if before < 0 {
+		t.Skip("no /proc/self/fd")
+	}
+	for _, version := range []int{TreeV1, TreeV2} {
+		db := setup(t, &Db{MinSize: 4 * kiB, MaxSize: 4 * kiB, Chunker: ChunkFixed, TreeVersion: version})
+		tree, err := db.PutStream("sha256", bytes.NewReader(goldenData(2*miB)), PutStreamOpts{})
+		tck(t, err)
+		err = db.checkTreeSizes(tree.Path)
+		tck(t, err)
+		after := openFds()
+		tassert(t, after <= before+2, "v%d: %d fds open before, %d after", version, before, after)
+	}
+}
@@ -0,0 +1,188 @@
+package db
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"syscall"
+
+	. "github.com/stevegt/goadapt"
+)
+
+// Tree file formats; see RFC-1003.  A v1 tree body is one canpath per
+// line.  A v2 body starts with a "v2" line, and each entry line is
+//
+//	<length> <canpath>
+//
+// where length is the number of content bytes under the entry, so
+// Size and Seek can skip whole subtrees without opening their leaves.
+// Both formats are always readable; Db.TreeVersion picks the one new
+// trees are written in.
+const (
+	TreeV1 = 1
+	TreeV2 = 2
+)
+
+const treeV2Magic = "v2"
+
+// treeEntry is one entry of a tree file.  size is -1 if the tree
+// file doesn't record it.
+type treeEntry struct {
+	path *Path
+	size int64
+}
+
+// treeVersion returns the format for new trees.  Dbs created before
+// TreeVersion was added to config.json write v1.
+func (db *Db) treeVersion() int {
+	if db.TreeVersion == 0 {
+		return TreeV1
+	}
+	return db.TreeVersion
+}
+
+// checkTreeVersion makes sure version is a tree format we can write.
+func checkTreeVersion(version int) (err error) {
+	if version < 0 || version > TreeV2 {
+		return fmt.Errorf("%w: unsupported tree version: %d", syscall.EINVAL, version)
+	}
+	return
+}
+
+// parseTree parses a tree body in either format.
+func parseTree(db *Db, rd io.Reader) (version int, entries []treeEntry, err error) {
+	defer Return(&err)
+	version = TreeV1
+	scanner := bufio.NewScanner(rd)
+	first := true
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if first {
+			first = false
+			if line == treeV2Magic {
+				version = TreeV2
+				continue
+			}
+		}
+		entry := treeEntry{size: -1}
+		if version == TreeV2 {
+			fields := strings.Fields(line)
+			ErrnoIf(len(fields) != 2, syscall.EINVAL, "malformed tree entry: %q", line)
+			size, err := strconv.ParseInt(fields[0], 10, 64)
+			ErrnoIf(err != nil || size < 0, syscall.EINVAL, "malformed tree entry: %q", line)
+			entry.size = size
+			line = fields[1]
+		}
+		entry.path, err = objectPath(db, line)
+		Ck(err)
+		entries = append(entries, entry)
+	}
+	err = scanner.Err()
+	Ck(err)
+	return
+}
+
+// encodeTree returns the body of a tree holding children, in the
+// given format.
+func encodeTree(version int, children []Object) (buf []byte, err error) {
+	defer Return(&err)
+	var sb strings.Builder
+	if version == TreeV2 {
+		sb.WriteString(treeV2Magic + "\n")
+	}
+	for _, child := range children {
+		canon := strings.TrimSpace(child.GetPath().Canon)
+		if version == TreeV2 {
+			size, err := entrySize(child)
+			Ck(err)
+			fmt.Fprintf(&sb, "%d %s\n", size, canon)
+			continue
+		}
+		sb.WriteString(canon + "\n")
+	}
+	return []byte(sb.String()), nil
+}
+
+// entrySize returns child's size for a v2 tree entry.  A block's Size
+// opens the block's file, so if the block wasn't open already,
+// entrySize closes it again; otherwise building a tree would hold a
+// file handle for every block in it.
+func entrySize(child Object) (size int64, err error) {
+	block, ok := child.(*Block)
+	if !ok || block.IsOpen() {
+		return child.Size()
+	}
+	defer block.Close()
+	return block.Size()
+}
+
+// readTree reads and parses tree's file.  It opens its own file
+// handle, so it doesn't disturb tree's read cursor.
+func (tree *Tree) readTree() (version int, entries []treeEntry, err error) {
+	defer Return(&err)
+	file, err := OpenWorm(tree.Db, tree.Path)
+	Ck(err)
+	defer file.Close()
+	version, entries, err = parseTree(tree.Db, file)
+	Ck(err, "%q", file.Path.Abs)
+	return
+}
+
+// SizeMismatchError is returned when a v2 tree records the wrong
+// size for one of its entries.  A tree's hash covers the sizes it
+// records, but not whether they're right, so a tree that lies about
+// them still hashes correctly.
+type SizeMismatchError struct {
+	Tree     *Path
+	Entry    *Path
+	Recorded int64
+	Actual   int64
+}
+
+func (e *SizeMismatchError) Error() string {
+	return fmt.Sprintf("size mismatch: %s records %d bytes for %s, which holds %d", e.Tree.Canon, e.Recorded, e.Entry.Canon, e.Actual)
+}
+
+// checkEntrySize compares the size a v2 tree at path records for
+// entry with the size of the entry in db, and returns a
+// *SizeMismatchError if they differ.  A subtree's size is the sum of
+// the sizes it records, so checking every tree, entries first,
+// checks them all.
+func (db *Db) checkEntrySize(path *Path, entry treeEntry) (err error) {
+	defer Return(&err)
+	if entry.size < 0 {
+		return
+	}
+	obj, err := db.ObjectFromPath(entry.path)
+	Ck(err)
+	defer obj.Close()
+	actual, err := obj.Size()
+	Ck(err)
+	if actual != entry.size {
+		return &SizeMismatchError{Tree: path, Entry: entry.path, Recorded: entry.size, Actual: actual}
+	}
+	return
+}
+
+// checkTreeSizes checks every size the tree at path records; see
+// checkEntrySize.
+func (db *Db) checkTreeSizes(path *Path) (err error) {
+	tree, err := db.GetTree(path)
+	if err != nil {
+		return
+	}
+	defer tree.Close()
+	_, entries, err := tree.readTree()
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		err = db.checkEntrySize(path, entry)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
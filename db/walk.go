@@ -0,0 +1,172 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	. "github.com/stevegt/goadapt"
+)
+
+// WalkOrder selects whether a tree is visited before or after its
+// entries.
+type WalkOrder int
+
+const (
+	PreOrder WalkOrder = iota
+	PostOrder
+)
+
+// WalkOpts controls the behavior of Tree.Walk and TreeIter.
+type WalkOpts struct {
+	Order WalkOrder
+	// All causes trees to be visited as well as leaves.
+	All bool
+	// Dedup causes shared subtrees and blocks to be visited only
+	// once.  This keeps a set of visited canpaths, so memory use
+	// grows with the number of unique objects.
+	Dedup bool
+}
+
+// SkipTree can be returned by a WalkFunc to skip the entries of the
+// tree it was just called with.  It is only meaningful in PreOrder
+// walks with All set.
+var SkipTree = errors.New("skip this tree")
+
+// WalkFunc is called by Tree.Walk for each object visited.  depth is
+// zero for the root tree.
+type WalkFunc func(obj Object, depth int) error
+
+// Walk visits the objects under tree in depth-first order, calling fn
+// for each.  Walk holds at most one tree's entries per level in
+// memory, so it can be used on trees of any size.
+func (tree *Tree) Walk(opts WalkOpts, fn WalkFunc) (err error) {
+	defer Return(&err)
+	iter := tree.Iter(opts)
+	for {
+		obj, depth, err := iter.Next()
+		if err == io.EOF {
+			break
+		}
+		Ck(err)
+		err = fn(obj, depth)
+		if err == SkipTree {
+			iter.Skip()
+			continue
+		}
+		Ck(err)
+	}
+	return
+}
+
+// Iter returns an iterator over the objects under tree.
+func (tree *Tree) Iter(opts WalkOpts) (iter *TreeIter) {
+	iter = &TreeIter{opts: opts}
+	iter.stack = []*iterFrame{{tree: tree}}
+	if opts.Dedup {
+		iter.visited = make(map[string]bool)
+	}
+	return
+}
+
+// TreeIter is a depth-first iterator over the objects in a Merkle
+// tree.  Use Tree.Iter to create one.
+type TreeIter struct {
+	opts    WalkOpts
+	stack   []*iterFrame
+	visited map[string]bool
+}
+
+type iterFrame struct {
+	tree    *Tree
+	entries []Object
+	next    int
+	entered bool
+	loaded  bool
+	skip    bool
+}
+
+// Next returns the next object in the walk along with its depth.  It
+// returns io.EOF when there are no more objects.
+func (iter *TreeIter) Next() (obj Object, depth int, err error) {
+	defer Return(&err)
+	for {
+		if len(iter.stack) == 0 {
+			return nil, 0, io.EOF
+		}
+		depth = len(iter.stack) - 1
+		frame := iter.stack[depth]
+
+		if !frame.entered {
+			frame.entered = true
+			if iter.seen(frame.tree) {
+				iter.pop()
+				continue
+			}
+			if iter.opts.All && iter.opts.Order == PreOrder {
+				return frame.tree, depth, nil
+			}
+		}
+
+		if !frame.loaded && !frame.skip {
+			frame.entries, err = frame.tree.readEntries()
+			Ck(err)
+			frame.loaded = true
+		}
+
+		if frame.skip || frame.next >= len(frame.entries) {
+			iter.pop()
+			if iter.opts.All && iter.opts.Order == PostOrder && !frame.skip {
+				return frame.tree, depth, nil
+			}
+			continue
+		}
+
+		entry := frame.entries[frame.next]
+		// drop our reference so finished entries can be collected
+		frame.entries[frame.next] = nil
+		frame.next++
+		switch child := entry.(type) {
+		case *Tree:
+			iter.stack = append(iter.stack, &iterFrame{tree: child})
+		case *Block:
+			if iter.seen(child) {
+				continue
+			}
+			return child, depth + 1, nil
+		default:
+			panic(fmt.Sprintf("unhandled type %T", child))
+		}
+	}
+}
+
+// Skip causes the entries of the tree most recently returned by Next
+// to be skipped.  It has no effect unless the walk is PreOrder and the
+// last object returned was a tree.
+func (iter *TreeIter) Skip() {
+	if len(iter.stack) == 0 {
+		return
+	}
+	frame := iter.stack[len(iter.stack)-1]
+	if !frame.loaded {
+		frame.skip = true
+	}
+}
+
+func (iter *TreeIter) pop() {
+	iter.stack = iter.stack[:len(iter.stack)-1]
+}
+
+// seen records obj in the visited set and reports whether it was
+// already there.  It always returns false unless Dedup is set.
+func (iter *TreeIter) seen(obj Object) bool {
+	if iter.visited == nil {
+		return false
+	}
+	canon := obj.GetPath().Canon
+	if iter.visited[canon] {
+		return true
+	}
+	iter.visited[canon] = true
+	return false
+}
@@ -0,0 +1,97 @@
+package db
+
+import (
+	"io"
+	"strings"
+	"testing"
+)
+
+// mkWalkTree builds a root tree that refers to a shared subtree twice:
+//
+//	root -> (tree1, block3, tree1)
+//	tree1 -> (block1, block2)
+func mkWalkTree(t *testing.T, db *Db) (root, tree1 *Tree, blocks []*Block) {
+	for _, s := range []string{"blob1value", "blob2value", "blob3value"} {
+		block, err := db.PutBlock("sha256", mkbuf(s))
+		tck(t, err)
+		blocks = append(blocks, block)
+	}
+	tree1, err := db.PutTree("sha256", blocks[0], blocks[1])
+	tck(t, err)
+	root, err = db.PutTree("sha256", tree1, blocks[2], tree1)
+	tck(t, err)
+	return
+}
+
+func walkStr(t *testing.T, tree *Tree, opts WalkOpts, skip string) string {
+	var out []string
+	err := tree.Walk(opts, func(obj Object, depth int) error {
+		canon := obj.GetPath().Canon
+		out = append(out, strings.Repeat(" ", depth)+canon)
+		if canon == skip {
+			return SkipTree
+		}
+		return nil
+	})
+	tck(t, err)
+	return strings.Join(out, "\n")
+}
+
+func TestWalk(t *testing.T) {
+	db := setup(t, nil)
+	root, tree1, blocks := mkWalkTree(t, db)
+	r := root.Path.Canon
+	t1 := tree1.Path.Canon
+	b1 := blocks[0].Path.Canon
+	b2 := blocks[1].Path.Canon
+	b3 := blocks[2].Path.Canon
+
+	// leaves only
+	got := walkStr(t, root, WalkOpts{}, "")
+	expect := strings.Join([]string{"  " + b1, "  " + b2, " " + b3, "  " + b1, "  " + b2}, "\n")
+	tassert(t, expect == got, "expected\n%s\ngot\n%s", expect, got)
+
+	// pre-order
+	got = walkStr(t, root, WalkOpts{All: true}, "")
+	expect = strings.Join([]string{r, " " + t1, "  " + b1, "  " + b2, " " + b3, " " + t1, "  " + b1, "  " + b2}, "\n")
+	tassert(t, expect == got, "expected\n%s\ngot\n%s", expect, got)
+
+	// post-order
+	got = walkStr(t, root, WalkOpts{All: true, Order: PostOrder}, "")
+	expect = strings.Join([]string{"  " + b1, "  " + b2, " " + t1, " " + b3, "  " + b1, "  " + b2, " " + t1, r}, "\n")
+	tassert(t, expect == got, "expected\n%s\ngot\n%s", expect, got)
+
+	// skip subtrees
+	got = walkStr(t, root, WalkOpts{All: true}, t1)
+	expect = strings.Join([]string{r, " " + t1, " " + b3, " " + t1}, "\n")
+	tassert(t, expect == got, "expected\n%s\ngot\n%s", expect, got)
+
+	// dedup shared subtrees
+	got = walkStr(t, root, WalkOpts{All: true, Dedup: true}, "")
+	expect = strings.Join([]string{r, " " + t1, "  " + b1, "  " + b2, " " + b3}, "\n")
+	tassert(t, expect == got, "expected\n%s\ngot\n%s", expect, got)
+}
+
+func TestTreeIter(t *testing.T) {
+	db := setup(t, nil)
+	root, _, _ := mkWalkTree(t, db)
+
+	iter := root.Iter(WalkOpts{})
+	var got []byte
+	for {
+		obj, _, err := iter.Next()
+		if err == io.EOF {
+			break
+		}
+		tck(t, err)
+		buf, err := db.GetBlock(obj.GetPath())
+		tck(t, err)
+		got = append(got, buf...)
+	}
+	expect := "blob1valueblob2valueblob3valueblob1valueblob2value"
+	tassert(t, expect == string(got), "expected %q got %q", expect, string(got))
+
+	// iterator stays at EOF
+	_, _, err := iter.Next()
+	tassert(t, err == io.EOF, "expected EOF, got %v", err)
+}
@@ -10,6 +10,7 @@ import (
 	"runtime"
 	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
@@ -184,8 +185,9 @@ var _ = (fs.NodeLookuper)((*algoNode)(nil))
 func (n *algoNode) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (child *fs.Inode, errno syscall.Errno) {
 	defer Unpanic(&errno, msglog)
 
+	// name may be an abbreviated hash
 	raw := filepath.Join("tree", n.algo, name)
-	path, err := pb.Path{}.New(n.db, raw)
+	path, err := n.db.Resolve(raw)
 	Ck(err)
 	child = n.NewInode(
 		ctx,
@@ -242,9 +244,7 @@ func (n *contentNode) Open(ctx context.Context, flags uint32) (fh fs.FileHandle,
 		return nil, 0, syscall.EREMOTE
 	}
 
-	// make a copy so tree.currentLeaf is unique
-	// XXX is this actually needed?
-	// XXX what about seek position within leaf file?
+	// reads use ReadAt, so the handle's tree cursor is never used
 	fh = &contentNode{
 		db:   n.db,
 		path: n.path,
@@ -285,24 +285,10 @@ var _ = (fs.FileReader)((*contentNode)(nil))
 func (fh *contentNode) Read(ctx context.Context, buf []byte, offset int64) (res fuse.ReadResult, errno syscall.Errno) {
 	defer Unpanic(&errno, msglog)
 
-	tree := fh.tree
-
-	// seek
-	_, err := tree.Seek(offset, io.SeekStart)
-	if err != nil {
-		log.Errorf("seek error: %#v", err)
-		return nil, syscall.EIO
-	}
-
-	// read
-	nread, err := tree.Read(buf)
-	if err == io.EOF {
-		if nread == 0 {
-			// XXX is this the right way to report EOF?
-			return nil, 0
-			// return fuse.ReadResultData(buf[:0]), 0
-		}
-	} else if err != nil {
+	// ReadAt leaves the tree's cursor alone, so concurrent reads
+	// on the same handle are safe
+	nread, err := fh.tree.ReadAt(buf, offset)
+	if err != nil && err != io.EOF {
 		log.Errorf("read error: %#v", err)
 		return nil, syscall.EIO
 	}
@@ -371,40 +357,75 @@ func (n *tagNode) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (
 
 // "new" node
 
+// newNode is a write-only file; each open of it creates a new stream,
+// and the data written is stored in the db when the file is closed.
 type newNode struct {
 	fs.Inode
-	db   *pb.Db
-	path *db.Path
-	tree *pb.Tree
+	db *pb.Db
 }
 
-var _ = (fs.FileWriter)((*newNode)(nil))
+var _ = (fs.NodeOpener)((*newNode)(nil))
 
-func (fh *newNode) Write(ctx context.Context, data []byte, off int64) (written uint32, errno syscall.Errno) {
+func (n *newNode) Open(ctx context.Context, flags uint32) (fh fs.FileHandle, fuseFlags uint32, errno syscall.Errno) {
 	defer Unpanic(&errno, msglog)
-	fmt.Println("Write called")
-	if fh.path != nil {
-		return 0, syscall.EEXIST
-	}
-	block, err := fh.db.PutBlock("sha256", data)
+	// XXX get algo from db
+	stream, err := n.db.CreateStream("sha256", "")
 	Ck(err)
-	fh.tree, err = fh.db.PutTree("sha256", block)
-	Ck(err)
-	fmt.Println(fh.tree.Path.Addr)
-	return uint32(len(data)), 0
+	fh = &newHandle{stream: stream}
+	return fh, fuse.FOPEN_DIRECT_IO, 0
+}
 
+var _ = (fs.NodeSetattrer)((*newNode)(nil))
+
+func (n *newNode) Setattr(ctx context.Context, f fs.FileHandle, in *fuse.SetAttrIn, out *fuse.AttrOut) syscall.Errno {
+	// allow O_TRUNC on open; there's nothing to truncate
+	return 0
 }
 
-var _ = (fs.NodeOpener)((*newNode)(nil))
+// newHandle is the file handle for one open of the "new" node.
+type newHandle struct {
+	mu     sync.Mutex
+	stream *pb.Stream
+	off    int64
+}
 
-func (fh *newNode) Open(ctx context.Context, flags uint32) (outfh fs.FileHandle, fuseFlags uint32, errno syscall.Errno) {
-	return fh, 0, 0
+var _ = (fs.FileWriter)((*newHandle)(nil))
+
+func (fh *newHandle) Write(ctx context.Context, data []byte, off int64) (written uint32, errno syscall.Errno) {
+	defer Unpanic(&errno, msglog)
+	fh.mu.Lock()
+	defer fh.mu.Unlock()
+	if fh.stream == nil {
+		return 0, syscall.EBADF
+	}
+	// streams are append-only
+	if off != fh.off {
+		return 0, syscall.ESPIPE
+	}
+	n, err := fh.stream.Write(data)
+	fh.off += int64(n)
+	Ck(err)
+	return uint32(n), 0
 }
 
-var _ = (fs.NodeSetattrer)((*newNode)(nil))
+var _ = (fs.FileFlusher)((*newHandle)(nil))
 
-func (fh *newNode) Setattr(ctx context.Context, f fs.FileHandle, in *fuse.SetAttrIn, out *fuse.AttrOut) syscall.Errno {
-	fmt.Printf("%#v\n", in)
+// Flush is called on close(2); we finish the stream here rather than
+// in Release so the caller's close doesn't return until the data is
+// stored.
+func (fh *newHandle) Flush(ctx context.Context) (errno syscall.Errno) {
+	defer Unpanic(&errno, msglog)
+	fh.mu.Lock()
+	defer fh.mu.Unlock()
+	if fh.stream == nil {
+		// already flushed, e.g. by a dup'd descriptor
+		return 0
+	}
+	stream := fh.stream
+	fh.stream = nil
+	err := stream.Close()
+	Ck(err)
+	fmt.Println(stream.RootNode.Path.Addr)
 	return 0
 }
 
@@ -139,13 +139,13 @@ func TestTreeFuse(t *testing.T) {
 		Test data: %s/%s
 		
 		`
-		fmt.Printf(info, mnt, mnt, mnt, tree2.Addr)
+		fmt.Printf(info, mnt, mnt, mnt, filepath.Join(tree2.Algo, tree2.Hash))
 		// Wait until unmount before exiting
 		server.Wait()
 		return
 	}
 
-	fn := filepath.Join(mnt, tree2.Addr, "content")
+	fn := filepath.Join(mnt, tree2.Algo, tree2.Hash, "content")
 	got, err := ioutil.ReadFile(fn)
 	tassert(t, err == nil, "%#v", err)
 	tassert(t, bytes.Compare(expect, got) == 0, "expect %s, got %v", string(expect), string(got))
@@ -0,0 +1,181 @@
+// Package gateway serves the content of a db read-only over HTTP:
+//
+//	GET /block/<algo>/<hash>          a block's content
+//	GET /tree/<algo>/<hash>           the concatenated leaves of a tree
+//	GET /object/<algo>/<hash>         either, whichever the hash names
+//	GET /stream/<label>               the tree a stream label points at
+//	GET /entries/tree/<algo>/<hash>   a tree's entries, as JSON
+//	GET /entries/stream/<label>       likewise for a stream
+//
+// Content supports Range requests, which read trees via Tree.ReadAt.
+// The ETag is the object's hash, so conditional requests work, and
+// content addresses are served as immutable.  Stream labels move, so
+// /stream/ responses must be revalidated; their Content-Location is
+// the tree's content address.
+package gateway
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	. "github.com/stevegt/goadapt"
+	pb "github.com/t7a/pitbase/db"
+)
+
+// cache headers
+const (
+	immutable = "public, max-age=31536000, immutable"
+	mutable   = "no-cache"
+)
+
+// Entry describes one entry of a tree in an entries listing.
+type Entry struct {
+	Path  string `json:"path"`  // canpath
+	Class string `json:"class"` // "block" or "tree"
+	Size  int64  `json:"size"`  // content size in bytes
+}
+
+// Listing is the response body of an entries request.
+type Listing struct {
+	Path    string  `json:"path"` // canpath of the tree
+	Entries []Entry `json:"entries"`
+}
+
+type handler struct {
+	db *pb.Db
+}
+
+// Handler returns an http.Handler serving db's content read-only.
+// Each request opens its own objects, so it's safe for concurrent
+// use.
+func Handler(db *pb.Db) http.Handler {
+	return &handler{db: db}
+}
+
+func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "read-only", http.StatusMethodNotAllowed)
+		return
+	}
+	err := h.serve(w, r)
+	if err != nil {
+		code := status(err)
+		if code == http.StatusInternalServerError {
+			log.Errorf("%s %s: %v", r.Method, r.URL.Path, err)
+		} else {
+			log.Debugf("%s %s: %v", r.Method, r.URL.Path, err)
+		}
+		http.Error(w, http.StatusText(code), code)
+	}
+}
+
+// status maps an error to an HTTP status code.
+func status(err error) int {
+	switch {
+	case errors.Is(err, syscall.ENOENT), errors.Is(err, os.ErrNotExist):
+		return http.StatusNotFound
+	case errors.Is(err, syscall.EINVAL):
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
+}
+
+func (h *handler) serve(w http.ResponseWriter, r *http.Request) (err error) {
+	defer Return(&err)
+	urlpath := strings.TrimPrefix(r.URL.Path, "/")
+	listing := false
+	if strings.HasPrefix(urlpath, "entries/") {
+		listing = true
+		urlpath = strings.TrimPrefix(urlpath, "entries/")
+	}
+	path, fixed, err := h.resolve(urlpath)
+	Ck(err)
+
+	hdr := w.Header()
+	if fixed {
+		hdr.Set("Cache-Control", immutable)
+	} else {
+		hdr.Set("Cache-Control", mutable)
+		hdr.Set("Content-Location", "/"+path.Canon)
+	}
+
+	if listing {
+		ErrnoIf(path.Class != "tree", syscall.EINVAL, "not a tree: %s", path.Canon)
+		buf, err := h.entries(path)
+		Ck(err)
+		// a different representation needs a different strong ETag
+		hdr.Set("ETag", fmt.Sprintf(`"entries-%s"`, path.Hash))
+		hdr.Set("Content-Type", "application/json")
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(buf))
+		return nil
+	}
+
+	obj, err := h.db.ObjectFromPath(path)
+	Ck(err)
+	defer obj.Close()
+	hdr.Set("ETag", fmt.Sprintf(`"%s"`, path.Hash))
+	// setting Content-Type keeps ServeContent from sniffing
+	hdr.Set("Content-Type", "application/octet-stream")
+	var content io.ReadSeeker = obj
+	if tree, ok := obj.(*pb.Tree); ok {
+		// ranges read via ReadAt, which finds leaves by offset
+		size, err := tree.Size()
+		Ck(err)
+		content = io.NewSectionReader(tree, 0, size)
+	}
+	http.ServeContent(w, r, "", time.Time{}, content)
+	return
+}
+
+// resolve maps a URL path, without its leading slash, to the object
+// it names.  fixed is true if urlpath is a content address.
+func (h *handler) resolve(urlpath string) (path *pb.Path, fixed bool, err error) {
+	defer Return(&err)
+	parts := strings.SplitN(urlpath, "/", 2)
+	switch parts[0] {
+	case "stream":
+		ErrnoIf(len(parts) < 2, syscall.ENOENT, "no stream label")
+		path, err = h.db.ResolveLabel(parts[1])
+		Ck(err)
+		return path, false, nil
+	case "block", "tree", "object":
+		ErrnoIf(strings.Count(urlpath, "/") != 2, syscall.ENOENT, "malformed address: %s", urlpath)
+		path, err = pb.Path{}.New(h.db, urlpath)
+		Ck(err)
+		ErrnoIf(!h.db.Exists(path), syscall.ENOENT, "not found: %s", urlpath)
+		return path, true, nil
+	}
+	ErrnoIf(true, syscall.ENOENT, "no such endpoint: /%s", urlpath)
+	return
+}
+
+// entries returns the JSON listing of the tree at path.
+func (h *handler) entries(path *pb.Path) (buf []byte, err error) {
+	defer Return(&err)
+	tree, err := h.db.GetTree(path)
+	Ck(err)
+	defer tree.Close()
+	objs, err := tree.Entries()
+	Ck(err)
+	listing := Listing{Path: path.Canon, Entries: []Entry{}}
+	for _, obj := range objs {
+		size, err := obj.Size()
+		obj.Close()
+		Ck(err)
+		epath := obj.GetPath()
+		listing.Entries = append(listing.Entries, Entry{Path: epath.Canon, Class: epath.Class, Size: size})
+	}
+	buf, err = json.Marshal(listing)
+	Ck(err)
+	return
+}
@@ -0,0 +1,138 @@
+package gateway
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	pb "github.com/t7a/pitbase/db"
+)
+
+// test boolean condition
+// XXX consolidate into a util or testutil package
+func tassert(t *testing.T, cond bool, txt string, args ...interface{}) {
+	t.Helper() // cause file:line info to show caller
+	if !cond {
+		t.Fatalf(txt, args...)
+	}
+}
+
+func tck(t *testing.T, err error) {
+	t.Helper()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func setup(t *testing.T) (db *pb.Db, srv *httptest.Server) {
+	dir := t.TempDir()
+	_, err := pb.Db{Dir: dir}.Create()
+	tck(t, err)
+	db, err = pb.Open(dir)
+	tck(t, err)
+	srv = httptest.NewServer(Handler(db))
+	t.Cleanup(srv.Close)
+	return
+}
+
+// get fetches url with optional headers given as name, value pairs.
+func get(t *testing.T, method, url string, hdrs ...string) (resp *http.Response, body string) {
+	t.Helper()
+	req, err := http.NewRequest(method, url, nil)
+	tck(t, err)
+	for i := 0; i+1 < len(hdrs); i += 2 {
+		req.Header.Set(hdrs[i], hdrs[i+1])
+	}
+	resp, err = http.DefaultClient.Do(req)
+	tck(t, err)
+	defer resp.Body.Close()
+	buf, err := ioutil.ReadAll(resp.Body)
+	tck(t, err)
+	return resp, string(buf)
+}
+
+func TestGateway(t *testing.T) {
+	db, srv := setup(t)
+	one, err := db.PutBlock("sha256", []byte("hello "))
+	tck(t, err)
+	two, err := db.PutBlock("sha256", []byte("world\n"))
+	tck(t, err)
+	sub, err := db.PutTree("sha256", two)
+	tck(t, err)
+	tree, err := db.PutTree("sha256", one, sub)
+	tck(t, err)
+	_, err = tree.LinkStream("dir/s1")
+	tck(t, err)
+
+	// blocks and trees
+	resp, body := get(t, "GET", srv.URL+"/"+one.Path.Canon)
+	tassert(t, resp.StatusCode == 200 && body == "hello ", "%d %q", resp.StatusCode, body)
+	tassert(t, resp.Header.Get("ETag") == `"`+one.Path.Hash+`"`, "etag %q", resp.Header.Get("ETag"))
+	tassert(t, strings.Contains(resp.Header.Get("Cache-Control"), "immutable"), "cache %q", resp.Header.Get("Cache-Control"))
+	resp, body = get(t, "GET", srv.URL+"/"+tree.Path.Canon)
+	tassert(t, resp.StatusCode == 200 && body == "hello world\n", "%d %q", resp.StatusCode, body)
+	resp, body = get(t, "HEAD", srv.URL+"/"+tree.Path.Canon)
+	tassert(t, resp.StatusCode == 200 && body == "", "%d %q", resp.StatusCode, body)
+	tassert(t, resp.ContentLength == 12, "length %d", resp.ContentLength)
+	resp, body = get(t, "GET", srv.URL+"/object/"+tree.Path.Algo+"/"+tree.Path.Hash)
+	tassert(t, resp.StatusCode == 200 && body == "hello world\n", "%d %q", resp.StatusCode, body)
+
+	// ranges, across a leaf boundary
+	resp, body = get(t, "GET", srv.URL+"/"+tree.Path.Canon, "Range", "bytes=4-8")
+	tassert(t, resp.StatusCode == 206 && body == "o wor", "%d %q", resp.StatusCode, body)
+	resp, body = get(t, "GET", srv.URL+"/"+tree.Path.Canon, "Range", "bytes=-3")
+	tassert(t, resp.StatusCode == 206 && body == "ld\n", "%d %q", resp.StatusCode, body)
+	resp, _ = get(t, "GET", srv.URL+"/"+tree.Path.Canon, "Range", "bytes=100-")
+	tassert(t, resp.StatusCode == 416, "%d", resp.StatusCode)
+
+	// conditional requests
+	etag := `"` + tree.Path.Hash + `"`
+	resp, body = get(t, "GET", srv.URL+"/"+tree.Path.Canon, "If-None-Match", etag)
+	tassert(t, resp.StatusCode == 304 && body == "", "%d %q", resp.StatusCode, body)
+	resp, body = get(t, "GET", srv.URL+"/"+tree.Path.Canon, "Range", "bytes=0-4", "If-Range", etag)
+	tassert(t, resp.StatusCode == 206 && body == "hello", "%d %q", resp.StatusCode, body)
+
+	// streams
+	resp, body = get(t, "GET", srv.URL+"/stream/dir/s1")
+	tassert(t, resp.StatusCode == 200 && body == "hello world\n", "%d %q", resp.StatusCode, body)
+	tassert(t, resp.Header.Get("ETag") == etag, "etag %q", resp.Header.Get("ETag"))
+	tassert(t, resp.Header.Get("Cache-Control") == "no-cache", "cache %q", resp.Header.Get("Cache-Control"))
+	tassert(t, resp.Header.Get("Content-Location") == "/"+tree.Path.Canon, "location %q", resp.Header.Get("Content-Location"))
+	resp, body = get(t, "GET", srv.URL+"/stream/dir/s1@%7B0%7D")
+	tassert(t, resp.StatusCode == 200 && body == "hello world\n", "%d %q", resp.StatusCode, body)
+
+	// entries
+	resp, body = get(t, "GET", srv.URL+"/entries/stream/dir/s1")
+	tassert(t, resp.StatusCode == 200, "%d %q", resp.StatusCode, body)
+	tassert(t, resp.Header.Get("Content-Type") == "application/json", "type %q", resp.Header.Get("Content-Type"))
+	var listing Listing
+	err = json.Unmarshal([]byte(body), &listing)
+	tck(t, err)
+	tassert(t, listing.Path == tree.Path.Canon && len(listing.Entries) == 2, "listing %+v", listing)
+	tassert(t, listing.Entries[0] == Entry{Path: one.Path.Canon, Class: "block", Size: 6}, "entry %+v", listing.Entries[0])
+	tassert(t, listing.Entries[1] == Entry{Path: sub.Path.Canon, Class: "tree", Size: 6}, "entry %+v", listing.Entries[1])
+	resp, _ = get(t, "GET", srv.URL+"/entries/"+one.Path.Canon)
+	tassert(t, resp.StatusCode == 400, "%d", resp.StatusCode)
+
+	// errors
+	missing := "/block/sha256/" + strings.Repeat("0", 64)
+	for url, code := range map[string]int{
+		missing: 404,
+		"/object/sha256/" + strings.Repeat("0", 64): 404,
+		"/stream/nosuch":      404,
+		"/stream/.hidden":     404,
+		"/stream/a@{1":        400,
+		"/block/sha256":       404,
+		"/object/sha256/1234": 400,
+		"/nosuch/sha256/1234": 404,
+		"/":                   404,
+	} {
+		resp, _ = get(t, "GET", srv.URL+url)
+		tassert(t, resp.StatusCode == code, "%s: got %d, expected %d", url, resp.StatusCode, code)
+	}
+	resp, _ = get(t, "PUT", srv.URL+"/"+one.Path.Canon)
+	tassert(t, resp.StatusCode == 405, "%d", resp.StatusCode)
+}
@@ -20,6 +20,7 @@ import (
 	. "github.com/stevegt/goadapt"
 	pb "github.com/t7a/pitbase/db"
 	"github.com/vmihailenco/msgpack"
+	"github.com/vmihailenco/msgpack/codes"
 )
 
 // XXX init(), caller(), and GetGID() are copies of the same from
@@ -223,7 +224,39 @@ func (pit *Pit) Serve(fn string) (err error) {
 	return
 }
 
+// Addr is any address pb.Path.New accepts.  In msgpack messages, a
+// digest, algo:hex, is sent as a binary multihash; anything else is
+// sent as a string.
 type Addr string
+
+// EncodeMsgpack implements msgpack.CustomEncoder.
+func (addr Addr) EncodeMsgpack(enc *msgpack.Encoder) error {
+	buf, err := pb.EncodeMultihash(string(addr))
+	if err != nil {
+		return enc.EncodeString(string(addr))
+	}
+	return enc.EncodeBytes(buf)
+}
+
+// DecodeMsgpack implements msgpack.CustomDecoder.
+func (addr *Addr) DecodeMsgpack(dec *msgpack.Decoder) (err error) {
+	defer Return(&err)
+	code, err := dec.PeekCode()
+	Ck(err)
+	if !codes.IsBin(code) {
+		s, err := dec.DecodeString()
+		Ck(err)
+		*addr = Addr(s)
+		return nil
+	}
+	buf, err := dec.DecodeBytes()
+	Ck(err)
+	digest, err := pb.DecodeMultihash(buf)
+	Ck(err)
+	*addr = Addr(digest)
+	return
+}
+
 type Callback func(Request) error
 
 type Dispatcher struct {
@@ -407,8 +440,14 @@ func (pit *Pit) imageSave(algo, img string) (tree *pb.Tree, err error) {
 	Ck(err)
 	imgrd, err := os.Open(path)
 	Ck(err)
-	tree, err = pit.Db.PutStream(algo, imgrd)
+	defer imgrd.Close()
+	stream, err := pit.Db.CreateStream(algo, "")
+	Ck(err)
+	_, err = io.Copy(stream, imgrd)
+	Ck(err)
+	err = stream.Close()
 	Ck(err)
+	tree = stream.RootNode
 
 	/*
 		ctx := context.Background()
@@ -423,7 +462,7 @@ func (pit *Pit) imageSave(algo, img string) (tree *pb.Tree, err error) {
 
 		// save image as a stream
 		saverd, err := cli.ImageSave(ctx, []string{img})
-		tree, err = pit.Db.PutStream(algo, saverd)
+		tree, err = pit.Db.PutStream(algo, saverd, pb.PutStreamOpts{})
 	*/
 	return
 }
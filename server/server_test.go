@@ -64,6 +64,25 @@ func TestMsgPack(t *testing.T) {
 
 }
 
+func TestMsgPackDigest(t *testing.T) {
+	digest := "sha256:1adab0720df1e5e62a8d2e7866a4a84dafcdfb71dde10443fdac950d8066623b"
+	req, err := Parse(digest + " hello world")
+	tassert(t, err == nil, "%v", err)
+	asDigest, err := msgpack.Marshal(req)
+	tassert(t, err == nil, "%v", err)
+
+	var got Request
+	err = msgpack.Unmarshal(asDigest, &got)
+	tassert(t, err == nil, "%v", err)
+	tassert(t, req.Compare(&got), "got %#v", got)
+
+	// the digest goes out as a multihash, not as text
+	req.Addr = Addr(strings.Replace(digest, ":", "/", 1))
+	asPath, err := msgpack.Marshal(req)
+	tassert(t, err == nil, "%v", err)
+	tassert(t, len(asDigest) < len(asPath)-30, "digest %d bytes, path %d bytes", len(asDigest), len(asPath))
+}
+
 func TestPitDir(t *testing.T) {
 	err := os.Setenv("PITDIR", "/dev/null")
 	tassert(t, err == nil, "%v", err)
@@ -263,7 +282,7 @@ func TestRunTree(t *testing.T) {
 	tassert(t, tree != nil, "%v", tree)
 
 	// run the image from the pitbase stream
-	addr := "tree/" + tree.Path.Addr
+	addr := tree.Path.Addr
 	err = echoTest(t, pit, addr, "hello")
 	tassert(t, err == nil, "%v", err)
 }
@@ -428,7 +447,7 @@ func TestImageTree(t *testing.T) {
 
 	// unpack image into a runc-compatible directory tree
 	cntr := &Container{
-		Image: "tree/" + tree.Addr,
+		Image: tree.Addr,
 		pit:   pit,
 	}
 